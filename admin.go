@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/joshghent/ango/client"
+	"github.com/joshghent/ango/cmd"
+)
+
+// openAdminBackend returns the backend for the commands in cmd: the HTTP API
+// at apiURL if it is set, otherwise the configured database. The returned
+// function closes the backend.
+func openAdminBackend(ctx context.Context, apiURL string) (cmd.Backend, func(), error) {
+	if apiURL != "" {
+		var opts []client.Option
+		if key := os.Getenv("ANGO_API_KEY"); key != "" {
+			opts = append(opts, client.WithAPIKey(key))
+		}
+		if token := os.Getenv("ANGO_TOKEN"); token != "" {
+			opts = append(opts, client.WithBearerToken(token))
+		}
+		return client.New(apiURL, opts...), func() {}, nil
+	}
+
+	if isSQLiteURL(appConfig.Database.URL) {
+		store, err := OpenSQLiteStore(ctx, appConfig.Database.URL)
+		if err != nil {
+			return nil, nil, err
+		}
+		return storeBackend{store}, func() { store.Close() }, nil
+	}
+
+	pool, err := connectToDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkSchema(ctx, pool); err != nil {
+		pool.Close()
+		return nil, nil, fmt.Errorf("database schema does not match this build, run \"migrate up\": %w", err)
+	}
+	return postgresBackend{storeBackend{NewPostgresStore(pool)}, pool}, pool.Close, nil
+}
+
+// storeBackend runs the commands in cmd against a store, using the same
+// service functions as the API.
+type storeBackend struct {
+	store Store
+}
+
+func (b storeBackend) ListBatches(ctx context.Context) ([]client.Batch, error) {
+	batches, err := getBatches(ctx, b.store)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]client.Batch, len(batches))
+	for i, batch := range batches {
+		result[i] = toClientBatch(batch)
+	}
+	return result, nil
+}
+
+func (b storeBackend) CreateBatch(ctx context.Context, name string, rules client.Rules) (client.Batch, error) {
+	batch, err := newBatch(ctx, b.store, BatchRequest{Name: name, Rules: Rules(rules)})
+	return toClientBatch(batch), err
+}
+
+func (b storeBackend) ExpireBatch(ctx context.Context, batchID string) (client.Batch, error) {
+	batch, err := expireBatch(ctx, b.store, batchID)
+	return toClientBatch(batch), err
+}
+
+func (b storeBackend) GetBatchInventory(ctx context.Context, batchID string) (client.BatchInventory, error) {
+	inventory, err := getBatchInventory(ctx, b.store, batchID)
+	return client.BatchInventory{
+		Batch:     toClientBatch(inventory.Batch),
+		Inventory: client.Inventory{Total: inventory.Total, Redeemed: inventory.Redeemed, Available: inventory.Available},
+	}, err
+}
+
+func (b storeBackend) UploadCodes(ctx context.Context, upload client.Upload) (string, error) {
+	codes, err := readCodesCSV(upload.CSV)
+	if err != nil {
+		return "", err
+	}
+	var rules Rules
+	if upload.Rules != nil {
+		rules = Rules(*upload.Rules)
+	}
+	return uploadBatch(ctx, b.store, upload.BatchName, rules, codes)
+}
+
+func (b storeBackend) ListBatchRedemptions(ctx context.Context, batchID string, q client.RedemptionQuery) (client.RedemptionPage, error) {
+	if _, err := uuid.Parse(batchID); err != nil {
+		return client.RedemptionPage{}, &ValidationError{Detail: "invalid batch_id format"}
+	}
+	if _, err := b.store.GetBatch(ctx, strings.ToLower(batchID)); err != nil {
+		return client.RedemptionPage{}, err
+	}
+
+	filter := RedemptionFilter{
+		BatchID:  strings.ToLower(batchID),
+		ClientID: strings.ToLower(q.ClientID),
+		From:     q.From,
+		To:       q.To,
+		Limit:    q.Limit,
+	}
+	if filter.Limit < 1 || filter.Limit > maxRedemptionsLimit {
+		filter.Limit = defaultRedemptionsLimit
+	}
+	if q.Cursor != "" {
+		cursor, err := parseRedemptionCursor(q.Cursor)
+		if err != nil {
+			return client.RedemptionPage{}, err
+		}
+		filter.Cursor = cursor
+	}
+
+	page, err := getRedemptions(ctx, b.store, filter)
+	if err != nil {
+		return client.RedemptionPage{}, err
+	}
+	result := client.RedemptionPage{Redemptions: make([]client.Redemption, len(page.Redemptions)), NextCursor: page.NextCursor}
+	for i, r := range page.Redemptions {
+		result.Redemptions[i] = client.Redemption{
+			Code:       r.Code,
+			BatchID:    r.BatchID,
+			BatchName:  r.BatchName,
+			ClientID:   r.ClientID,
+			CustomerID: r.CustomerID,
+			RedeemedAt: r.RedeemedAt,
+			RequestID:  r.RequestID,
+		}
+	}
+	return result, nil
+}
+
+func toClientBatch(batch Batch) client.Batch {
+	return client.Batch{ID: batch.ID, Name: batch.Name, Rules: client.Rules(batch.Rules), Expired: batch.Expired}
+}
+
+// postgresBackend adds API key management to storeBackend, as only the
+// Postgres schema has the api_keys table.
+type postgresBackend struct {
+	storeBackend
+	pool *pgxpool.Pool
+}
+
+// apiKeyPrefix makes keys easy to recognise, e.g. by secret scanners.
+const apiKeyPrefix = "ango_"
+
+var apiKeyScopes = []string{ScopeCodesRedeem, ScopeCodesUpload, ScopeBatchesRead, ScopeBatchesAdmin}
+
+// CreateAPIKey stores only the key's digest, so the key is returned once.
+func (b postgresBackend) CreateAPIKey(ctx context.Context, req cmd.APIKeyRequest) (cmd.APIKey, string, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return cmd.APIKey{}, "", &ValidationError{Detail: "name is required"}
+	}
+	if len(req.Scopes) == 0 {
+		return cmd.APIKey{}, "", &ValidationError{Detail: "at least one scope is required"}
+	}
+	for _, scope := range req.Scopes {
+		if !containsString(apiKeyScopes, scope) {
+			return cmd.APIKey{}, "", &ValidationError{Detail: fmt.Sprintf("unknown scope %q, expected one of %s", scope, strings.Join(apiKeyScopes, ", "))}
+		}
+	}
+	if req.ClientID != "" {
+		req.ClientID = strings.ToLower(req.ClientID)
+		if err := validateClients(ctx, b.store, []string{req.ClientID}); err != nil {
+			return cmd.APIKey{}, "", err
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return cmd.APIKey{}, "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	apiKey := cmd.APIKey{ID: uuid.New().String(), Name: req.Name, Scopes: req.Scopes, ClientID: req.ClientID}
+	var clientID *string
+	if req.ClientID != "" {
+		clientID = &req.ClientID
+	}
+	err := b.pool.QueryRow(ctx, `
+		INSERT INTO api_keys (id, name, key_hash, scopes, client_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`, apiKey.ID, apiKey.Name, hashAPIKey(key), apiKey.Scopes, clientID).Scan(&apiKey.CreatedAt)
+	if err != nil {
+		return cmd.APIKey{}, "", err
+	}
+	return apiKey, key, nil
+}
+
+func (b postgresBackend) ListAPIKeys(ctx context.Context) ([]cmd.APIKey, error) {
+	rows, err := b.pool.Query(ctx, `
+		SELECT id, name, scopes, client_id, created_at, revoked_at
+		FROM api_keys
+		ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []cmd.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey keeps the key's row, so that it still explains the key ID in
+// old logs.
+func (b postgresBackend) RevokeAPIKey(ctx context.Context, id string) (cmd.APIKey, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return cmd.APIKey{}, &ValidationError{Detail: "invalid key id format"}
+	}
+	key, err := scanAPIKey(b.pool.QueryRow(ctx, `
+		UPDATE api_keys
+		SET revoked_at = COALESCE(revoked_at, NOW())
+		WHERE id = $1
+		RETURNING id, name, scopes, client_id, created_at, revoked_at
+	`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return cmd.APIKey{}, cmd.ErrNoAPIKeyFound
+	}
+	return key, err
+}
+
+func scanAPIKey(row pgx.Row) (cmd.APIKey, error) {
+	var key cmd.APIKey
+	var clientID *string
+	var createdAt time.Time
+	var revokedAt *time.Time
+	if err := row.Scan(&key.ID, &key.Name, &key.Scopes, &clientID, &createdAt, &revokedAt); err != nil {
+		return cmd.APIKey{}, err
+	}
+	if clientID != nil {
+		key.ClientID = *clientID
+	}
+	key.CreatedAt = createdAt.UTC()
+	if revokedAt != nil {
+		revoked := revokedAt.UTC()
+		key.RevokedAt = &revoked
+	}
+	return key, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
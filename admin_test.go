@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/joshghent/ango/client"
+	"github.com/joshghent/ango/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAdminCommands runs the commands against a store directly and through
+// the HTTP API, which should behave the same.
+func TestAdminCommands(t *testing.T) {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		t.Fatalf("Unable to load the OpenAPI document: %v", err)
+	}
+
+	backends := map[string]func(t *testing.T, store Store) cmd.Backend{
+		"Store": func(t *testing.T, store Store) cmd.Backend {
+			return storeBackend{store}
+		},
+		"HTTP": func(t *testing.T, store Store) cmd.Backend {
+			router := gin.New()
+			router.Use(requestID())
+			registerRoutes(router, store, spec)
+			srv := httptest.NewServer(router)
+			t.Cleanup(srv.Close)
+			return client.New(srv.URL)
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryStore()
+			partner, err := createClient(ctx, store, ClientRequest{Name: "Partner"})
+			assert.NoError(t, err)
+			backend := newBackend(t, store)
+
+			run := func(stdin string, args ...string) (string, error) {
+				var out bytes.Buffer
+				env := cmd.Env{
+					Open:   func(context.Context) (cmd.Backend, error) { return backend, nil },
+					Stdin:  strings.NewReader(stdin),
+					Stdout: &out,
+				}
+				err := cmd.Run(ctx, env, args)
+				return out.String(), err
+			}
+
+			codes, err := run("", "codes", "generate", "--client", partner.ID, "--count", "3", "--prefix", "SPRING-")
+			assert.NoError(t, err)
+
+			out, err := run(codes, "codes", "upload", "--name", "Spring", "--max-per-customer", "1", "--output", "json", "-")
+			assert.NoError(t, err)
+			var upload struct {
+				BatchID string `json:"batch_id"`
+			}
+			assert.NoError(t, json.Unmarshal([]byte(out), &upload))
+
+			code, err := getCode(ctx, store, Request{BatchID: upload.BatchID, ClientID: partner.ID, CustomerID: "customer-1"})
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(code, "SPRING-"))
+
+			out, err = run("", "batches", "stats", "--output", "json")
+			assert.NoError(t, err)
+			var stats []client.BatchInventory
+			assert.NoError(t, json.Unmarshal([]byte(out), &stats))
+			if assert.Len(t, stats, 1) {
+				assert.Equal(t, "Spring", stats[0].Name)
+				assert.Equal(t, 1, stats[0].Rules.MaxPerCustomer)
+				assert.Equal(t, client.Inventory{Total: 3, Redeemed: 1, Available: 2}, stats[0].Inventory)
+			}
+
+			out, err = run("", "redemptions", "export", "--batch", upload.BatchID, "--output", "csv")
+			assert.NoError(t, err)
+			records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+			assert.NoError(t, err)
+			if assert.Len(t, records, 2) {
+				assert.Equal(t, []string{code, partner.ID, "customer-1"}, records[1][1:4])
+			}
+
+			out, err = run("", "batches", "expire", upload.BatchID)
+			assert.NoError(t, err)
+			assert.Contains(t, out, upload.BatchID)
+			batch, err := store.GetBatch(ctx, upload.BatchID)
+			assert.NoError(t, err)
+			assert.True(t, batch.Expired)
+
+			out, err = run("", "batches", "create", "--name", "Summer", "--output", "json")
+			assert.NoError(t, err)
+			var created client.Batch
+			assert.NoError(t, json.Unmarshal([]byte(out), &created))
+			assert.Equal(t, "Summer", created.Name)
+
+			// Expired batches aren't listed
+			out, err = run("", "batches", "list")
+			assert.NoError(t, err)
+			assert.Contains(t, out, "Summer")
+			assert.NotContains(t, out, "Spring")
+
+			_, err = run("", "batches", "expire", "00000000-0000-0000-0000-000000000000")
+			assert.ErrorIs(t, err, batchNotFoundError(name))
+
+			_, err = run("not,a,csv\n", "codes", "upload", "--name", "Broken", "-")
+			assert.Error(t, err)
+
+			// The columns are found by name, and a rejected upload
+			// doesn't leave a batch behind
+			before, err := store.GetBatches(ctx)
+			assert.NoError(t, err)
+			_, err = run("code,client_id\nAUTUMN-1,"+partner.ID+"\nAUTUMN-2,"+uuid.New().String()+"\n", "codes", "upload", "--name", "Autumn", "-")
+			assert.Error(t, err)
+			after, err := store.GetBatches(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, len(before), len(after))
+
+			out, err = run("code,client_id\nAUTUMN-1,"+partner.ID+"\n", "codes", "upload", "--name", "Autumn", "--output", "json", "-")
+			assert.NoError(t, err)
+			assert.NoError(t, json.Unmarshal([]byte(out), &upload))
+			code, err = getCode(ctx, store, Request{BatchID: upload.BatchID, ClientID: partner.ID, CustomerID: "customer-1"})
+			assert.NoError(t, err)
+			assert.Equal(t, "AUTUMN-1", code)
+
+			_, err = run("", "keys", "list")
+			assert.ErrorIs(t, err, cmd.ErrKeysUnsupported)
+		})
+	}
+}
+
+// batchNotFoundError is the error each backend returns for a missing batch.
+func batchNotFoundError(backend string) error {
+	if backend == "HTTP" {
+		return client.ErrNoBatchFound
+	}
+	return ErrNoBatchFound
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrLeaseLost = errors.New("the lease on a code was lost before it was claimed")
+
+// leaseTimeout bounds each lease, renew and flush query.
+const leaseTimeout = 10 * time.Second
+
+// Allocator serves redemptions for the configured batches from blocks of
+// codes leased to this instance, instead of a SELECT and UPDATE per request.
+// Claims are committed in batches and a request only gets its code once the
+// batch containing it has been written, so a crash never hands a code out
+// twice. Leases are renewed while the instance runs and released when it
+// stops; if it dies they expire and the codes can be leased again.
+//
+// Every other Store method, and redemptions from other batches, go straight
+// to the underlying Store.
+type Allocator struct {
+	Store
+	leaser  CodeLeaser
+	owner   string
+	cfg     AllocatorConfig
+	batches map[string]bool
+
+	mu       sync.Mutex
+	pools    map[allocatorKey]*codePool
+	claims   chan *pendingClaim
+	pending  map[string]int           // Claims per customer that have not been flushed yet
+	checking map[string]chan struct{} // Closed when the customer's rule check finishes
+}
+
+type allocatorKey struct {
+	batchID  string
+	clientID string
+}
+
+// codePool holds the leased codes for a batch and client. All fields are
+// guarded by Allocator.mu.
+type codePool struct {
+	codes      []string
+	validUntil time.Time     // When the oldest lease in the pool runs out, less a safety margin
+	refill     chan struct{} // Closed when the in-progress refill completes, nil otherwise
+	refillErr  error
+	leased     int // Codes leased by the last refill
+}
+
+type pendingClaim struct {
+	key allocatorKey
+	CodeAssignment
+	done chan error
+
+	// Guarded by Allocator.mu. A claim that is abandoned before it is
+	// flushed is skipped, and one being flushed can no longer be abandoned.
+	abandoned bool
+	flushing  bool
+}
+
+func NewAllocator(store Store, leaser CodeLeaser, cfg AllocatorConfig) *Allocator {
+	hostname, _ := os.Hostname()
+	a := &Allocator{
+		Store:    store,
+		leaser:   leaser,
+		owner:    fmt.Sprintf("%s-%s", hostname, uuid.New().String()[:8]),
+		cfg:      cfg,
+		batches:  map[string]bool{},
+		pools:    map[allocatorKey]*codePool{},
+		claims:   make(chan *pendingClaim, cfg.FlushSize),
+		pending:  map[string]int{},
+		checking: map[string]chan struct{}{},
+	}
+	for _, id := range cfg.Batches {
+		a.batches[strings.ToLower(id)] = true
+	}
+	return a
+}
+
+// margin is how long before a lease expires its codes stop being served, so
+// that a claim taken just before then is still flushed inside the lease.
+func (a *Allocator) margin() time.Duration {
+	return a.cfg.LeaseDuration / 10
+}
+
+func (a *Allocator) ClaimCode(ctx context.Context, batchID, clientID, customerID string, check func(ctx context.Context) error) (string, error) {
+	if !a.batches[strings.ToLower(batchID)] {
+		return a.Store.ClaimCode(ctx, batchID, clientID, customerID, check)
+	}
+
+	key := allocatorKey{batchID: strings.ToLower(batchID), clientID: strings.ToLower(clientID)}
+	code, err := a.take(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	// The customer's claims are checked one at a time, so that each check
+	// counts the claims before it that are still waiting to be flushed
+	unlock, err := a.lockCustomer(ctx, customerID)
+	if err != nil {
+		a.giveBack(key, code)
+		return "", err
+	}
+	if err := check(ctx); err != nil {
+		unlock()
+		a.giveBack(key, code)
+		return "", err
+	}
+
+	claim := &pendingClaim{key: key, done: make(chan error, 1), CodeAssignment: CodeAssignment{
+		BatchID:        key.batchID,
+		ClientID:       key.clientID,
+		Code:           code,
+		CustomerID:     customerID,
+		RequestID:      requestIDFromContext(ctx),
+		IdempotencyKey: idempotencyKeyFromContext(ctx),
+	}}
+	a.mu.Lock()
+	a.pending[customerID]++
+	a.mu.Unlock()
+	unlock()
+
+	select {
+	case a.claims <- claim:
+	case <-ctx.Done():
+		a.abandon(claim)
+		return "", ctx.Err()
+	}
+
+	select {
+	case err := <-claim.done:
+		if err != nil {
+			return "", err
+		}
+		return code, nil
+	case <-ctx.Done():
+		if a.abandon(claim) {
+			return "", ctx.Err()
+		}
+		// The claim is being flushed and may be committed, so wait for it
+		// rather than lose the code
+		if err := <-claim.done; err != nil {
+			return "", err
+		}
+		return code, nil
+	}
+}
+
+// CountRedemptions adds the customer's claims that have not been flushed
+// yet, so that a burst of redemptions can't get past max_per_customer.
+func (a *Allocator) CountRedemptions(ctx context.Context, customerID string, since time.Time) (int, error) {
+	count, err := a.Store.CountRedemptions(ctx, customerID, since)
+	if err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return count + a.pending[customerID], nil
+}
+
+// lockCustomer waits until no other claim for the customer is being checked.
+// The returned function unlocks the customer.
+func (a *Allocator) lockCustomer(ctx context.Context, customerID string) (func(), error) {
+	for {
+		a.mu.Lock()
+		wait, busy := a.checking[customerID]
+		if !busy {
+			done := make(chan struct{})
+			a.checking[customerID] = done
+			a.mu.Unlock()
+			return func() {
+				a.mu.Lock()
+				delete(a.checking, customerID)
+				a.mu.Unlock()
+				close(done)
+			}, nil
+		}
+		a.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// abandon gives the claim's code back if the claim has not started to be
+// flushed. It returns false if it has, as the claim may then be committed.
+func (a *Allocator) abandon(claim *pendingClaim) bool {
+	a.mu.Lock()
+	if claim.flushing {
+		a.mu.Unlock()
+		return false
+	}
+	claim.abandoned = true
+	a.unflushed(claim)
+	a.mu.Unlock()
+
+	a.giveBack(claim.key, claim.Code)
+	return true
+}
+
+// unflushed removes the claim from the customer's pending claims. It must be
+// called with a.mu held.
+func (a *Allocator) unflushed(claim *pendingClaim) {
+	if a.pending[claim.CustomerID]--; a.pending[claim.CustomerID] <= 0 {
+		delete(a.pending, claim.CustomerID)
+	}
+}
+
+// take removes a code from the pool, leasing a new block if it is empty.
+func (a *Allocator) take(ctx context.Context, key allocatorKey) (string, error) {
+	for {
+		a.mu.Lock()
+		pool, found := a.pools[key]
+		if !found {
+			pool = &codePool{}
+			a.pools[key] = pool
+		}
+		if len(pool.codes) > 0 && time.Now().After(pool.validUntil) {
+			// The leases were not renewed in time and the codes may be leased elsewhere
+			pool.codes = nil
+		}
+
+		if n := len(pool.codes); n > 0 {
+			code := pool.codes[n-1]
+			pool.codes = pool.codes[:n-1]
+			if len(pool.codes) < a.cfg.BlockSize/4 && pool.refill == nil {
+				a.startRefill(key, pool)
+			}
+			a.mu.Unlock()
+			return code, nil
+		}
+
+		if pool.refill == nil {
+			a.startRefill(key, pool)
+		}
+		wait := pool.refill
+		a.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+
+		a.mu.Lock()
+		err, leased, remaining := pool.refillErr, pool.leased, len(pool.codes)
+		a.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		if leased == 0 && remaining == 0 {
+			return "", ErrNoCodeFound
+		}
+	}
+}
+
+// startRefill leases another block in the background. It must be called
+// with a.mu held.
+func (a *Allocator) startRefill(key allocatorKey, pool *codePool) {
+	done := make(chan struct{})
+	pool.refill = done
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), leaseTimeout)
+		defer cancel()
+
+		start := time.Now()
+		codes, err := a.leaser.LeaseCodes(ctx, key.batchID, key.clientID, a.owner, a.cfg.BlockSize, a.cfg.LeaseDuration)
+		if err != nil {
+			slog.Error("Error leasing codes", "batch_id", key.batchID, "client_id", key.clientID, "error", err)
+		}
+
+		a.mu.Lock()
+		pool.refillErr = err
+		pool.leased = len(codes)
+		if len(codes) > 0 {
+			if len(pool.codes) == 0 {
+				pool.validUntil = start.Add(a.cfg.LeaseDuration - a.margin())
+			}
+			// Codes are taken from the end, so the older block is served first
+			pool.codes = append(codes, pool.codes...)
+		}
+		pool.refill = nil
+		a.mu.Unlock()
+		close(done)
+	}()
+}
+
+func (a *Allocator) giveBack(key allocatorKey, code string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if pool, found := a.pools[key]; found && time.Now().Before(pool.validUntil) {
+		pool.codes = append(pool.codes, code)
+	}
+}
+
+// Run commits claims and renews leases until ctx is cancelled, then flushes
+// any remaining claims and releases the unused codes.
+func (a *Allocator) Run(ctx context.Context) {
+	renew := time.NewTicker(a.cfg.LeaseDuration / 3)
+	defer renew.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.stop()
+			return
+		case <-renew.C:
+			a.renew()
+		case claim := <-a.claims:
+			a.flush(a.collect(claim))
+		}
+	}
+}
+
+// collect gathers claims until flush_size is reached or flush_interval passes.
+func (a *Allocator) collect(first *pendingClaim) []*pendingClaim {
+	batch := []*pendingClaim{first}
+	timer := time.NewTimer(a.cfg.FlushInterval)
+	defer timer.Stop()
+
+	for len(batch) < a.cfg.FlushSize {
+		select {
+		case claim := <-a.claims:
+			batch = append(batch, claim)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (a *Allocator) flush(claims []*pendingClaim) {
+	a.mu.Lock()
+	batch := claims[:0]
+	for _, claim := range claims {
+		if !claim.abandoned {
+			claim.flushing = true
+			batch = append(batch, claim)
+		}
+	}
+	a.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseTimeout)
+	defer cancel()
+
+	assignments := make([]CodeAssignment, len(batch))
+	for i, claim := range batch {
+		assignments[i] = claim.CodeAssignment
+	}
+
+	err := a.leaser.AssignLeasedCodes(ctx, a.owner, assignments)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrDuplicateIdempotencyKey) && len(batch) > 1:
+		// Only the retried redemptions should fail, so commit the claims one
+		// at a time
+		for _, claim := range batch {
+			a.flush([]*pendingClaim{claim})
+		}
+		return
+	case errors.Is(err, ErrLeaseLost):
+		// Some of the codes in memory may have been handed out elsewhere, so
+		// start again from a fresh set of leases
+		slog.Error("Lost leased codes, releasing every lease", "owner", a.owner)
+		a.reset(ctx)
+	case errors.Is(err, ErrDuplicateIdempotencyKey):
+		a.giveBack(batch[0].key, batch[0].Code)
+	default:
+		slog.Error("Error committing claimed codes", "count", len(batch), "error", err)
+		for _, claim := range batch {
+			a.giveBack(claim.key, claim.Code)
+		}
+	}
+
+	// Once flushed, committed claims are counted by the store
+	a.mu.Lock()
+	for _, claim := range batch {
+		a.unflushed(claim)
+	}
+	a.mu.Unlock()
+
+	for _, claim := range batch {
+		claim.done <- err
+	}
+}
+
+func (a *Allocator) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := a.leaser.RenewLeases(ctx, a.owner, a.cfg.LeaseDuration); err != nil {
+		slog.Error("Error renewing code leases", "owner", a.owner, "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, pool := range a.pools {
+		pool.validUntil = start.Add(a.cfg.LeaseDuration - a.margin())
+	}
+}
+
+func (a *Allocator) reset(ctx context.Context) {
+	a.mu.Lock()
+	for _, pool := range a.pools {
+		pool.codes = nil
+	}
+	a.mu.Unlock()
+
+	if err := a.leaser.ReleaseLeases(ctx, a.owner); err != nil {
+		slog.Error("Error releasing code leases", "owner", a.owner, "error", err)
+	}
+}
+
+func (a *Allocator) stop() {
+	for drained := false; !drained; {
+		select {
+		case claim := <-a.claims:
+			a.flush(a.collect(claim))
+		default:
+			drained = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseTimeout)
+	defer cancel()
+	a.reset(ctx)
+	slog.Info("Released leased codes", "owner", a.owner)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAllocator(t *testing.T, store *MemoryStore, cfg AllocatorConfig) *Allocator {
+	allocator := NewAllocator(store, store, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		allocator.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return allocator
+}
+
+// blockingLeaser holds each flush until release is closed.
+type blockingLeaser struct {
+	*MemoryStore
+	flushing chan struct{}
+	release  chan struct{}
+}
+
+func (l *blockingLeaser) AssignLeasedCodes(ctx context.Context, owner string, assignments []CodeAssignment) error {
+	l.flushing <- struct{}{}
+	<-l.release
+	return l.MemoryStore.AssignLeasedCodes(ctx, owner, assignments)
+}
+
+func testAllocatorConfig(batchID string) AllocatorConfig {
+	return AllocatorConfig{
+		Batches:       []string{batchID},
+		BlockSize:     8,
+		LeaseDuration: time.Minute,
+		FlushInterval: time.Millisecond,
+		FlushSize:     10,
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Concurrent claims are unique and committed", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, store, Rules{}, 20)
+		allocator := newTestAllocator(t, store, testAllocatorConfig(batchID))
+
+		var mu sync.Mutex
+		claimed := map[string]bool{}
+		noCode := 0
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				code, err := getCode(ctx, allocator, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+				mu.Lock()
+				defer mu.Unlock()
+				if err == ErrNoCodeFound {
+					noCode++
+					return
+				}
+				assert.NoError(t, err)
+				assert.False(t, claimed[code], "code %s was claimed twice", code)
+				claimed[code] = true
+			}()
+		}
+		wg.Wait()
+
+		assert.Len(t, claimed, 20)
+		assert.Equal(t, 30, noCode)
+
+		// Every code was written to the store before it was returned
+		inventory, err := getClientInventory(ctx, store, clientID)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, inventory.Available)
+	})
+
+	t.Run("Failed rules return the code to the pool", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, store, Rules{}, 1)
+		allocator := newTestAllocator(t, store, testAllocatorConfig(batchID))
+
+		failed := func(ctx context.Context) error { return ErrConditionNotMet }
+		_, err := allocator.ClaimCode(ctx, batchID, clientID, uuid.New().String(), failed)
+		assert.Equal(t, ErrConditionNotMet, err)
+
+		code, err := getCode(ctx, allocator, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, code)
+	})
+
+	t.Run("Other batches use the store", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, _ := newTestBatch(t, store, Rules{}, 1)
+		otherID, clientID := newTestBatch(t, store, Rules{}, 1)
+		allocator := newTestAllocator(t, store, testAllocatorConfig(batchID))
+
+		_, err := getCode(ctx, allocator, Request{BatchID: otherID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+
+		allocator.mu.Lock()
+		assert.Empty(t, allocator.pools)
+		allocator.mu.Unlock()
+	})
+
+	t.Run("Unused codes are released on shutdown", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, store, Rules{}, 5)
+		allocator := NewAllocator(store, store, testAllocatorConfig(batchID))
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			allocator.Run(runCtx)
+			close(done)
+		}()
+
+		_, err := getCode(ctx, allocator, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+
+		// The rest of the batch is leased, so it can't be claimed directly
+		_, err = getCode(ctx, store, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.Equal(t, ErrNoCodeFound, err)
+
+		cancel()
+		<-done
+
+		_, err = getCode(ctx, store, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Expired leases can be taken by another instance", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, store, Rules{}, 2)
+
+		// An instance that died without releasing its leases
+		_, err := store.LeaseCodes(ctx, batchID, clientID, "crashed", 2, time.Millisecond)
+		assert.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+
+		allocator := newTestAllocator(t, store, testAllocatorConfig(batchID))
+		code, err := getCode(ctx, allocator, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, code)
+
+		// The crashed instance can no longer commit its codes
+		assert.Equal(t, ErrLeaseLost, store.AssignLeasedCodes(ctx, "crashed", []CodeAssignment{{BatchID: batchID, Code: code, CustomerID: uuid.New().String()}}))
+	})
+
+	t.Run("Unflushed claims count towards max per customer", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, store, Rules{MaxPerCustomer: 2}, 10)
+		cfg := testAllocatorConfig(batchID)
+		cfg.FlushInterval = 50 * time.Millisecond
+		allocator := newTestAllocator(t, store, cfg)
+		customerID := uuid.New().String()
+
+		var mu sync.Mutex
+		redeemed := 0
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := getCode(ctx, allocator, Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+				if err == nil {
+					mu.Lock()
+					redeemed++
+					mu.Unlock()
+				} else {
+					assert.ErrorIs(t, err, ErrConditionNotMet)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, 2, redeemed)
+		count, err := store.CountRedemptions(ctx, customerID, time.Time{})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+	})
+
+	t.Run("Concurrent retries get the same code", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, store, Rules{}, 10)
+		cfg := testAllocatorConfig(batchID)
+		cfg.FlushInterval = 50 * time.Millisecond
+		allocator := newTestAllocator(t, store, cfg)
+		req := Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()}
+		keyCtx := withIdempotencyKey(ctx, "key-1")
+
+		// The retries are flushed with another customer's claim, which
+		// must still be committed
+		var other string
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			other, err = getCode(ctx, allocator, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+			assert.NoError(t, err)
+		}()
+
+		codes := make([]string, 5)
+		for i := range codes {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var err error
+				codes[i], err = getCode(keyCtx, allocator, req)
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		for _, code := range codes {
+			assert.Equal(t, codes[0], code)
+		}
+		assert.NotEqual(t, other, codes[0])
+		inventory, err := getClientInventory(ctx, store, clientID)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, inventory.Redeemed)
+	})
+
+	t.Run("Cancelled claims are not lost", func(t *testing.T) {
+		store := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, store, Rules{}, 5)
+		leaser := &blockingLeaser{MemoryStore: store, flushing: make(chan struct{}, 1), release: make(chan struct{})}
+		cfg := testAllocatorConfig(batchID)
+		cfg.FlushSize = 1
+		allocator := NewAllocator(store, leaser, cfg)
+		runCtx, stop := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			allocator.Run(runCtx)
+			close(done)
+		}()
+
+		type result struct {
+			code string
+			err  error
+		}
+		claim := func(ctx context.Context) chan result {
+			results := make(chan result, 1)
+			go func() {
+				code, err := allocator.ClaimCode(ctx, batchID, clientID, uuid.New().String(), func(context.Context) error { return nil })
+				results <- result{code, err}
+			}()
+			return results
+		}
+
+		// The first claim is being flushed when its request is cancelled
+		flushingCtx, cancelFlushing := context.WithCancel(ctx)
+		flushing := claim(flushingCtx)
+		<-leaser.flushing
+
+		// The second is still queued behind it
+		queuedCtx, cancelQueued := context.WithCancel(ctx)
+		queued := claim(queuedCtx)
+		assert.Eventually(t, func() bool { return len(allocator.claims) == 1 }, time.Second, time.Millisecond)
+
+		cancelQueued()
+		r := <-queued
+		assert.ErrorIs(t, r.err, context.Canceled)
+
+		cancelFlushing()
+		close(leaser.release)
+		r = <-flushing
+		assert.NoError(t, r.err)
+		assert.NotEmpty(t, r.code)
+
+		stop()
+		<-done
+
+		// Only the first claim was committed, and the queued code was released
+		inventory, err := getClientInventory(ctx, store, clientID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, inventory.Redeemed)
+		code, err := getCode(ctx, store, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+		assert.NotEqual(t, r.code, code)
+	})
+}
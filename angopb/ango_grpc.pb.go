@@ -0,0 +1,312 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: angopb/ango.proto
+
+package angopb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Ango_Redeem_FullMethodName        = "/ango.v1.Ango/Redeem"
+	Ango_ListBatches_FullMethodName   = "/ango.v1.Ango/ListBatches"
+	Ango_GetBatch_FullMethodName      = "/ango.v1.Ango/GetBatch"
+	Ango_UploadCodes_FullMethodName   = "/ango.v1.Ango/UploadCodes"
+	Ango_GetBatchStats_FullMethodName = "/ango.v1.Ango/GetBatchStats"
+)
+
+// AngoClient is the client API for Ango service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AngoClient interface {
+	// Redeem claims a code from the batch for the customer. Requires the
+	// codes:redeem scope.
+	Redeem(ctx context.Context, in *RedeemRequest, opts ...grpc.CallOption) (*RedeemResponse, error)
+	// ListBatches returns every batch that has not expired. Requires the
+	// batches:read scope.
+	ListBatches(ctx context.Context, in *ListBatchesRequest, opts ...grpc.CallOption) (*ListBatchesResponse, error)
+	// GetBatch requires the batches:read scope.
+	GetBatch(ctx context.Context, in *GetBatchRequest, opts ...grpc.CallOption) (*Batch, error)
+	// UploadCodes creates a batch and adds codes to it. The first message
+	// describes the batch, and the rest carry its codes. Either every code is
+	// added or none are. Requires the codes:upload scope.
+	UploadCodes(ctx context.Context, opts ...grpc.CallOption) (Ango_UploadCodesClient, error)
+	// GetBatchStats counts the batch's codes across every client. Requires the
+	// batches:read scope.
+	GetBatchStats(ctx context.Context, in *GetBatchStatsRequest, opts ...grpc.CallOption) (*BatchStats, error)
+}
+
+type angoClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAngoClient(cc grpc.ClientConnInterface) AngoClient {
+	return &angoClient{cc}
+}
+
+func (c *angoClient) Redeem(ctx context.Context, in *RedeemRequest, opts ...grpc.CallOption) (*RedeemResponse, error) {
+	out := new(RedeemResponse)
+	err := c.cc.Invoke(ctx, Ango_Redeem_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *angoClient) ListBatches(ctx context.Context, in *ListBatchesRequest, opts ...grpc.CallOption) (*ListBatchesResponse, error) {
+	out := new(ListBatchesResponse)
+	err := c.cc.Invoke(ctx, Ango_ListBatches_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *angoClient) GetBatch(ctx context.Context, in *GetBatchRequest, opts ...grpc.CallOption) (*Batch, error) {
+	out := new(Batch)
+	err := c.cc.Invoke(ctx, Ango_GetBatch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *angoClient) UploadCodes(ctx context.Context, opts ...grpc.CallOption) (Ango_UploadCodesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Ango_ServiceDesc.Streams[0], Ango_UploadCodes_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &angoUploadCodesClient{stream}
+	return x, nil
+}
+
+type Ango_UploadCodesClient interface {
+	Send(*UploadCodesRequest) error
+	CloseAndRecv() (*UploadCodesResponse, error)
+	grpc.ClientStream
+}
+
+type angoUploadCodesClient struct {
+	grpc.ClientStream
+}
+
+func (x *angoUploadCodesClient) Send(m *UploadCodesRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *angoUploadCodesClient) CloseAndRecv() (*UploadCodesResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(UploadCodesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *angoClient) GetBatchStats(ctx context.Context, in *GetBatchStatsRequest, opts ...grpc.CallOption) (*BatchStats, error) {
+	out := new(BatchStats)
+	err := c.cc.Invoke(ctx, Ango_GetBatchStats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AngoServer is the server API for Ango service.
+// All implementations must embed UnimplementedAngoServer
+// for forward compatibility
+type AngoServer interface {
+	// Redeem claims a code from the batch for the customer. Requires the
+	// codes:redeem scope.
+	Redeem(context.Context, *RedeemRequest) (*RedeemResponse, error)
+	// ListBatches returns every batch that has not expired. Requires the
+	// batches:read scope.
+	ListBatches(context.Context, *ListBatchesRequest) (*ListBatchesResponse, error)
+	// GetBatch requires the batches:read scope.
+	GetBatch(context.Context, *GetBatchRequest) (*Batch, error)
+	// UploadCodes creates a batch and adds codes to it. The first message
+	// describes the batch, and the rest carry its codes. Either every code is
+	// added or none are. Requires the codes:upload scope.
+	UploadCodes(Ango_UploadCodesServer) error
+	// GetBatchStats counts the batch's codes across every client. Requires the
+	// batches:read scope.
+	GetBatchStats(context.Context, *GetBatchStatsRequest) (*BatchStats, error)
+	mustEmbedUnimplementedAngoServer()
+}
+
+// UnimplementedAngoServer must be embedded to have forward compatible implementations.
+type UnimplementedAngoServer struct {
+}
+
+func (UnimplementedAngoServer) Redeem(context.Context, *RedeemRequest) (*RedeemResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Redeem not implemented")
+}
+func (UnimplementedAngoServer) ListBatches(context.Context, *ListBatchesRequest) (*ListBatchesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBatches not implemented")
+}
+func (UnimplementedAngoServer) GetBatch(context.Context, *GetBatchRequest) (*Batch, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBatch not implemented")
+}
+func (UnimplementedAngoServer) UploadCodes(Ango_UploadCodesServer) error {
+	return status.Errorf(codes.Unimplemented, "method UploadCodes not implemented")
+}
+func (UnimplementedAngoServer) GetBatchStats(context.Context, *GetBatchStatsRequest) (*BatchStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBatchStats not implemented")
+}
+func (UnimplementedAngoServer) mustEmbedUnimplementedAngoServer() {}
+
+// UnsafeAngoServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AngoServer will
+// result in compilation errors.
+type UnsafeAngoServer interface {
+	mustEmbedUnimplementedAngoServer()
+}
+
+func RegisterAngoServer(s grpc.ServiceRegistrar, srv AngoServer) {
+	s.RegisterService(&Ango_ServiceDesc, srv)
+}
+
+func _Ango_Redeem_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RedeemRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AngoServer).Redeem(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ango_Redeem_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AngoServer).Redeem(ctx, req.(*RedeemRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ango_ListBatches_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBatchesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AngoServer).ListBatches(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ango_ListBatches_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AngoServer).ListBatches(ctx, req.(*ListBatchesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ango_GetBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AngoServer).GetBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ango_GetBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AngoServer).GetBatch(ctx, req.(*GetBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Ango_UploadCodes_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AngoServer).UploadCodes(&angoUploadCodesServer{stream})
+}
+
+type Ango_UploadCodesServer interface {
+	SendAndClose(*UploadCodesResponse) error
+	Recv() (*UploadCodesRequest, error)
+	grpc.ServerStream
+}
+
+type angoUploadCodesServer struct {
+	grpc.ServerStream
+}
+
+func (x *angoUploadCodesServer) SendAndClose(m *UploadCodesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *angoUploadCodesServer) Recv() (*UploadCodesRequest, error) {
+	m := new(UploadCodesRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Ango_GetBatchStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBatchStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AngoServer).GetBatchStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Ango_GetBatchStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AngoServer).GetBatchStats(ctx, req.(*GetBatchStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Ango_ServiceDesc is the grpc.ServiceDesc for Ango service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Ango_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ango.v1.Ango",
+	HandlerType: (*AngoServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Redeem",
+			Handler:    _Ango_Redeem_Handler,
+		},
+		{
+			MethodName: "ListBatches",
+			Handler:    _Ango_ListBatches_Handler,
+		},
+		{
+			MethodName: "GetBatch",
+			Handler:    _Ango_GetBatch_Handler,
+		},
+		{
+			MethodName: "GetBatchStats",
+			Handler:    _Ango_GetBatchStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "UploadCodes",
+			Handler:       _Ango_UploadCodes_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "angopb/ango.proto",
+}
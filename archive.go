@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// archivableBatchesQuery selects the batches with nothing left to redeem:
+// expired batches, and batches whose codes have all been claimed.
+const archivableBatchesQuery = `
+	SELECT b.id, b.name
+	FROM batches b
+	WHERE b.archived_at IS NULL
+	  AND (b.expired OR (
+		EXISTS (SELECT 1 FROM codes c WHERE c.batch_id = b.id)
+		AND NOT EXISTS (SELECT 1 FROM codes c WHERE c.batch_id = b.id AND c.customer_id IS NULL)
+	  ))
+	ORDER BY b.name, b.id
+`
+
+// runArchiveCommand implements "ango archive", which moves the codes of
+// batches with nothing left to redeem into codes_archive.
+func runArchiveCommand(ctx context.Context, pool *pgxpool.Pool, args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	flags.SetOutput(w)
+	dryRun := flags.Bool("dry-run", false, "list the batches that would be archived without archiving them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: ango archive [--dry-run]")
+	}
+
+	type batch struct{ id, name string }
+	var batches []batch
+	rows, err := pool.Query(ctx, archivableBatchesQuery)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var b batch
+		if err := rows.Scan(&b.id, &b.name); err != nil {
+			rows.Close()
+			return err
+		}
+		batches = append(batches, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, b := range batches {
+		if *dryRun {
+			fmt.Fprintf(w, "Would archive %s (%s)\n", b.id, b.name)
+			continue
+		}
+		archived, err := archiveBatch(ctx, pool, b.id)
+		if err != nil {
+			return fmt.Errorf("archiving batch %s: %w", b.id, err)
+		}
+		fmt.Fprintf(w, "Archived %s (%s): %d codes\n", b.id, b.name, archived)
+	}
+	if len(batches) == 0 {
+		fmt.Fprintln(w, "No batches to archive")
+	}
+	return nil
+}
+
+// archiveBatch moves a batch's codes to codes_archive and marks it archived.
+// The batch row is updated first, so that concurrent runs archive it once.
+func archiveBatch(ctx context.Context, pool *pgxpool.Pool, batchID string) (int64, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE batches SET archived_at = NOW() WHERE id = $1 AND archived_at IS NULL", batchID)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, nil
+	}
+
+	tag, err = tx.Exec(ctx, `
+		INSERT INTO codes_archive (code, batch_id, client_id, customer_id)
+		SELECT code, batch_id, client_id, customer_id FROM codes WHERE batch_id = $1
+	`, batchID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM codes WHERE batch_id = $1", batchID); err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v4"
+)
+
+// Scopes that can be granted to a JWT or API key. Each route registered in
+// main requires exactly one of these.
+const (
+	ScopeCodesRedeem  = "codes:redeem"
+	ScopeCodesUpload  = "codes:upload"
+	ScopeBatchesRead  = "batches:read"
+	ScopeBatchesAdmin = "batches:admin"
+)
+
+const principalKey = "ango.principal"
+
+var (
+	ErrMissingCredentials = errors.New("no credentials were provided")
+	ErrInvalidToken       = errors.New("the bearer token is invalid")
+	ErrInvalidAPIKey      = errors.New("the api key is invalid")
+	authConfig            = AuthConfig{} // Populated by loadAuthConfig in main
+)
+
+// impliedScopes lists the scopes that are granted implicitly by another scope.
+var impliedScopes = map[string][]string{
+	ScopeBatchesAdmin: {ScopeBatchesRead},
+}
+
+type AuthConfig struct {
+	Enabled       bool
+	JWTSecret     []byte
+	JWKS          map[string]crypto.PublicKey // keyed by "kid"
+	Issuer        string
+	Audience      string
+	ClientIDClaim string // if set, the client_id is taken from this claim instead of the request body
+	StaticAPIKeys []string
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject  string
+	ClientID string
+	APIKeyID string
+	Scopes   []string
+}
+
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+		for _, implied := range impliedScopes[s] {
+			if implied == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadAuthConfig prepares the authentication settings for use by the
+// middleware. Authentication is enabled as soon as a JWT secret, JWKS file or
+// static API key is configured, or when it is explicitly enabled.
+func loadAuthConfig(settings AuthSettings) (AuthConfig, error) {
+	cfg := AuthConfig{
+		Issuer:        settings.Issuer,
+		Audience:      settings.Audience,
+		ClientIDClaim: settings.ClientIDClaim,
+		StaticAPIKeys: settings.APIKeys,
+	}
+
+	if settings.JWTSecret != "" {
+		cfg.JWTSecret = []byte(settings.JWTSecret)
+	}
+
+	if settings.JWKSFile != "" {
+		keys, err := loadJWKSFile(settings.JWKSFile)
+		if err != nil {
+			return AuthConfig{}, err
+		}
+		cfg.JWKS = keys
+	}
+
+	cfg.Enabled = len(cfg.JWTSecret) > 0 || len(cfg.JWKS) > 0 || len(cfg.StaticAPIKeys) > 0 || settings.Enabled
+
+	return cfg, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadJWKSFile parses a local JSON Web Key Set containing RSA and/or EC public keys.
+func loadJWKSFile(path string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS file: %v", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS file: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key at index %d in JWKS file: %v", i, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URLInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URLInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBase64URLInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URLInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// requireScope returns middleware that authenticates the caller and checks
+// that they have been granted scope. It is a no-op when auth is disabled.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authConfig.Enabled {
+			c.Next()
+			return
+		}
+
+		principal, err := authenticate(c)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="ango"`)
+			respondWithProblem(c, 401, ProblemUnauthorized, "unauthorized")
+			return
+		}
+		if !principal.HasScope(scope) {
+			respondWithProblem(c, 403, ProblemForbidden, "insufficient scope, requires "+scope)
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// principalFromContext returns the authenticated caller, if auth is enabled.
+func principalFromContext(c *gin.Context) (Principal, bool) {
+	v, ok := c.Get(principalKey)
+	if !ok {
+		return Principal{}, false
+	}
+	p, ok := v.(Principal)
+	return p, ok
+}
+
+func authenticate(c *gin.Context) (Principal, error) {
+	return authenticateCredentials(c.Request.Context(), c.GetHeader("Authorization"), c.GetHeader("X-API-Key"))
+}
+
+// authenticateCredentials checks the value of the Authorization or X-API-Key
+// header, which gRPC requests send as metadata of the same name.
+func authenticateCredentials(ctx context.Context, authorization, apiKey string) (Principal, error) {
+	if authorization != "" {
+		token, found := strings.CutPrefix(authorization, "Bearer ")
+		if !found {
+			return Principal{}, ErrInvalidToken
+		}
+		return parseJWT(strings.TrimSpace(token))
+	}
+	if apiKey != "" {
+		return lookupAPIKey(ctx, apiKey)
+	}
+	return Principal{}, ErrMissingCredentials
+}
+
+func parseJWT(raw string) (Principal, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}),
+		jwt.WithExpirationRequired(),
+	}
+	if authConfig.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(authConfig.Issuer))
+	}
+	if authConfig.Audience != "" {
+		opts = append(opts, jwt.WithAudience(authConfig.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(raw, claims, jwtKeyFunc, opts...); err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	subject, _ := claims.GetSubject()
+	principal := Principal{
+		Subject: subject,
+		Scopes:  scopesFromClaims(claims),
+	}
+	if authConfig.ClientIDClaim != "" {
+		clientID, _ := claims[authConfig.ClientIDClaim].(string)
+		if clientID == "" {
+			return Principal{}, fmt.Errorf("%w: missing %s claim", ErrInvalidToken, authConfig.ClientIDClaim)
+		}
+		principal.ClientID = clientID
+	}
+	return principal, nil
+}
+
+// jwtKeyFunc picks the verification key for a token. HMAC tokens are only
+// accepted with JWT_SECRET and asymmetric tokens only with a JWKS key of the
+// matching type, so a public key can never be used as an HMAC secret.
+func jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(authConfig.JWTSecret) == 0 {
+			return nil, errors.New("HMAC tokens are not accepted")
+		}
+		return authConfig.JWTSecret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		key, err := jwksKey(token)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+				return key, nil
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+				return key, nil
+			}
+		}
+		return nil, errors.New("key type does not match signing method")
+	default:
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+}
+
+func jwksKey(token *jwt.Token) (crypto.PublicKey, error) {
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, found := authConfig.JWKS[kid]; found {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	// Tokens without a kid are only accepted when the key set is unambiguous
+	if len(authConfig.JWKS) == 1 {
+		for _, key := range authConfig.JWKS {
+			return key, nil
+		}
+	}
+	return nil, errors.New("token has no key id")
+}
+
+// scopesFromClaims supports both the OAuth2 space-delimited "scope" claim and
+// array-valued "scopes"/"scp" claims.
+func scopesFromClaims(claims jwt.MapClaims) []string {
+	if scope, ok := claims["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	for _, name := range []string{"scopes", "scp"} {
+		if values, ok := claims[name].([]interface{}); ok {
+			var scopes []string
+			for _, v := range values {
+				if s, ok := v.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+			return scopes
+		}
+	}
+	return nil
+}
+
+// hashAPIKey is used so that only a digest of each API key is stored.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func lookupAPIKey(ctx context.Context, key string) (Principal, error) {
+	for _, static := range authConfig.StaticAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(static), []byte(key)) == 1 {
+			return Principal{
+				Subject:  "static-api-key",
+				APIKeyID: hashAPIKey(key)[:16],
+				Scopes:   []string{ScopeCodesRedeem, ScopeCodesUpload, ScopeBatchesAdmin},
+			}, nil
+		}
+	}
+
+	if db == nil {
+		return Principal{}, ErrInvalidAPIKey
+	}
+
+	var principal Principal
+	var clientID *string
+	err := db.QueryRow(ctx, `
+		SELECT id, name, scopes, client_id
+		FROM api_keys
+		WHERE key_hash = $1 AND revoked_at IS NULL
+	`, hashAPIKey(key)).Scan(&principal.APIKeyID, &principal.Subject, &principal.Scopes, &clientID)
+	if err != nil {
+		if err != pgx.ErrNoRows {
+			loggerFromContext(ctx).Error("Error looking up API key", "error", err)
+		}
+		return Principal{}, ErrInvalidAPIKey
+	}
+	if clientID != nil {
+		principal.ClientID = *clientID
+	}
+	return principal, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func signHS256(t *testing.T, secret string, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("Unable to sign token: %v", err)
+	}
+	return token
+}
+
+func TestRequireScope(t *testing.T) {
+	previous := authConfig
+	defer func() { authConfig = previous }()
+	authConfig = AuthConfig{Enabled: true, JWTSecret: []byte("test-secret"), StaticAPIKeys: []string{"static-key"}}
+
+	router := gin.New()
+	router.GET("/batches", requireScope(ScopeBatchesRead), func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	expiry := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"No credentials", "", "", 401},
+		{"Malformed authorization header", "Authorization", "Basic abc", 401},
+		{"Valid token with scope", "Authorization", "Bearer " + signHS256(t, "test-secret", jwt.MapClaims{"scope": "batches:read", "exp": expiry}), 200},
+		{"Admin scope implies read", "Authorization", "Bearer " + signHS256(t, "test-secret", jwt.MapClaims{"scopes": []string{"batches:admin"}, "exp": expiry}), 200},
+		{"Missing scope", "Authorization", "Bearer " + signHS256(t, "test-secret", jwt.MapClaims{"scope": "codes:redeem", "exp": expiry}), 403},
+		{"Wrong secret", "Authorization", "Bearer " + signHS256(t, "other-secret", jwt.MapClaims{"scope": "batches:read", "exp": expiry}), 401},
+		{"Expired token", "Authorization", "Bearer " + signHS256(t, "test-secret", jwt.MapClaims{"scope": "batches:read", "exp": time.Now().Add(-time.Hour).Unix()}), 401},
+		{"Token without expiry", "Authorization", "Bearer " + signHS256(t, "test-secret", jwt.MapClaims{"scope": "batches:read"}), 401},
+		{"Static API key", "X-API-Key", "static-key", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/batches", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.status, w.Code)
+		})
+	}
+}
+
+func TestRequireScopeDisabled(t *testing.T) {
+	previous := authConfig
+	defer func() { authConfig = previous }()
+	authConfig = AuthConfig{}
+
+	router := gin.New()
+	router.GET("/batches", requireScope(ScopeBatchesRead), func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/batches", nil))
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestES256WithJWKSFile(t *testing.T) {
+	previous := authConfig
+	defer func() { authConfig = previous }()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	jwks := fmt.Sprintf(`{"keys": [{"kty": "EC", "kid": "test", "crv": "P-256", "x": "%s", "y": "%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(jwks), 0o600); err != nil {
+		t.Fatalf("Unable to write JWKS file: %v", err)
+	}
+
+	keys, err := loadJWKSFile(path)
+	assert.NoError(t, err)
+	authConfig = AuthConfig{Enabled: true, JWKS: keys, ClientIDClaim: "client_id"}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"scope":     "codes:redeem",
+		"client_id": "217be7c8-679c-4e08-bffc-db3451bdcdbf",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	})
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+
+	principal, err := parseJWT(signed)
+	assert.NoError(t, err)
+	assert.True(t, principal.HasScope(ScopeCodesRedeem))
+	assert.Equal(t, "217be7c8-679c-4e08-bffc-db3451bdcdbf", principal.ClientID)
+
+	// An HS256 token must not be accepted when only a JWKS is configured
+	_, err = parseJWT(signHS256(t, "anything", jwt.MapClaims{"scope": "codes:redeem", "exp": time.Now().Add(time.Hour).Unix()}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestGetCodeHandler_ClientIDFromToken(t *testing.T) {
+	previous := authConfig
+	defer func() { authConfig = previous }()
+	authConfig = AuthConfig{Enabled: true, JWTSecret: []byte("test-secret"), ClientIDClaim: "client_id"}
+
+	router := gin.New()
+	router.POST("/api/v1/code/redeem", requireScope(ScopeCodesRedeem), getCodeHandler(NewMemoryStore()))
+
+	token := signHS256(t, "test-secret", jwt.MapClaims{
+		"scope":     "codes:redeem",
+		"client_id": "217be7c8-679c-4e08-bffc-db3451bdcdbf",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+	})
+
+	body := `{"batchid": "11111111-1111-1111-1111-111111111111", "clientid": "2ee73a08-ac6f-457d-934f-dcbc61840ae6", "customerid": "fba9230a-a521-430e-aaf8-8aefbf588071"}`
+	req, _ := http.NewRequest("POST", "/api/v1/code/redeem", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), "client_id does not match credentials")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// batchChangesChannel is notified with the batch ID by a trigger on batches
+// whenever a batch is updated or deleted.
+const batchChangesChannel = "ango_batch_changes"
+
+// batchRulesCache is a least recently used cache of batch rules, keyed by the
+// lower-cased batch ID. Entries expire after appConfig.Cache.Expiration and,
+// once appConfig.Cache.MaxEntries is reached, the least recently used entry is
+// evicted to make room.
+type batchRulesCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used at the front
+	// version is bumped whenever entries are invalidated, so that rules
+	// read before an invalidation are not cached after it
+	version uint64
+}
+
+type batchCacheEntry struct {
+	batchID string
+	rules   CachedRules
+}
+
+func newBatchRulesCache() *batchRulesCache {
+	return &batchRulesCache{entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (c *batchRulesCache) Get(batchID string) (CachedRules, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[strings.ToLower(batchID)]
+	if !found {
+		batchCacheTotal.WithLabelValues("miss").Inc()
+		return CachedRules{}, false
+	}
+	entry := elem.Value.(*batchCacheEntry)
+	if time.Since(entry.rules.CacheTime) >= appConfig.Cache.Expiration {
+		c.remove(elem, "expired")
+		batchCacheTotal.WithLabelValues("miss").Inc()
+		return CachedRules{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	batchCacheTotal.WithLabelValues("hit").Inc()
+	return entry.rules, true
+}
+
+// Version returns the version to pass to Set for rules about to be read from
+// the database.
+func (c *batchRulesCache) Version() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// Set caches a batch's rules, unless the cache has been invalidated since
+// version was returned, as the rules may be from before the change.
+func (c *batchRulesCache) Set(batchID string, rules CachedRules, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version != c.version {
+		return
+	}
+	batchID = strings.ToLower(batchID)
+	if elem, found := c.entries[batchID]; found {
+		elem.Value.(*batchCacheEntry).rules = rules
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[batchID] = c.order.PushFront(&batchCacheEntry{batchID: batchID, rules: rules})
+	for c.order.Len() > appConfig.Cache.MaxEntries {
+		c.remove(c.order.Back(), "capacity")
+	}
+	batchCacheEntries.Set(float64(c.order.Len()))
+}
+
+// Delete drops a batch so that its rules are read from the database again.
+func (c *batchRulesCache) Delete(batchID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Bumped even if the batch isn't cached, as it may be being read
+	c.version++
+	if elem, found := c.entries[strings.ToLower(batchID)]; found {
+		c.remove(elem, "invalidated")
+	}
+}
+
+// Purge drops every entry.
+func (c *batchRulesCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.version++
+	for c.order.Len() > 0 {
+		c.remove(c.order.Back(), "invalidated")
+	}
+}
+
+func (c *batchRulesCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// remove must be called with c.mu held.
+func (c *batchRulesCache) remove(elem *list.Element, reason string) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*batchCacheEntry).batchID)
+	batchCacheEvictionsTotal.WithLabelValues(reason).Inc()
+	batchCacheEntries.Set(float64(c.order.Len()))
+}
+
+// listenForBatchChanges removes batches from the cache as they are changed by
+// any instance. If the connection is lost, notifications may have been
+// missed, so the whole cache is dropped before listening again.
+func listenForBatchChanges(ctx context.Context, pool *pgxpool.Pool) {
+	for {
+		err := waitForBatchChanges(ctx, pool)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Lost batch change notifications, retrying", "error", err, "retry_in", appConfig.Database.RetryInterval)
+		batchCache.Purge()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(appConfig.Database.RetryInterval):
+		}
+	}
+}
+
+func waitForBatchChanges(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection is listening, so it is closed rather than returned to the pool
+	pgConn := conn.Hijack()
+	defer pgConn.Close(context.Background())
+
+	if _, err := pgConn.Exec(ctx, "LISTEN "+batchChangesChannel); err != nil {
+		return err
+	}
+	// Changes made before LISTEN took effect would otherwise be missed
+	batchCache.Purge()
+	slog.Debug("Listening for batch changes", "channel", batchChangesChannel)
+
+	for {
+		notification, err := pgConn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		slog.Debug("Batch changed, removing it from the cache", "batch_id", notification.Payload)
+		batchCache.Delete(notification.Payload)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchRulesCache(t *testing.T) {
+	saved := appConfig.Cache
+	t.Cleanup(func() { appConfig.Cache = saved })
+	appConfig.Cache.MaxEntries = 2
+	appConfig.Cache.Expiration = time.Minute
+
+	cache := newBatchRulesCache()
+	cache.Set("a", CachedRules{Rules: Rules{MaxPerCustomer: 1}, CacheTime: time.Now()}, cache.Version())
+	cache.Set("b", CachedRules{CacheTime: time.Now()}, cache.Version())
+
+	// Reading "a" makes "b" the least recently used, so it is evicted
+	rules, found := cache.Get("A")
+	assert.True(t, found)
+	assert.Equal(t, 1, rules.Rules.MaxPerCustomer)
+	cache.Set("c", CachedRules{CacheTime: time.Now()}, cache.Version())
+	assert.Equal(t, 2, cache.Len())
+	_, found = cache.Get("b")
+	assert.False(t, found)
+
+	cache.Delete("C")
+	_, found = cache.Get("c")
+	assert.False(t, found)
+
+	cache.Set("d", CachedRules{CacheTime: time.Now().Add(-time.Hour)}, cache.Version())
+	_, found = cache.Get("d")
+	assert.False(t, found, "expired entries are not returned")
+	assert.Equal(t, 1, cache.Len())
+
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+
+	// Rules read before the batch changed are not cached
+	version := cache.Version()
+	cache.Delete("e")
+	cache.Set("e", CachedRules{CacheTime: time.Now()}, version)
+	_, found = cache.Get("e")
+	assert.False(t, found)
+}
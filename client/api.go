@@ -0,0 +1,336 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Rules struct {
+	MaxPerCustomer int `json:"maxpercustomer"` // The most codes a customer can redeem from the batch, 0 for no limit
+	TimeLimit      int `json:"timelimit"`      // Only count redemptions in the last TimeLimit days, 0 for all time
+}
+
+type Batch struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Rules   Rules  `json:"rules"`
+	Expired bool   `json:"expired"`
+}
+
+type Inventory struct {
+	Total     int `json:"total"`
+	Redeemed  int `json:"redeemed"`
+	Available int `json:"available"`
+}
+
+// BatchInventory is a batch with a count of its codes, either for one client
+// or across every client.
+type BatchInventory struct {
+	Batch
+	Inventory
+}
+
+type ClientInventory struct {
+	ClientID string `json:"client_id"`
+	Inventory
+}
+
+type RedeemRequest struct {
+	BatchID    string `json:"batchid"`
+	ClientID   string `json:"clientid,omitempty"` // Optional when the credentials are tied to a client
+	CustomerID string `json:"customerid"`
+	// IdempotencyKey identifies the redemption across retries. A new key is
+	// used for each call if it is empty, so set it to retry a redemption
+	// beyond the client's own retries, e.g. after a restart.
+	IdempotencyKey string `json:"-"`
+}
+
+// RuleResult explains the outcome of a rule for a customer.
+type RuleResult struct {
+	Rule           string     `json:"rule"`
+	Passed         bool       `json:"passed"`
+	Reason         string     `json:"reason,omitempty"`
+	NextEligibleAt *time.Time `json:"next_eligible_at,omitempty"` // When a failed rule will pass again, if it will
+}
+
+type Eligibility struct {
+	Eligible bool         `json:"eligible"`
+	Rules    []RuleResult `json:"rules"`
+}
+
+// Upload creates a batch from a CSV of client_id,code,<extra> rows after a
+// header row.
+type Upload struct {
+	BatchName string
+	Rules     *Rules // Optional
+	CSV       io.Reader
+}
+
+type Redemption struct {
+	Code       string    `json:"code"`
+	BatchID    string    `json:"batch_id"`
+	BatchName  string    `json:"batch_name"`
+	ClientID   string    `json:"client_id"`
+	CustomerID string    `json:"customer_id"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+	RequestID  string    `json:"request_id,omitempty"` // The X-Request-ID of the redeem request
+}
+
+type RedemptionPage struct {
+	Redemptions []Redemption `json:"redemptions"`
+	NextCursor  string       `json:"next_cursor,omitempty"` // Pass as Cursor to get the next page, empty on the last page
+}
+
+// RedemptionQuery filters a list of redemptions. Every field is optional.
+type RedemptionQuery struct {
+	BatchID  string // Ignored when listing a batch's redemptions
+	ClientID string
+	From     time.Time // Inclusive
+	To       time.Time // Exclusive
+	Limit    int
+	Cursor   string
+}
+
+func (q RedemptionQuery) values() url.Values {
+	v := url.Values{}
+	if q.BatchID != "" {
+		v.Set("batch_id", q.BatchID)
+	}
+	if q.ClientID != "" {
+		v.Set("client_id", q.ClientID)
+	}
+	if !q.From.IsZero() {
+		v.Set("from", q.From.UTC().Format(time.RFC3339Nano))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.UTC().Format(time.RFC3339Nano))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		v.Set("cursor", q.Cursor)
+	}
+	return v
+}
+
+type ErasureResult struct {
+	CustomerID  string `json:"customer_id"`
+	Redemptions int    `json:"redemptions"` // Redemptions whose customer ID was erased
+}
+
+// ClientRecord is a client that codes are issued to, such as a partner or
+// a storefront.
+type ClientRecord struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+type ClientRequest struct {
+	Name     string                 `json:"name"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// Redeem claims a code from the batch for the customer. It fails with
+// ErrNoCodeFound when the batch has run out and ErrConditionNotMet when the
+// customer fails one of the batch's rules.
+func (c *Client) Redeem(ctx context.Context, r RedeemRequest) (string, error) {
+	req, err := jsonRequest(http.MethodPost, "/api/v1/code/redeem", r)
+	if err != nil {
+		return "", err
+	}
+	req.idempotencyKey = r.IdempotencyKey
+	if req.idempotencyKey == "" {
+		req.idempotencyKey = uuid.New().String()
+	}
+	req.retry = true
+
+	var resp struct {
+		Code string `json:"code"`
+	}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.Code, nil
+}
+
+// CheckEligibility evaluates the batch's rules for the customer without
+// claiming a code.
+func (c *Client) CheckEligibility(ctx context.Context, r RedeemRequest) (Eligibility, error) {
+	var eligibility Eligibility
+	req, err := jsonRequest(http.MethodPost, "/api/v1/code/eligibility", r)
+	if err != nil {
+		return eligibility, err
+	}
+	req.retry = true
+	err = c.do(ctx, req, &eligibility)
+	return eligibility, err
+}
+
+func (c *Client) ListBatches(ctx context.Context) ([]Batch, error) {
+	var batches []Batch
+	err := c.get(ctx, "/api/v1/batches", nil, &batches)
+	return batches, err
+}
+
+// CreateBatch creates a batch without codes. It is not retried, as a retry
+// could create a second batch.
+func (c *Client) CreateBatch(ctx context.Context, name string, rules Rules) (Batch, error) {
+	var batch Batch
+	req, err := jsonRequest(http.MethodPost, "/api/v1/batches", map[string]interface{}{"name": name, "rules": rules})
+	if err != nil {
+		return batch, err
+	}
+	err = c.do(ctx, req, &batch)
+	return batch, err
+}
+
+// GetBatchInventory returns the batch with its codes counted across every
+// client. It fails with ErrNoBatchFound if there is no such batch.
+func (c *Client) GetBatchInventory(ctx context.Context, batchID string) (BatchInventory, error) {
+	var inventory BatchInventory
+	err := c.get(ctx, "/api/v1/batches/"+url.PathEscape(batchID)+"/inventory", nil, &inventory)
+	return inventory, err
+}
+
+// ExpireBatch stops codes being redeemed from the batch. Expiring an expired
+// batch is not an error.
+func (c *Client) ExpireBatch(ctx context.Context, batchID string) (Batch, error) {
+	var batch Batch
+	err := c.do(ctx, request{method: http.MethodPost, path: "/api/v1/batches/" + url.PathEscape(batchID) + "/expire", retry: true}, &batch)
+	return batch, err
+}
+
+// UploadCodes creates a batch and adds the upload's codes to it, returning
+// the new batch's ID. Uploads are not retried, as a retry could create a
+// second batch.
+func (c *Client) UploadCodes(ctx context.Context, upload Upload) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("batch_name", upload.BatchName); err != nil {
+		return "", err
+	}
+	if upload.Rules != nil {
+		rules, err := json.Marshal(upload.Rules)
+		if err != nil {
+			return "", err
+		}
+		if err := form.WriteField("rules", string(rules)); err != nil {
+			return "", err
+		}
+	}
+	file, err := form.CreateFormFile("file", "codes.csv")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, upload.CSV); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		BatchID string `json:"batch_id"`
+	}
+	req := request{method: http.MethodPost, path: "/api/v1/codes/upload", body: body.Bytes(), contentType: form.FormDataContentType()}
+	if err := c.do(ctx, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.BatchID, nil
+}
+
+// ListBatchRedemptions returns a page of the batch's redemptions, newest first.
+func (c *Client) ListBatchRedemptions(ctx context.Context, batchID string, q RedemptionQuery) (RedemptionPage, error) {
+	q.BatchID = ""
+	var page RedemptionPage
+	err := c.get(ctx, "/api/v1/batches/"+url.PathEscape(batchID)+"/redemptions", q.values(), &page)
+	return page, err
+}
+
+// ListCustomerRedemptions returns a page of the customer's redemptions,
+// newest first.
+func (c *Client) ListCustomerRedemptions(ctx context.Context, customerID string, q RedemptionQuery) (RedemptionPage, error) {
+	var page RedemptionPage
+	err := c.get(ctx, "/api/v1/customers/"+url.PathEscape(customerID)+"/redemptions", q.values(), &page)
+	return page, err
+}
+
+// EraseCustomer replaces the customer's ID wherever it is stored. Erasing a
+// customer twice is not an error.
+func (c *Client) EraseCustomer(ctx context.Context, customerID string) (ErasureResult, error) {
+	var result ErasureResult
+	req := request{method: http.MethodDelete, path: "/api/v1/customers/" + url.PathEscape(customerID), retry: true}
+	err := c.do(ctx, req, &result)
+	return result, err
+}
+
+func (c *Client) ListClients(ctx context.Context) ([]ClientRecord, error) {
+	var clients []ClientRecord
+	err := c.get(ctx, "/api/v1/clients", nil, &clients)
+	return clients, err
+}
+
+// GetClient fails with ErrNoClientFound if there is no such client.
+func (c *Client) GetClient(ctx context.Context, clientID string) (ClientRecord, error) {
+	var client ClientRecord
+	err := c.get(ctx, "/api/v1/clients/"+url.PathEscape(clientID), nil, &client)
+	return client, err
+}
+
+// CreateClient is not retried, as a retry could create a second client.
+func (c *Client) CreateClient(ctx context.Context, r ClientRequest) (ClientRecord, error) {
+	var client ClientRecord
+	req, err := jsonRequest(http.MethodPost, "/api/v1/clients", r)
+	if err != nil {
+		return client, err
+	}
+	err = c.do(ctx, req, &client)
+	return client, err
+}
+
+func (c *Client) UpdateClient(ctx context.Context, clientID string, r ClientRequest) (ClientRecord, error) {
+	var client ClientRecord
+	req, err := jsonRequest(http.MethodPut, "/api/v1/clients/"+url.PathEscape(clientID), r)
+	if err != nil {
+		return client, err
+	}
+	req.retry = true
+	err = c.do(ctx, req, &client)
+	return client, err
+}
+
+// DeleteClient fails with ErrClientInUse if the client has codes.
+func (c *Client) DeleteClient(ctx context.Context, clientID string) error {
+	return c.do(ctx, request{method: http.MethodDelete, path: "/api/v1/clients/" + url.PathEscape(clientID), retry: true}, nil)
+}
+
+// ListClientBatches returns the batches with codes for the client, along
+// with the client's inventory in each.
+func (c *Client) ListClientBatches(ctx context.Context, clientID string) ([]BatchInventory, error) {
+	var batches []BatchInventory
+	err := c.get(ctx, "/api/v1/clients/"+url.PathEscape(clientID)+"/batches", nil, &batches)
+	return batches, err
+}
+
+func (c *Client) GetClientInventory(ctx context.Context, clientID string) (ClientInventory, error) {
+	var inventory ClientInventory
+	err := c.get(ctx, "/api/v1/clients/"+url.PathEscape(clientID)+"/inventory", nil, &inventory)
+	return inventory, err
+}
+
+func (c *Client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return c.do(ctx, request{method: http.MethodGet, path: path, query: query, retry: true}, out)
+}
@@ -0,0 +1,247 @@
+// Package client is a Go client for the Ango HTTP API.
+//
+//	c := client.New("https://ango.example.com", client.WithAPIKey(key))
+//	code, err := c.Redeem(ctx, client.RedeemRequest{BatchID: batchID, CustomerID: customerID})
+//	if errors.Is(err, client.ErrNoCodeFound) {
+//		// The batch has run out of codes
+//	}
+//
+// Requests that are safe to repeat are retried when the server can't be
+// reached, is unavailable or rate limits them. Redemptions are sent with an
+// Idempotency-Key, so a retry returns the code claimed by an earlier attempt
+// rather than claiming another.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxRetries = 3
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 2 * time.Second
+	defaultTimeout    = 30 * time.Second
+)
+
+// Client calls the Ango HTTP API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	token      string
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+// WithAPIKey authenticates requests with an API key.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken authenticates requests with a JWT.
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient sends requests with hc instead of a client with a 30 second
+// timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times a request is retried, 0 to never retry,
+// and the range of the exponential backoff between attempts. The server's
+// Retry-After takes precedence over the backoff.
+func WithRetries(max int, minBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = max
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// New returns a client for the Ango server at baseURL, e.g.
+// http://localhost:3000.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		maxRetries: defaultMaxRetries,
+		minBackoff: defaultMinBackoff,
+		maxBackoff: defaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type request struct {
+	method         string
+	path           string
+	query          url.Values
+	body           []byte
+	contentType    string
+	idempotencyKey string
+	// retry is whether the request is safe to send again after a failure
+	// that it may have got past the server, such as a timeout or 500
+	retry bool
+}
+
+func jsonRequest(method, path string, body interface{}) (request, error) {
+	req := request{method: method, path: path}
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return req, err
+		}
+		req.body = data
+		req.contentType = "application/json"
+	}
+	return req, nil
+}
+
+// do sends req, retrying it if it fails in a way that can be retried, and
+// decodes the response into out unless it is nil.
+func (c *Client) do(ctx context.Context, req request, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req)
+		if err == nil && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil || resp.StatusCode == http.StatusNoContent {
+				return nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("ango: error decoding the response: %w", err)
+			}
+			return nil
+		}
+
+		var wait time.Duration
+		retry := false
+		if err != nil {
+			// The request may have reached the server before the connection failed
+			retry = req.retry && ctx.Err() == nil
+		} else {
+			apiErr := decodeError(resp)
+			err = apiErr
+			wait = apiErr.RetryAfter
+			switch apiErr.Status {
+			case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				// The server turned the request away without handling it
+				retry = true
+			case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+				retry = req.retry
+			}
+		}
+		if !retry || attempt >= c.maxRetries {
+			return err
+		}
+
+		if backoff := c.backoff(attempt); wait < backoff {
+			wait = backoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	u := c.baseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+	var body io.Reader
+	if req.body != nil {
+		body = bytes.NewReader(req.body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq.Header.Set("Accept", "application/json")
+	if req.contentType != "" {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if req.idempotencyKey != "" {
+		httpReq.Header.Set("Idempotency-Key", req.idempotencyKey)
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.apiKey != "" {
+		httpReq.Header.Set("X-API-Key", c.apiKey)
+	}
+	return c.httpClient.Do(httpReq)
+}
+
+// backoff returns a random wait of up to minBackoff doubled for each attempt,
+// capped at maxBackoff.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.maxBackoff
+	if attempt < 30 && c.minBackoff<<attempt < c.maxBackoff {
+		d = c.minBackoff << attempt
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// problem is an RFC 7807 problem response.
+type problem struct {
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id"`
+	Rules     []RuleResult `json:"rules"`
+}
+
+// decodeError reads an error response and closes its body.
+func decodeError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	apiErr := &Error{Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode), RequestID: resp.Header.Get("X-Request-ID")}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return apiErr
+	}
+	var p problem
+	if err := json.Unmarshal(data, &p); err != nil || p.Code == "" {
+		apiErr.Detail = strings.TrimSpace(string(data))
+		return apiErr
+	}
+	apiErr.Code = p.Code
+	apiErr.Detail = p.Detail
+	apiErr.Rules = p.Rules
+	if p.Title != "" {
+		apiErr.Title = p.Title
+	}
+	if p.RequestID != "" {
+		apiErr.RequestID = p.RequestID
+	}
+	return apiErr
+}
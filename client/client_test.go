@@ -0,0 +1,229 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient returns a client for a server that handles requests with
+// handler, with retries that don't wait.
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	opts = append([]Option{WithRetries(2, time.Millisecond, time.Millisecond)}, opts...)
+	return New(srv.URL+"/", opts...)
+}
+
+func writeProblem(w http.ResponseWriter, status int, code, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":       "urn:ango:problem:" + code,
+		"title":      http.StatusText(status),
+		"status":     status,
+		"detail":     detail,
+		"code":       code,
+		"request_id": "req-1",
+	})
+}
+
+func TestRedeem(t *testing.T) {
+	var body map[string]string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/code/redeem", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-API-Key"))
+		assert.NotEmpty(t, r.Header.Get("Idempotency-Key"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		json.NewEncoder(w).Encode(map[string]string{"code": "CODE-1"})
+	}, WithAPIKey("secret"))
+
+	code, err := c.Redeem(context.Background(), RedeemRequest{BatchID: "batch", ClientID: "client", CustomerID: "customer"})
+	assert.NoError(t, err)
+	assert.Equal(t, "CODE-1", code)
+	assert.Equal(t, map[string]string{"batchid": "batch", "clientid": "client", "customerid": "customer"}, body)
+}
+
+func TestRetries(t *testing.T) {
+	t.Run("Redemptions are retried with the same idempotency key", func(t *testing.T) {
+		var keys []string
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			if len(keys) < 3 {
+				writeProblem(w, 500, "internal_error", "Internal server error")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"code": "CODE-1"})
+		})
+
+		code, err := c.Redeem(context.Background(), RedeemRequest{BatchID: "batch", CustomerID: "customer", IdempotencyKey: "key-1"})
+		assert.NoError(t, err)
+		assert.Equal(t, "CODE-1", code)
+		assert.Equal(t, []string{"key-1", "key-1", "key-1"}, keys)
+	})
+
+	t.Run("Retries run out", func(t *testing.T) {
+		attempts := 0
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			writeProblem(w, 503, "internal_error", "Shutting down")
+		})
+
+		_, err := c.ListBatches(context.Background())
+		assert.ErrorIs(t, err, ErrInternal)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("Requests that aren't idempotent are only retried when they were turned away", func(t *testing.T) {
+		attempts := 0
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				writeProblem(w, 429, "rate_limited", "rate limit exceeded")
+				return
+			}
+			writeProblem(w, 500, "internal_error", "Internal server error")
+		})
+
+		_, err := c.CreateClient(context.Background(), ClientRequest{Name: "Partner"})
+		assert.ErrorIs(t, err, ErrInternal)
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("Errors that can't succeed are not retried", func(t *testing.T) {
+		attempts := 0
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			writeProblem(w, 404, "inventory_exhausted", "no codes were found")
+		})
+
+		_, err := c.Redeem(context.Background(), RedeemRequest{BatchID: "batch", CustomerID: "customer"})
+		assert.ErrorIs(t, err, ErrNoCodeFound)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("Retry-After", func(t *testing.T) {
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "30")
+			writeProblem(w, 429, "rate_limited", "rate limit exceeded")
+		}, WithRetries(0, 0, 0))
+
+		_, err := c.Redeem(context.Background(), RedeemRequest{BatchID: "batch", CustomerID: "customer"})
+		var apiErr *Error
+		if assert.ErrorAs(t, err, &apiErr) {
+			assert.Equal(t, 30*time.Second, apiErr.RetryAfter)
+		}
+		assert.ErrorIs(t, err, ErrRateLimited)
+	})
+}
+
+func TestErrors(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/code/redeem":
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(403)
+			io.WriteString(w, `{"type":"urn:ango:problem:rule_failed:maxpercustomer","title":"Forbidden","status":403,
+				"detail":"maxpercustomer: customer has 1/1 codes","code":"rule_failed:maxpercustomer",
+				"rules":[{"rule":"maxpercustomer","passed":false,"reason":"customer has 1/1 codes"}]}`)
+		case "/api/v1/clients/missing":
+			writeProblem(w, 404, "client_not_found", "no client was found")
+		default:
+			w.WriteHeader(502)
+			io.WriteString(w, "Bad Gateway")
+		}
+	}, WithRetries(0, 0, 0))
+	ctx := context.Background()
+
+	_, err := c.Redeem(ctx, RedeemRequest{BatchID: "batch", CustomerID: "customer"})
+	assert.ErrorIs(t, err, ErrConditionNotMet)
+	var apiErr *Error
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, 403, apiErr.Status)
+		assert.Equal(t, "maxpercustomer", apiErr.Rule())
+		assert.Len(t, apiErr.Rules, 1)
+		assert.Equal(t, "ango: rule_failed:maxpercustomer: maxpercustomer: customer has 1/1 codes", apiErr.Error())
+	}
+
+	_, err = c.GetClient(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNoClientFound)
+	assert.False(t, errors.Is(err, ErrNoBatchFound))
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, "req-1", apiErr.RequestID)
+		assert.Empty(t, apiErr.Rule())
+	}
+
+	// Errors from proxies in front of the API don't have a code
+	_, err = c.ListBatches(ctx)
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, 502, apiErr.Status)
+		assert.Equal(t, "Bad Gateway", apiErr.Detail)
+	}
+	assert.False(t, errors.Is(err, ErrInternal))
+}
+
+func TestUploadCodes(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, "Spring", r.FormValue("batch_name"))
+		assert.JSONEq(t, `{"maxpercustomer":1,"timelimit":0}`, r.FormValue("rules"))
+		file, header, err := r.FormFile("file")
+		if assert.NoError(t, err) {
+			data, _ := io.ReadAll(file)
+			assert.Equal(t, "client_id,code,extra\nclient,CODE-1,\n", string(data))
+			assert.True(t, strings.HasSuffix(header.Filename, ".csv"))
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "Codes uploaded successfully", "batch_id": "batch"})
+	}, WithBearerToken("token"))
+
+	batchID, err := c.UploadCodes(context.Background(), Upload{
+		BatchName: "Spring",
+		Rules:     &Rules{MaxPerCustomer: 1},
+		CSV:       strings.NewReader("client_id,code,extra\nclient,CODE-1,\n"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "batch", batchID)
+}
+
+func TestListRedemptions(t *testing.T) {
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/customers/a b@example.com/redemptions", r.URL.Path)
+		assert.Equal(t, "batch", r.URL.Query().Get("batch_id"))
+		assert.Equal(t, "2024-05-01T00:00:00Z", r.URL.Query().Get("from"))
+		assert.Equal(t, "10", r.URL.Query().Get("limit"))
+		assert.Empty(t, r.URL.Query().Get("to"))
+		io.WriteString(w, `{"redemptions":[{"code":"CODE-1","batch_id":"batch","batch_name":"Spring","client_id":"client",
+			"customer_id":"a b@example.com","redeemed_at":"2024-05-02T10:00:00Z"}],"next_cursor":"next"}`)
+	})
+
+	page, err := c.ListCustomerRedemptions(context.Background(), "a b@example.com", RedemptionQuery{BatchID: "batch", From: from, Limit: 10})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Redemptions, 1) {
+		assert.Equal(t, "CODE-1", page.Redemptions[0].Code)
+		assert.Equal(t, "Spring", page.Redemptions[0].BatchName)
+	}
+	assert.Equal(t, "next", page.NextCursor)
+}
+
+func TestClientInventory(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"id":"batch","name":"Spring","rules":{"maxpercustomer":1},"expired":false,"total":3,"redeemed":1,"available":2}]`)
+	})
+
+	batches, err := c.ListClientBatches(context.Background(), "client")
+	assert.NoError(t, err)
+	if assert.Len(t, batches, 1) {
+		assert.Equal(t, "Spring", batches[0].Name)
+		assert.Equal(t, 1, batches[0].Rules.MaxPerCustomer)
+		assert.Equal(t, Inventory{Total: 3, Redeemed: 1, Available: 2}, batches[0].Inventory)
+	}
+}
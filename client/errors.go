@@ -0,0 +1,87 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// These match the server's errors, so that callers can handle them with
+// errors.Is whichever side of the API they are on.
+var (
+	ErrNoCodeFound     = errors.New("no codes were found")
+	ErrConditionNotMet = errors.New("the request did not meet the rule conditions defined for the batch")
+	ErrNoBatchFound    = errors.New("no batch was found")
+	ErrBatchExpired    = errors.New("the batch is expired")
+	ErrNoClientFound   = errors.New("no client was found")
+	ErrClientInUse     = errors.New("the client still has codes")
+	ErrUnknownClient   = errors.New("the upload references clients that do not exist")
+)
+
+// Errors for the problems that don't come from the service layer.
+var (
+	ErrInvalidRequest = errors.New("the request is invalid")
+	ErrUnauthorized   = errors.New("the credentials are missing or invalid")
+	ErrForbidden      = errors.New("the credentials do not allow the request")
+	ErrNotFound       = errors.New("the resource was not found")
+	ErrRateLimited    = errors.New("the request was rate limited")
+	ErrInternal       = errors.New("the server failed to handle the request")
+)
+
+const ruleFailedPrefix = "rule_failed"
+
+// errorsByCode maps the server's error codes to the errors above.
+var errorsByCode = map[string]error{
+	"invalid_request":     ErrInvalidRequest,
+	"unauthorized":        ErrUnauthorized,
+	"forbidden":           ErrForbidden,
+	"not_found":           ErrNotFound,
+	"batch_not_found":     ErrNoBatchFound,
+	"batch_expired":       ErrBatchExpired,
+	"client_not_found":    ErrNoClientFound,
+	"client_in_use":       ErrClientInUse,
+	"unknown_client":      ErrUnknownClient,
+	"inventory_exhausted": ErrNoCodeFound,
+	ruleFailedPrefix:      ErrConditionNotMet,
+	"rate_limited":        ErrRateLimited,
+	"internal_error":      ErrInternal,
+}
+
+// Error is a problem response from the API. It matches the error for its
+// code with errors.Is, e.g. errors.Is(err, ErrNoBatchFound).
+type Error struct {
+	Status     int
+	Code       string // e.g. batch_not_found or rule_failed:maxpercustomer
+	Title      string
+	Detail     string
+	RequestID  string
+	Rules      []RuleResult  // The result of each rule when Code is a rule_failed code
+	RetryAfter time.Duration // How long the server asked the caller to wait, if it did
+}
+
+func (e *Error) Error() string {
+	detail := e.Detail
+	if detail == "" {
+		detail = e.Title
+	}
+	if e.Code == "" {
+		return fmt.Sprintf("ango: %d %s", e.Status, detail)
+	}
+	return fmt.Sprintf("ango: %s: %s", e.Code, detail)
+}
+
+func (e *Error) Is(target error) bool {
+	code, _, _ := strings.Cut(e.Code, ":")
+	return code != "" && errorsByCode[code] == target
+}
+
+// Rule returns the name of the rule a rule_failed error is for, e.g.
+// maxpercustomer, or an empty string.
+func (e *Error) Rule() string {
+	code, rule, _ := strings.Cut(e.Code, ":")
+	if code != ruleFailedPrefix {
+		return ""
+	}
+	return rule
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrNoClientFound = errors.New("no client was found")
+	ErrClientInUse   = errors.New("the client still has codes")
+	ErrUnknownClient = errors.New("the upload references clients that do not exist")
+	clientCache      = sync.Map{} // Cache of client IDs known to exist
+)
+
+type Client struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+}
+
+type ClientRequest struct {
+	Name     string                 `json:"name"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+// BatchInventory is the number of codes a client has in a batch.
+type BatchInventory struct {
+	Batch
+	Total     int `json:"total"`
+	Redeemed  int `json:"redeemed"`
+	Available int `json:"available"`
+}
+
+type ClientInventory struct {
+	ClientID  string `json:"client_id"`
+	Total     int    `json:"total"`
+	Redeemed  int    `json:"redeemed"`
+	Available int    `json:"available"`
+}
+
+func createClientHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ClientRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "cannot parse json")
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "Client name is required")
+			return
+		}
+
+		client, err := createClient(c.Request.Context(), store, req)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(201, client)
+	}
+}
+
+func getClientsHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clients, err := getClients(c.Request.Context(), store)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, clients)
+	}
+}
+
+func getClientHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, ok := clientIDParam(c)
+		if !ok {
+			return
+		}
+
+		client, err := getClient(c.Request.Context(), store, clientID)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, client)
+	}
+}
+
+func updateClientHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, ok := clientIDParam(c)
+		if !ok {
+			return
+		}
+
+		var req ClientRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "cannot parse json")
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "Client name is required")
+			return
+		}
+
+		client, err := updateClient(c.Request.Context(), store, clientID, req)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, client)
+	}
+}
+
+func deleteClientHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, ok := clientIDParam(c)
+		if !ok {
+			return
+		}
+
+		if err := deleteClient(c.Request.Context(), store, clientID); err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.Status(204)
+	}
+}
+
+func getClientBatchesHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, ok := clientIDParam(c)
+		if !ok {
+			return
+		}
+
+		batches, err := getClientBatches(c.Request.Context(), store, clientID)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, batches)
+	}
+}
+
+func getClientInventoryHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientID, ok := clientIDParam(c)
+		if !ok {
+			return
+		}
+
+		inventory, err := getClientInventory(c.Request.Context(), store, clientID)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, inventory)
+	}
+}
+
+func clientIDParam(c *gin.Context) (string, bool) {
+	clientID := c.Param("id")
+	if _, err := uuid.Parse(clientID); err != nil {
+		respondWithProblem(c, 400, ProblemInvalidRequest, "invalid client_id format")
+		return "", false
+	}
+	return clientID, true
+}
+
+func createClient(ctx context.Context, store Store, req ClientRequest) (Client, error) {
+	client := Client{
+		ID:       uuid.New().String(),
+		Name:     req.Name,
+		Metadata: req.Metadata,
+	}
+	if client.Metadata == nil {
+		client.Metadata = map[string]interface{}{}
+	}
+	return store.CreateClient(ctx, client)
+}
+
+func getClients(ctx context.Context, store Store) ([]Client, error) {
+	return store.GetClients(ctx)
+}
+
+func getClient(ctx context.Context, store Store, clientID string) (Client, error) {
+	return store.GetClient(ctx, clientID)
+}
+
+func updateClient(ctx context.Context, store Store, clientID string, req ClientRequest) (Client, error) {
+	metadata := req.Metadata
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	return store.UpdateClient(ctx, Client{ID: clientID, Name: req.Name, Metadata: metadata})
+}
+
+func deleteClient(ctx context.Context, store Store, clientID string) error {
+	if err := store.DeleteClient(ctx, clientID); err != nil {
+		return err
+	}
+	clientCache.Delete(clientID)
+	return nil
+}
+
+func getClientBatches(ctx context.Context, store Store, clientID string) ([]BatchInventory, error) {
+	if _, err := store.GetClient(ctx, clientID); err != nil {
+		return nil, err
+	}
+	return store.GetClientBatches(ctx, clientID)
+}
+
+func getClientInventory(ctx context.Context, store Store, clientID string) (ClientInventory, error) {
+	if _, err := store.GetClient(ctx, clientID); err != nil {
+		return ClientInventory{}, err
+	}
+	return store.GetClientInventory(ctx, clientID)
+}
+
+// clientExists is used on the redeem path, so positive lookups are cached the
+// same way batch rules are.
+func clientExists(ctx context.Context, store Store, clientID string) (bool, error) {
+	if cached, found := clientCache.Load(clientID); found {
+		if time.Since(cached.(time.Time)) < appConfig.Cache.Expiration {
+			return true, nil
+		}
+		clientCache.Delete(clientID)
+	}
+
+	exists, err := store.ClientExists(ctx, clientID)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		clientCache.Store(clientID, time.Now())
+	}
+	return exists, nil
+}
+
+// validateClients checks that every client referenced by an upload exists.
+func validateClients(ctx context.Context, store Store, clientIDs []string) error {
+	var invalid []string
+	seen := make(map[string]bool)
+	var ids []string
+	for _, id := range clientIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, err := uuid.Parse(id); err != nil {
+			invalid = append(invalid, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	found, err := store.FindClients(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if !found[strings.ToLower(id)] {
+			invalid = append(invalid, id)
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownClient, strings.Join(invalid, ", "))
+	}
+	return nil
+}
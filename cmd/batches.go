@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/joshghent/ango/client"
+)
+
+var batchHeader = []string{"ID", "NAME", "MAX PER CUSTOMER", "TIME LIMIT", "EXPIRED"}
+
+func batchRow(batch client.Batch) []string {
+	row := append([]string{batch.ID, batch.Name}, rulesColumns(batch.Rules)...)
+	return append(row, strconv.FormatBool(batch.Expired))
+}
+
+// runBatches implements "ango batches".
+func runBatches(ctx context.Context, env Env, args []string) error {
+	name, args, err := subcommand("batches", args, "list", "create", "expire", "stats")
+	if err != nil {
+		return err
+	}
+	flags, output := newFlagSet("batches "+name, env.Stdout, tableOrJSON...)
+
+	switch name {
+	case "list":
+		if err := parseFlags(flags, args, output, tableOrJSON, 0, 0, "ango batches list [--output table|json]"); err != nil {
+			return err
+		}
+		backend, err := env.Open(ctx)
+		if err != nil {
+			return err
+		}
+		batches, err := backend.ListBatches(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, len(batches))
+		for i, batch := range batches {
+			rows[i] = batchRow(batch)
+		}
+		return render(env.Stdout, *output, batches, batchHeader, rows)
+
+	case "create":
+		batchName := flags.String("name", "", "name of the batch")
+		rules := rulesFlags(flags)
+		if err := parseFlags(flags, args, output, tableOrJSON, 0, 0, "ango batches create --name NAME [--max-per-customer N] [--time-limit DAYS] [--output table|json]"); err != nil {
+			return err
+		}
+		if *batchName == "" {
+			return fmt.Errorf("--name is required")
+		}
+		backend, err := env.Open(ctx)
+		if err != nil {
+			return err
+		}
+		batch, err := backend.CreateBatch(ctx, *batchName, *rules)
+		if err != nil {
+			return err
+		}
+		return render(env.Stdout, *output, batch, batchHeader, [][]string{batchRow(batch)})
+
+	case "expire":
+		if err := parseFlags(flags, args, output, tableOrJSON, 1, -1, "ango batches expire [--output table|json] BATCH_ID..."); err != nil {
+			return err
+		}
+		backend, err := env.Open(ctx)
+		if err != nil {
+			return err
+		}
+		batches := make([]client.Batch, 0, flags.NArg())
+		rows := make([][]string, 0, flags.NArg())
+		for _, batchID := range flags.Args() {
+			batch, err := backend.ExpireBatch(ctx, batchID)
+			if err != nil {
+				return fmt.Errorf("expiring batch %s: %w", batchID, err)
+			}
+			batches = append(batches, batch)
+			rows = append(rows, batchRow(batch))
+		}
+		return render(env.Stdout, *output, batches, batchHeader, rows)
+
+	default: // stats
+		if err := parseFlags(flags, args, output, tableOrJSON, 0, -1, "ango batches stats [--output table|json] [BATCH_ID...]"); err != nil {
+			return err
+		}
+		backend, err := env.Open(ctx)
+		if err != nil {
+			return err
+		}
+		// Without IDs, show every batch that hasn't expired
+		batchIDs := flags.Args()
+		if len(batchIDs) == 0 {
+			batches, err := backend.ListBatches(ctx)
+			if err != nil {
+				return err
+			}
+			for _, batch := range batches {
+				batchIDs = append(batchIDs, batch.ID)
+			}
+		}
+
+		inventories := make([]client.BatchInventory, 0, len(batchIDs))
+		rows := make([][]string, 0, len(batchIDs))
+		for _, batchID := range batchIDs {
+			inventory, err := backend.GetBatchInventory(ctx, batchID)
+			if err != nil {
+				return fmt.Errorf("getting batch %s: %w", batchID, err)
+			}
+			inventories = append(inventories, inventory)
+			rows = append(rows, []string{
+				inventory.ID,
+				inventory.Name,
+				strconv.Itoa(inventory.Total),
+				strconv.Itoa(inventory.Redeemed),
+				strconv.Itoa(inventory.Available),
+				strconv.FormatBool(inventory.Expired),
+			})
+		}
+		return render(env.Stdout, *output, inventories, []string{"ID", "NAME", "TOTAL", "REDEEMED", "AVAILABLE", "EXPIRED"}, rows)
+	}
+}
+
+// rulesFlags adds the flags setting a batch's rules to flags.
+func rulesFlags(flags *flag.FlagSet) *client.Rules {
+	var rules client.Rules
+	flags.IntVar(&rules.MaxPerCustomer, "max-per-customer", 0, "the most codes a customer can redeem from the batch, 0 for no limit")
+	flags.IntVar(&rules.TimeLimit, "time-limit", 0, "only count redemptions in the last N days towards --max-per-customer, 0 for all time")
+	return &rules
+}
@@ -0,0 +1,177 @@
+// Package cmd implements the ango subcommands that operators use to manage
+// a server: batches, codes, redemptions and API keys. The commands run
+// against a Backend, which is either the HTTP API, through the client
+// package, or the database itself.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/joshghent/ango/client"
+)
+
+// Backend is what the commands need from a server. *client.Client
+// implements it.
+type Backend interface {
+	ListBatches(ctx context.Context) ([]client.Batch, error)
+	CreateBatch(ctx context.Context, name string, rules client.Rules) (client.Batch, error)
+	ExpireBatch(ctx context.Context, batchID string) (client.Batch, error)
+	GetBatchInventory(ctx context.Context, batchID string) (client.BatchInventory, error)
+	UploadCodes(ctx context.Context, upload client.Upload) (string, error)
+	ListBatchRedemptions(ctx context.Context, batchID string, q client.RedemptionQuery) (client.RedemptionPage, error)
+}
+
+// KeyManager is implemented by backends that can manage API keys. Keys are
+// stored in the Postgres database and can't be managed through the API.
+type KeyManager interface {
+	// CreateAPIKey returns the new key's record and the key itself, which
+	// is not stored and can't be retrieved later.
+	CreateAPIKey(ctx context.Context, req APIKeyRequest) (APIKey, string, error)
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKey returns ErrNoAPIKeyFound if there is no such key.
+	// Revoking a revoked key is not an error.
+	RevokeAPIKey(ctx context.Context, id string) (APIKey, error)
+}
+
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ClientID  string     `json:"client_id,omitempty"` // The client the key is limited to, if any
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type APIKeyRequest struct {
+	Name     string
+	Scopes   []string
+	ClientID string // Optional
+}
+
+var (
+	ErrNoAPIKeyFound   = errors.New("no API key was found")
+	ErrKeysUnsupported = errors.New("API keys can only be managed with a connection to a Postgres database, not the API or SQLite")
+)
+
+// Env is where a command gets its backend and does its input and output.
+type Env struct {
+	// Open connects to the server or database. It is only called by
+	// commands that need a backend.
+	Open   func(ctx context.Context) (Backend, error)
+	Stdin  io.Reader
+	Stdout io.Writer
+}
+
+var commands = map[string]func(context.Context, Env, []string) error{
+	"batches":     runBatches,
+	"codes":       runCodes,
+	"redemptions": runRedemptions,
+	"keys":        runKeys,
+}
+
+// Usage describes the commands, for the ango usage message.
+const Usage = `  batches list|create|expire|stats   manage batches
+  codes upload|generate             upload a CSV of codes, or generate one
+  redemptions export                export a batch's redemptions
+  keys create|list|revoke           manage API keys (Postgres only)`
+
+// IsCommand reports whether name is one of the commands run by Run.
+func IsCommand(name string) bool {
+	_, found := commands[name]
+	return found
+}
+
+// Run runs the command named by args[0] with the rest of args.
+func Run(ctx context.Context, env Env, args []string) error {
+	if len(args) == 0 || !IsCommand(args[0]) {
+		return fmt.Errorf("unknown command, expected one of:\n%s", Usage)
+	}
+	return commands[args[0]](ctx, env, args[1:])
+}
+
+// subcommand splits args into the subcommand, which must be one of names,
+// and its arguments.
+func subcommand(command string, args []string, names ...string) (string, []string, error) {
+	if len(args) > 0 {
+		for _, name := range names {
+			if args[0] == name {
+				return name, args[1:], nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("usage: ango %s %s", command, strings.Join(names, "|"))
+}
+
+// newFlagSet returns a flag set for a subcommand with an --output flag
+// accepting formats, the first of which is the default.
+func newFlagSet(name string, w io.Writer, formats ...string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(w)
+	if len(formats) == 0 {
+		return flags, nil
+	}
+	output := flags.String("output", formats[0], "output format: "+strings.Join(formats, " or "))
+	return flags, output
+}
+
+// parseFlags parses args, checking that --output is one of formats and that
+// there are between min and max positional arguments, -1 for no maximum.
+func parseFlags(flags *flag.FlagSet, args []string, output *string, formats []string, min, max int, usage string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	if output != nil {
+		for _, format := range formats {
+			if *output == format {
+				return nil
+			}
+		}
+		return fmt.Errorf("--output must be one of %s", strings.Join(formats, ", "))
+	}
+	return nil
+}
+
+var tableOrJSON = []string{"table", "json"}
+
+// render writes v as indented JSON, or rows as a table under header.
+func render(w io.Writer, format string, v interface{}, header []string, rows [][]string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// rulesColumns are the columns describing a batch's rules, where 0 means
+// there is no limit.
+func rulesColumns(rules client.Rules) []string {
+	columns := []string{"-", "-"}
+	if rules.MaxPerCustomer > 0 {
+		columns[0] = fmt.Sprint(rules.MaxPerCustomer)
+	}
+	if rules.TimeLimit > 0 {
+		columns[1] = fmt.Sprintf("%dd", rules.TimeLimit)
+	}
+	return columns
+}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/joshghent/ango/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeBackend struct {
+	batches     []client.Batch
+	redemptions []client.Redemption
+	pageSize    int
+	queries     []client.RedemptionQuery
+}
+
+func (b *fakeBackend) ListBatches(ctx context.Context) ([]client.Batch, error) {
+	return b.batches, nil
+}
+
+func (b *fakeBackend) CreateBatch(ctx context.Context, name string, rules client.Rules) (client.Batch, error) {
+	batch := client.Batch{ID: "new", Name: name, Rules: rules}
+	b.batches = append(b.batches, batch)
+	return batch, nil
+}
+
+func (b *fakeBackend) ExpireBatch(ctx context.Context, batchID string) (client.Batch, error) {
+	for i := range b.batches {
+		if b.batches[i].ID == batchID {
+			b.batches[i].Expired = true
+			return b.batches[i], nil
+		}
+	}
+	return client.Batch{}, client.ErrNoBatchFound
+}
+
+func (b *fakeBackend) GetBatchInventory(ctx context.Context, batchID string) (client.BatchInventory, error) {
+	for _, batch := range b.batches {
+		if batch.ID == batchID {
+			return client.BatchInventory{Batch: batch, Inventory: client.Inventory{Total: 10, Redeemed: 4, Available: 6}}, nil
+		}
+	}
+	return client.BatchInventory{}, client.ErrNoBatchFound
+}
+
+func (b *fakeBackend) UploadCodes(ctx context.Context, upload client.Upload) (string, error) {
+	return "uploaded", nil
+}
+
+// ListBatchRedemptions pages through the redemptions using their index as
+// the cursor.
+func (b *fakeBackend) ListBatchRedemptions(ctx context.Context, batchID string, q client.RedemptionQuery) (client.RedemptionPage, error) {
+	b.queries = append(b.queries, q)
+	start := 0
+	if q.Cursor != "" {
+		start = len(q.Cursor)
+	}
+	end := start + b.pageSize
+	if end >= len(b.redemptions) {
+		return client.RedemptionPage{Redemptions: b.redemptions[start:]}, nil
+	}
+	return client.RedemptionPage{Redemptions: b.redemptions[start:end], NextCursor: strings.Repeat("x", end)}, nil
+}
+
+type fakeKeyBackend struct {
+	fakeBackend
+	requests []APIKeyRequest
+}
+
+func (b *fakeKeyBackend) CreateAPIKey(ctx context.Context, req APIKeyRequest) (APIKey, string, error) {
+	b.requests = append(b.requests, req)
+	return APIKey{ID: "key-1", Name: req.Name, Scopes: req.Scopes, CreatedAt: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)}, "ango_secret", nil
+}
+
+func (b *fakeKeyBackend) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	return nil, nil
+}
+
+func (b *fakeKeyBackend) RevokeAPIKey(ctx context.Context, id string) (APIKey, error) {
+	return APIKey{}, ErrNoAPIKeyFound
+}
+
+func run(backend Backend, stdin string, args ...string) (string, error) {
+	var out bytes.Buffer
+	env := Env{
+		Open:   func(context.Context) (Backend, error) { return backend, nil },
+		Stdin:  strings.NewReader(stdin),
+		Stdout: &out,
+	}
+	err := Run(context.Background(), env, args)
+	return out.String(), err
+}
+
+func TestBatches(t *testing.T) {
+	backend := &fakeBackend{batches: []client.Batch{
+		{ID: "b1", Name: "Spring", Rules: client.Rules{MaxPerCustomer: 1, TimeLimit: 30}},
+		{ID: "b2", Name: "Summer Sale"},
+	}}
+
+	out, err := run(backend, "", "batches", "list")
+	assert.NoError(t, err)
+	assert.Equal(t, ""+
+		"ID  NAME         MAX PER CUSTOMER  TIME LIMIT  EXPIRED\n"+
+		"b1  Spring       1                 30d         false\n"+
+		"b2  Summer Sale  -                 -           false\n", out)
+
+	out, err = run(backend, "", "batches", "stats", "--output", "json", "b2")
+	assert.NoError(t, err)
+	var stats []client.BatchInventory
+	assert.NoError(t, json.Unmarshal([]byte(out), &stats))
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, "Summer Sale", stats[0].Name)
+		assert.Equal(t, 6, stats[0].Available)
+	}
+
+	_, err = run(backend, "", "batches", "expire", "b1", "missing")
+	assert.ErrorIs(t, err, client.ErrNoBatchFound)
+	assert.True(t, backend.batches[0].Expired)
+
+	_, err = run(backend, "", "batches", "create", "--max-per-customer", "2")
+	assert.EqualError(t, err, "--name is required")
+
+	_, err = run(backend, "", "batches", "list", "--output", "yaml")
+	assert.EqualError(t, err, "--output must be one of table, json")
+
+	_, err = run(backend, "", "batches", "delete")
+	assert.EqualError(t, err, "usage: ango batches list|create|expire|stats")
+}
+
+func TestGenerateCodes(t *testing.T) {
+	opened := false
+	env := Env{
+		Open: func(context.Context) (Backend, error) {
+			opened = true
+			return nil, errors.New("no backend")
+		},
+		Stdout: &bytes.Buffer{},
+	}
+	err := Run(context.Background(), env, []string{"codes", "generate", "--client", "client-1", "--count", "200", "--length", "6", "--prefix", "X-"})
+	assert.NoError(t, err)
+	assert.False(t, opened, "generating codes shouldn't need a backend")
+
+	records, err := csv.NewReader(env.Stdout.(*bytes.Buffer)).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 201) {
+		assert.Equal(t, []string{"client_id", "code", "extra"}, records[0])
+	}
+	seen := map[string]bool{}
+	for _, record := range records[1:] {
+		assert.Equal(t, "client-1", record[0])
+		assert.Regexp(t, "^X-["+codeAlphabet+"]{6}$", record[1])
+		assert.False(t, seen[record[1]], "duplicate code %s", record[1])
+		seen[record[1]] = true
+	}
+
+	_, err = run(nil, "", "codes", "generate", "--client", "client-1", "--count", "1", "--length", "4")
+	assert.EqualError(t, err, "--length must be between 6 and 64")
+	_, err = run(nil, "", "codes", "generate", "--count", "1")
+	assert.EqualError(t, err, "--client is required")
+}
+
+func TestExportRedemptions(t *testing.T) {
+	redeemedAt := time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	backend := &fakeBackend{pageSize: 2}
+	for _, code := range []string{"A", "B", "C"} {
+		backend.redemptions = append(backend.redemptions, client.Redemption{Code: code, ClientID: "client-1", CustomerID: "customer-" + code, RedeemedAt: redeemedAt})
+	}
+
+	out, err := run(backend, "", "redemptions", "export", "--batch", "b1", "--from", "2024-05-01T00:00:00Z", "--output", "json")
+	assert.NoError(t, err)
+	var redemptions []client.Redemption
+	assert.NoError(t, json.Unmarshal([]byte(out), &redemptions))
+	assert.Equal(t, backend.redemptions, redemptions)
+	if assert.Len(t, backend.queries, 2) {
+		assert.Equal(t, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), backend.queries[1].From)
+		assert.Equal(t, exportPageSize, backend.queries[1].Limit)
+		assert.Equal(t, "xx", backend.queries[1].Cursor)
+	}
+
+	out, err = run(backend, "", "redemptions", "export", "--batch", "b1", "--output", "csv")
+	assert.NoError(t, err)
+	assert.Equal(t, ""+
+		"redeemed_at,code,client_id,customer_id,request_id\n"+
+		"2024-05-02T10:00:00Z,A,client-1,customer-A,\n"+
+		"2024-05-02T10:00:00Z,B,client-1,customer-B,\n"+
+		"2024-05-02T10:00:00Z,C,client-1,customer-C,\n", out)
+
+	empty := &fakeBackend{pageSize: 2}
+	out, err = run(empty, "", "redemptions", "export", "--batch", "b1", "--output", "json")
+	assert.NoError(t, err)
+	assert.Equal(t, "[]\n", out)
+
+	_, err = run(backend, "", "redemptions", "export", "--batch", "b1", "--to", "yesterday")
+	assert.EqualError(t, err, "--to must be an RFC 3339 time")
+}
+
+func TestKeys(t *testing.T) {
+	_, err := run(&fakeBackend{}, "", "keys", "list")
+	assert.ErrorIs(t, err, ErrKeysUnsupported)
+
+	backend := &fakeKeyBackend{}
+	out, err := run(backend, "", "keys", "create", "--name", "checkout", "--scopes", "codes:redeem, batches:read")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "Key: ango_secret\n")
+	if assert.Len(t, backend.requests, 1) {
+		assert.Equal(t, []string{"codes:redeem", "batches:read"}, backend.requests[0].Scopes)
+	}
+
+	out, err = run(backend, "", "keys", "create", "--name", "checkout", "--scopes", "codes:redeem", "--output", "json")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"id":"key-1","name":"checkout","scopes":["codes:redeem"],"created_at":"2024-05-01T00:00:00Z","key":"ango_secret"}`, out)
+
+	_, err = run(backend, "", "keys", "revoke", "key-2")
+	assert.ErrorIs(t, err, ErrNoAPIKeyFound)
+	_, err = run(backend, "", "keys", "revoke")
+	assert.EqualError(t, err, "usage: ango keys revoke [--output table|json] KEY_ID")
+}
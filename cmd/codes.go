@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/joshghent/ango/client"
+)
+
+// codeAlphabet leaves out characters that are easily confused, such as 0
+// and O. It has 32 characters, so a random byte picks one without bias.
+const codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+const (
+	minCodeLength = 6
+	maxCodeLength = 64
+)
+
+// runCodes implements "ango codes".
+func runCodes(ctx context.Context, env Env, args []string) error {
+	name, args, err := subcommand("codes", args, "upload", "generate")
+	if err != nil {
+		return err
+	}
+
+	if name == "generate" {
+		flags, _ := newFlagSet("codes generate", env.Stdout)
+		clientID := flags.String("client", "", "client id to generate the codes for")
+		count := flags.Int("count", 0, "number of codes to generate")
+		length := flags.Int("length", 12, "number of random characters in each code")
+		prefix := flags.String("prefix", "", "prefix for every code, e.g. SUMMER-")
+		if err := parseFlags(flags, args, nil, nil, 0, 0, "ango codes generate --client ID --count N [--length N] [--prefix PREFIX]"); err != nil {
+			return err
+		}
+		switch {
+		case *clientID == "":
+			return fmt.Errorf("--client is required")
+		case *count < 1:
+			return fmt.Errorf("--count must be at least 1")
+		case *length < minCodeLength || *length > maxCodeLength:
+			return fmt.Errorf("--length must be between %d and %d", minCodeLength, maxCodeLength)
+		}
+		return generateCodes(env.Stdout, *clientID, *count, *length, *prefix)
+	}
+
+	flags, output := newFlagSet("codes upload", env.Stdout, tableOrJSON...)
+	batchName := flags.String("name", "", "name of the batch to create")
+	rules := rulesFlags(flags)
+	if err := parseFlags(flags, args, output, tableOrJSON, 1, 1, "ango codes upload --name NAME [--max-per-customer N] [--time-limit DAYS] [--output table|json] FILE|-"); err != nil {
+		return err
+	}
+	if *batchName == "" {
+		return fmt.Errorf("--name is required")
+	}
+
+	in := env.Stdin
+	if path := flags.Arg(0); path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	backend, err := env.Open(ctx)
+	if err != nil {
+		return err
+	}
+	batchID, err := backend.UploadCodes(ctx, client.Upload{BatchName: *batchName, Rules: rules, CSV: in})
+	if err != nil {
+		return err
+	}
+	return render(env.Stdout, *output, map[string]string{"batch_id": batchID}, []string{"BATCH ID"}, [][]string{{batchID}})
+}
+
+// generateCodes writes count unique random codes for the client as a CSV
+// that "ango codes upload" accepts.
+func generateCodes(w io.Writer, clientID string, count, length int, prefix string) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"client_id", "code", "extra"}); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, count)
+	buf := make([]byte, length)
+	for len(seen) < count {
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		for i, b := range buf {
+			buf[i] = codeAlphabet[int(b)%len(codeAlphabet)]
+		}
+		code := prefix + string(buf)
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+		if err := out.Write([]string{clientID, code, ""}); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
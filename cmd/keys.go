@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+var keyHeader = []string{"ID", "NAME", "SCOPES", "CLIENT ID", "CREATED AT", "REVOKED AT"}
+
+func keyRow(key APIKey) []string {
+	row := []string{key.ID, key.Name, strings.Join(key.Scopes, ","), key.ClientID, formatTime(key.CreatedAt), ""}
+	if key.RevokedAt != nil {
+		row[5] = formatTime(*key.RevokedAt)
+	}
+	return row
+}
+
+// runKeys implements "ango keys".
+func runKeys(ctx context.Context, env Env, args []string) error {
+	name, args, err := subcommand("keys", args, "create", "list", "revoke")
+	if err != nil {
+		return err
+	}
+	flags, output := newFlagSet("keys "+name, env.Stdout, tableOrJSON...)
+	var req APIKeyRequest
+	var scopes string
+	usage := "ango keys " + name + " [--output table|json]"
+	min, max := 0, 0
+	switch name {
+	case "create":
+		flags.StringVar(&req.Name, "name", "", "name of the key, shown in logs as the caller")
+		flags.StringVar(&scopes, "scopes", "", "comma separated scopes to grant, e.g. codes:redeem,batches:read")
+		flags.StringVar(&req.ClientID, "client", "", "limit the key to the client's codes")
+		usage = "ango keys create --name NAME --scopes SCOPE,... [--client ID] [--output table|json]"
+	case "revoke":
+		usage = "ango keys revoke [--output table|json] KEY_ID"
+		min, max = 1, 1
+	}
+	if err := parseFlags(flags, args, output, tableOrJSON, min, max, usage); err != nil {
+		return err
+	}
+
+	backend, err := env.Open(ctx)
+	if err != nil {
+		return err
+	}
+	keys, ok := backend.(KeyManager)
+	if !ok {
+		return ErrKeysUnsupported
+	}
+
+	switch name {
+	case "create":
+		if req.Name == "" || scopes == "" {
+			return fmt.Errorf("--name and --scopes are required")
+		}
+		for _, scope := range strings.Split(scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				req.Scopes = append(req.Scopes, scope)
+			}
+		}
+		key, secret, err := keys.CreateAPIKey(ctx, req)
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return render(env.Stdout, *output, struct {
+				APIKey
+				Key string `json:"key"`
+			}{key, secret}, nil, nil)
+		}
+		if err := render(env.Stdout, *output, nil, keyHeader, [][]string{keyRow(key)}); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(env.Stdout, "\nKey: %s\nStore the key now, it can't be shown again.\n", secret)
+		return err
+
+	case "list":
+		list, err := keys.ListAPIKeys(ctx)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, len(list))
+		for i, key := range list {
+			rows[i] = keyRow(key)
+		}
+		return render(env.Stdout, *output, list, keyHeader, rows)
+
+	default: // revoke
+		key, err := keys.RevokeAPIKey(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		return render(env.Stdout, *output, key, keyHeader, [][]string{keyRow(key)})
+	}
+}
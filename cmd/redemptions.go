@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/joshghent/ango/client"
+)
+
+// exportPageSize is the most redemptions the API returns at once.
+const exportPageSize = 500
+
+var redemptionHeader = []string{"REDEEMED AT", "CODE", "CLIENT ID", "CUSTOMER ID", "REQUEST ID"}
+
+// runRedemptions implements "ango redemptions".
+func runRedemptions(ctx context.Context, env Env, args []string) error {
+	_, args, err := subcommand("redemptions", args, "export")
+	if err != nil {
+		return err
+	}
+
+	formats := []string{"table", "json", "csv"}
+	flags, output := newFlagSet("redemptions export", env.Stdout, formats...)
+	batchID := flags.String("batch", "", "batch id to export the redemptions of")
+	clientID := flags.String("client", "", "only export redemptions of the client's codes")
+	flags.String("from", "", "only export redemptions at or after this RFC 3339 time")
+	flags.String("to", "", "only export redemptions before this RFC 3339 time")
+	if err := parseFlags(flags, args, output, formats, 0, 0, "ango redemptions export --batch ID [--client ID] [--from TIME] [--to TIME] [--output table|json|csv]"); err != nil {
+		return err
+	}
+	if *batchID == "" {
+		return fmt.Errorf("--batch is required")
+	}
+	q := client.RedemptionQuery{ClientID: *clientID, Limit: exportPageSize}
+	for name, dest := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if value := flags.Lookup(name).Value.String(); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return fmt.Errorf("--%s must be an RFC 3339 time", name)
+			}
+			*dest = t
+		}
+	}
+
+	backend, err := env.Open(ctx)
+	if err != nil {
+		return err
+	}
+
+	// CSV and JSON are written a page at a time, so that large batches
+	// aren't held in memory. A table is aligned once every row is known.
+	var rows [][]string
+	var out exporter
+	switch *output {
+	case "csv":
+		out = newCSVExporter(env.Stdout)
+	case "json":
+		out = &jsonExporter{w: env.Stdout}
+	default:
+		out = exportFunc(func(r client.Redemption) error {
+			rows = append(rows, redemptionRow(r))
+			return nil
+		})
+	}
+
+	for {
+		page, err := backend.ListBatchRedemptions(ctx, *batchID, q)
+		if err != nil {
+			return err
+		}
+		for _, redemption := range page.Redemptions {
+			if err := out.write(redemption); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+
+	if closer, ok := out.(interface{ close() error }); ok {
+		return closer.close()
+	}
+	return render(env.Stdout, "table", nil, redemptionHeader, rows)
+}
+
+func redemptionRow(r client.Redemption) []string {
+	return []string{formatTime(r.RedeemedAt), r.Code, r.ClientID, r.CustomerID, r.RequestID}
+}
+
+// exporter writes redemptions one at a time. Exporters with a close method
+// have it called after the last one.
+type exporter interface {
+	write(client.Redemption) error
+}
+
+type exportFunc func(client.Redemption) error
+
+func (f exportFunc) write(r client.Redemption) error { return f(r) }
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func newCSVExporter(w io.Writer) *csvExporter {
+	e := &csvExporter{w: csv.NewWriter(w)}
+	e.w.Write([]string{"redeemed_at", "code", "client_id", "customer_id", "request_id"})
+	return e
+}
+
+func (e *csvExporter) write(r client.Redemption) error {
+	return e.w.Write(redemptionRow(r))
+}
+
+func (e *csvExporter) close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonExporter writes a JSON array with one redemption per line.
+type jsonExporter struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExporter) write(r client.Redemption) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if e.count == 0 {
+		sep = "[\n  "
+	}
+	e.count++
+	_, err = fmt.Fprintf(e.w, "%s%s", sep, data)
+	return err
+}
+
+func (e *jsonExporter) close() error {
+	if e.count == 0 {
+		_, err := io.WriteString(e.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(e.w, "\n]\n")
+	return err
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// appConfig is the configuration the server was started with. It holds the
+// defaults until loadConfig is called.
+var appConfig = defaultConfig()
+
+// Config is loaded from defaults, then an optional YAML or TOML file, then
+// environment variables. Keys in the file follow the yaml tags, e.g.
+// "database.max_conns", and each setting can be overridden by its env var.
+type Config struct {
+	Server    ServerConfig      `yaml:"server"`
+	Database  DatabaseConfig    `yaml:"database"`
+	Cache     CacheConfig       `yaml:"cache"`
+	Redeem    RedeemConfig      `yaml:"redeem"`
+	Health    HealthConfig      `yaml:"health"`
+	Log       LogConfig         `yaml:"log"`
+	Auth      AuthSettings      `yaml:"auth"`
+	RateLimit RateLimitSettings `yaml:"rate_limit"`
+	Tracing   TracingConfig     `yaml:"tracing"`
+	Allocator AllocatorConfig   `yaml:"allocator"`
+	Retention RetentionConfig   `yaml:"retention"`
+	Customers CustomersConfig   `yaml:"customers"`
+	OpenAPI   OpenAPIConfig     `yaml:"openapi"`
+	GRPC      GRPCConfig        `yaml:"grpc"`
+}
+
+type ServerConfig struct {
+	Port            int           `yaml:"port" env:"PORT"`
+	DrainPeriod     time.Duration `yaml:"drain_period" env:"SERVER_DRAIN_PERIOD"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+}
+
+type DatabaseConfig struct {
+	URL                  string        `yaml:"url" env:"DATABASE_URL" secret:"true"`
+	MaxConns             int32         `yaml:"max_conns" env:"DATABASE_MAX_CONNS"`
+	ConnectRetries       int           `yaml:"connect_retries" env:"DATABASE_CONNECT_RETRIES"`
+	RetryInterval        time.Duration `yaml:"retry_interval" env:"DATABASE_RETRY_INTERVAL"`
+	SlowQueryThreshold   time.Duration `yaml:"slow_query_threshold" env:"DATABASE_SLOW_QUERY_THRESHOLD"`
+	AutoMigrate          bool          `yaml:"auto_migrate" env:"DATABASE_AUTO_MIGRATE"`
+	ReadURL              string        `yaml:"read_url" env:"DATABASE_READ_URL" secret:"true"`
+	MaxReplicaLag        time.Duration `yaml:"max_replica_lag" env:"DATABASE_MAX_REPLICA_LAG"`
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval" env:"DATABASE_REPLICA_CHECK_INTERVAL"`
+}
+
+type CacheConfig struct {
+	Expiration time.Duration `yaml:"expiration" env:"CACHE_EXPIRATION"`
+	MaxEntries int           `yaml:"max_entries" env:"CACHE_MAX_ENTRIES"`
+}
+
+type RedeemConfig struct {
+	Timeout time.Duration `yaml:"timeout" env:"REDEEM_TIMEOUT"`
+}
+
+type HealthConfig struct {
+	CheckTimeout            time.Duration `yaml:"check_timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	PoolSaturationThreshold float64       `yaml:"pool_saturation_threshold" env:"HEALTH_POOL_SATURATION_THRESHOLD"`
+}
+
+type LogConfig struct {
+	Level             string `yaml:"level" env:"LOG_LEVEL"`
+	Format            string `yaml:"format" env:"LOG_FORMAT"`
+	RedactCustomerIDs bool   `yaml:"redact_customer_ids" env:"LOG_REDACT_CUSTOMER_IDS"`
+}
+
+type AuthSettings struct {
+	Enabled       bool     `yaml:"enabled" env:"AUTH_ENABLED"`
+	JWTSecret     string   `yaml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	JWKSFile      string   `yaml:"jwks_file" env:"JWKS_FILE"`
+	Issuer        string   `yaml:"issuer" env:"JWT_ISSUER"`
+	Audience      string   `yaml:"audience" env:"JWT_AUDIENCE"`
+	ClientIDClaim string   `yaml:"client_id_claim" env:"JWT_CLIENT_ID_CLAIM"`
+	APIKeys       []string `yaml:"api_keys" env:"API_KEY" secret:"true"`
+}
+
+type RateLimitSettings struct {
+	Backend     string `yaml:"backend" env:"RATE_LIMIT_BACKEND"`
+	PerAPIKey   string `yaml:"per_api_key" env:"RATE_LIMIT_PER_API_KEY"`
+	PerClient   string `yaml:"per_client" env:"RATE_LIMIT_PER_CLIENT"`
+	PerCustomer string `yaml:"per_customer" env:"RATE_LIMIT_PER_CUSTOMER"`
+}
+
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	ServiceName string `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+}
+
+type AllocatorConfig struct {
+	Batches       []string      `yaml:"batches" env:"ALLOCATOR_BATCHES"`
+	BlockSize     int           `yaml:"block_size" env:"ALLOCATOR_BLOCK_SIZE"`
+	LeaseDuration time.Duration `yaml:"lease_duration" env:"ALLOCATOR_LEASE_DURATION"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"ALLOCATOR_FLUSH_INTERVAL"`
+	FlushSize     int           `yaml:"flush_size" env:"ALLOCATOR_FLUSH_SIZE"`
+}
+
+// RetentionConfig controls how long redemptions keep their customer IDs.
+type RetentionConfig struct {
+	Days     int           `yaml:"days" env:"RETENTION_DAYS"` // 0 keeps customer IDs forever
+	Interval time.Duration `yaml:"interval" env:"RETENTION_INTERVAL"`
+}
+
+type CustomersConfig struct {
+	// HashKey, if set, stores customer IDs as an HMAC-SHA256 keyed with it
+	HashKey string `yaml:"hash_key" env:"CUSTOMER_ID_HASH_KEY" secret:"true"`
+}
+
+// OpenAPIConfig controls validating requests and responses against the
+// OpenAPI document served at /openapi.json.
+type OpenAPIConfig struct {
+	ValidateRequests  bool `yaml:"validate_requests" env:"OPENAPI_VALIDATE_REQUESTS"`
+	ValidateResponses bool `yaml:"validate_responses" env:"OPENAPI_VALIDATE_RESPONSES"` // Logs responses that don't match
+}
+
+type GRPCConfig struct {
+	Port int `yaml:"port" env:"GRPC_PORT"` // 0, the default, disables the gRPC server
+}
+
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{Port: 3000, DrainPeriod: 5 * time.Second, ShutdownTimeout: 30 * time.Second},
+		Database: DatabaseConfig{
+			MaxConns:             50,
+			ConnectRetries:       5,
+			RetryInterval:        5 * time.Second,
+			SlowQueryThreshold:   100 * time.Millisecond,
+			MaxReplicaLag:        10 * time.Second,
+			ReplicaCheckInterval: 5 * time.Second,
+		},
+		Cache:   CacheConfig{Expiration: 15 * time.Minute, MaxEntries: 10000},
+		Redeem:  RedeemConfig{Timeout: 15 * time.Second},
+		Health:  HealthConfig{CheckTimeout: 2 * time.Second, PoolSaturationThreshold: 0.9},
+		Log:     LogConfig{Level: "info", Format: "json", RedactCustomerIDs: true},
+		Tracing: TracingConfig{Exporter: "none", ServiceName: "ango"},
+		Allocator: AllocatorConfig{
+			BlockSize:     500,
+			LeaseDuration: 5 * time.Minute,
+			FlushInterval: 10 * time.Millisecond,
+			FlushSize:     200,
+		},
+		Retention: RetentionConfig{Interval: time.Hour},
+		OpenAPI:   OpenAPIConfig{ValidateRequests: true},
+	}
+}
+
+// loadConfig builds the configuration from the defaults, the file at path (if
+// not empty) and the environment, and validates the result.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := applyConfigValues(reflect.ValueOf(&cfg).Elem(), "", values); err != nil {
+			return Config{}, fmt.Errorf("error in config file %s: %v", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem()); err != nil {
+		return Config{}, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+
+	values := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension %q, use .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file: %v", err)
+	}
+	return values, nil
+}
+
+// applyConfigValues copies values decoded from a config file onto the matching
+// struct fields. Unknown keys are rejected so typos do not go unnoticed.
+func applyConfigValues(v reflect.Value, prefix string, values map[string]interface{}) error {
+	fields := map[string]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Tag.Get("yaml")] = v.Field(i)
+	}
+
+	for key, value := range values {
+		field, found := fields[key]
+		if !found {
+			return fmt.Errorf("unknown key %q", prefix+key)
+		}
+
+		if field.Kind() == reflect.Struct {
+			nested, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%q must be a table", prefix+key)
+			}
+			if err := applyConfigValues(field, prefix+key+".", nested); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if list, ok := value.([]interface{}); ok && field.Kind() == reflect.Slice {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			field.Set(reflect.ValueOf(items))
+			continue
+		}
+
+		if err := setField(field, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("invalid value for %q: %v", prefix+key, err)
+		}
+	}
+	return nil
+}
+
+func applyEnv(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := v.Type().Field(i).Tag.Get("env")
+		value, set := os.LookupEnv(name)
+		if name == "" || !set || value == "" {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	case []string:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port must be between 1 and 65535"))
+	}
+	if c.GRPC.Port < 0 || c.GRPC.Port > 65535 {
+		errs = append(errs, fmt.Errorf("grpc.port must be between 0 and 65535"))
+	} else if c.GRPC.Port == c.Server.Port {
+		errs = append(errs, fmt.Errorf("grpc.port must differ from server.port"))
+	}
+	if c.Server.DrainPeriod < 0 {
+		errs = append(errs, fmt.Errorf("server.drain_period must not be negative"))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.shutdown_timeout must be greater than zero"))
+	}
+	if c.Database.MaxConns < 1 {
+		errs = append(errs, fmt.Errorf("database.max_conns must be at least 1"))
+	}
+	if c.Database.ConnectRetries < 1 {
+		errs = append(errs, fmt.Errorf("database.connect_retries must be at least 1"))
+	}
+	if c.Cache.MaxEntries < 1 {
+		errs = append(errs, fmt.Errorf("cache.max_entries must be at least 1"))
+	}
+	for name, d := range map[string]time.Duration{
+		"database.retry_interval":         c.Database.RetryInterval,
+		"database.slow_query_threshold":   c.Database.SlowQueryThreshold,
+		"database.max_replica_lag":        c.Database.MaxReplicaLag,
+		"database.replica_check_interval": c.Database.ReplicaCheckInterval,
+		"cache.expiration":                c.Cache.Expiration,
+		"redeem.timeout":                  c.Redeem.Timeout,
+		"health.check_timeout":            c.Health.CheckTimeout,
+		"retention.interval":              c.Retention.Interval,
+	} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be greater than zero", name))
+		}
+	}
+
+	if c.Health.PoolSaturationThreshold <= 0 || c.Health.PoolSaturationThreshold > 1 {
+		errs = append(errs, fmt.Errorf("health.pool_saturation_threshold must be greater than 0 and at most 1"))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %v", err))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("log.format must be json or text"))
+	}
+
+	switch c.RateLimit.Backend {
+	case "", "memory", "postgres":
+	default:
+		errs = append(errs, fmt.Errorf("rate_limit.backend must be memory or postgres"))
+	}
+	if c.Database.ReadURL != "" && (isSQLiteURL(c.Database.URL) || isSQLiteURL(c.Database.ReadURL)) {
+		errs = append(errs, fmt.Errorf("database.read_url is only supported with Postgres"))
+	}
+	if c.RateLimit.Backend == "postgres" && isSQLiteURL(c.Database.URL) {
+		errs = append(errs, fmt.Errorf("rate_limit.backend postgres cannot be used with a SQLite database"))
+	}
+	for name, limit := range map[string]string{
+		"rate_limit.per_api_key":  c.RateLimit.PerAPIKey,
+		"rate_limit.per_client":   c.RateLimit.PerClient,
+		"rate_limit.per_customer": c.RateLimit.PerCustomer,
+	} {
+		if _, err := parseRateLimit(limit); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter must be none, otlp or stdout"))
+	}
+
+	for _, id := range c.Allocator.Batches {
+		if _, err := uuid.Parse(id); err != nil {
+			errs = append(errs, fmt.Errorf("allocator.batches: invalid batch id %q", id))
+		}
+	}
+	if len(c.Allocator.Batches) > 0 && isSQLiteURL(c.Database.URL) {
+		errs = append(errs, fmt.Errorf("allocator.batches cannot be used with a SQLite database"))
+	}
+	if c.Allocator.BlockSize < 1 || c.Allocator.FlushSize < 1 {
+		errs = append(errs, fmt.Errorf("allocator.block_size and allocator.flush_size must be at least 1"))
+	}
+	if c.Allocator.FlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("allocator.flush_interval must be greater than zero"))
+	}
+	if c.Allocator.LeaseDuration < 10*c.Allocator.FlushInterval {
+		errs = append(errs, fmt.Errorf("allocator.lease_duration must be at least 10 times allocator.flush_interval"))
+	}
+
+	if c.Customers.HashKey != "" && len(c.Customers.HashKey) < 32 {
+		errs = append(errs, fmt.Errorf("customers.hash_key must be at least 32 characters"))
+	}
+	if c.Retention.Days < 0 {
+		errs = append(errs, fmt.Errorf("retention.days must not be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the configuration with secrets masked, for printing.
+func (c Config) Redacted() Config {
+	redactSecrets(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+func redactSecrets(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			redactSecrets(field)
+			continue
+		}
+		if v.Type().Field(i).Tag.Get("secret") != "true" || field.IsZero() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString("REDACTED")
+		case reflect.Slice:
+			redacted := make([]string, field.Len())
+			for j := range redacted {
+				redacted[j] = "REDACTED"
+			}
+			field.Set(reflect.ValueOf(redacted))
+		}
+	}
+}
+
+func printConfig(cfg Config) error {
+	out, err := yaml.Marshal(cfg.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	maxCustomerIDLength = 255
+	// hashedCustomerIDPrefix marks customer IDs stored as a keyed hash
+	hashedCustomerIDPrefix = "hmac-sha256:"
+)
+
+// validCustomerID reports whether id can be used as a customer ID. Customer
+// IDs are opaque strings from the caller's systems, such as a UUID, a number
+// or an email address.
+func validCustomerID(id string) bool {
+	if id == "" || len(id) > maxCustomerIDLength || !utf8.ValidString(id) {
+		return false
+	}
+	return strings.IndexFunc(id, unicode.IsControl) == -1
+}
+
+// storedCustomerID returns the form of a customer ID that is written to and
+// looked up in the store. UUIDs are normalised to lower case, so that they
+// match however they are written, as they did when the columns were UUIDs.
+// If customers.hash_key is set the result is a keyed hash of the ID.
+func storedCustomerID(id string) string {
+	if u, err := uuid.Parse(id); err == nil {
+		id = u.String()
+	}
+	return hashCustomerID(id, appConfig.Customers.HashKey)
+}
+
+func hashCustomerID(id, key string) string {
+	if key == "" {
+		return id
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(id))
+	return hashedCustomerIDPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// hashCustomerIDsBatchSize is how many customer IDs are hashed per statement.
+const hashCustomerIDsBatchSize = 1000
+
+// runCustomersCommand implements "ango customers hash", which replaces the
+// customer IDs stored before customers.hash_key was set with their hashes.
+func runCustomersCommand(ctx context.Context, pool *pgxpool.Pool, args []string, w io.Writer) error {
+	if len(args) != 1 || args[0] != "hash" {
+		return fmt.Errorf("usage: ango customers hash")
+	}
+	key := appConfig.Customers.HashKey
+	if key == "" {
+		return errors.New("customers.hash_key is not set")
+	}
+
+	for _, table := range []string{"codes", "code_usage", "codes_archive"} {
+		hashed, err := hashStoredCustomerIDs(ctx, pool, table, key)
+		if err != nil {
+			return fmt.Errorf("hashing %s: %w", table, err)
+		}
+		fmt.Fprintf(w, "%-13s %d customer IDs hashed\n", table, hashed)
+	}
+	return nil
+}
+
+func hashStoredCustomerIDs(ctx context.Context, pool *pgxpool.Pool, table, key string) (int, error) {
+	total := 0
+	for {
+		rows, err := pool.Query(ctx, fmt.Sprintf(`
+			SELECT DISTINCT customer_id FROM %s
+			WHERE customer_id IS NOT NULL AND customer_id NOT LIKE '%s%%'
+			LIMIT $1
+		`, table, hashedCustomerIDPrefix), hashCustomerIDsBatchSize)
+		if err != nil {
+			return total, err
+		}
+		var ids, hashes []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return total, err
+			}
+			ids = append(ids, id)
+			hashes = append(hashes, hashCustomerID(id, key))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		_, err = pool.Exec(ctx, fmt.Sprintf(`
+			UPDATE %[1]s SET customer_id = m.hashed
+			FROM unnest($1::text[], $2::text[]) AS m(id, hashed)
+			WHERE %[1]s.customer_id = m.id
+		`, table), ids, hashes)
+		if err != nil {
+			return total, err
+		}
+		total += len(ids)
+	}
+}
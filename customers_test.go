@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidCustomerID(t *testing.T) {
+	for _, id := range []string{"7c9e6679-7425-40de-944b-e07fc1f90ae7", "1234567", "jane@example.com", "CUST-00042", strings.Repeat("a", maxCustomerIDLength)} {
+		assert.True(t, validCustomerID(id), id)
+	}
+	for _, id := range []string{"", strings.Repeat("a", maxCustomerIDLength+1), "line\nbreak", "\xff"} {
+		assert.False(t, validCustomerID(id), id)
+	}
+}
+
+func TestStoredCustomerID(t *testing.T) {
+	saved := appConfig.Customers
+	t.Cleanup(func() { appConfig.Customers = saved })
+
+	appConfig.Customers.HashKey = ""
+	assert.Equal(t, "jane@example.com", storedCustomerID("jane@example.com"))
+	assert.Equal(t, "7c9e6679-7425-40de-944b-e07fc1f90ae7", storedCustomerID("7C9E6679-7425-40DE-944B-E07FC1F90AE7"))
+
+	appConfig.Customers.HashKey = strings.Repeat("k", 32)
+	hashed := storedCustomerID("jane@example.com")
+	assert.True(t, strings.HasPrefix(hashed, hashedCustomerIDPrefix))
+	assert.NotContains(t, hashed, "jane")
+	assert.Equal(t, hashed, storedCustomerID("jane@example.com"))
+	assert.Equal(t, storedCustomerID("7c9e6679-7425-40de-944b-e07fc1f90ae7"), storedCustomerID("7C9E6679-7425-40DE-944B-E07FC1F90AE7"))
+
+	// A different key gives a different hash
+	appConfig.Customers.HashKey = strings.Repeat("x", 32)
+	assert.NotEqual(t, hashed, storedCustomerID("jane@example.com"))
+}
@@ -0,0 +1,4 @@
+ALTER TABLE code_usage DROP CONSTRAINT IF EXISTS fk_code_usage_client;
+ALTER TABLE codes DROP CONSTRAINT IF EXISTS fk_codes_client;
+ALTER TABLE codes ALTER COLUMN client_id TYPE VARCHAR USING client_id::text;
+DROP TABLE IF EXISTS clients;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS clients (
+    id UUID PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- codes.client_id was free-form text. Redemptions have always required a UUID,
+-- so any other value is unreachable and the conversion below will fail loudly
+-- rather than silently dropping codes.
+ALTER TABLE codes ALTER COLUMN client_id TYPE UUID USING client_id::uuid;
+
+-- Create a client for every pool that already exists
+INSERT INTO clients (id, name)
+SELECT DISTINCT client_id, client_id::text FROM codes
+UNION
+SELECT DISTINCT client_id, client_id::text FROM code_usage
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE codes
+ADD CONSTRAINT fk_codes_client FOREIGN KEY (client_id) REFERENCES clients (id);
+
+ALTER TABLE code_usage
+ADD CONSTRAINT fk_code_usage_client FOREIGN KEY (client_id) REFERENCES clients (id);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS idx_codes_leased_by;
+
+ALTER TABLE codes
+DROP COLUMN leased_until,
+DROP COLUMN leased_by;
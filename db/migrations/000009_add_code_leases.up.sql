@@ -0,0 +1,7 @@
+-- Codes leased to an instance by the in-memory allocator. A lease that has
+-- passed leased_until belongs to an instance that stopped without releasing it.
+ALTER TABLE codes
+ADD COLUMN leased_by TEXT,
+ADD COLUMN leased_until TIMESTAMPTZ;
+
+CREATE INDEX idx_codes_leased_by ON codes (leased_by) WHERE leased_by IS NOT NULL;
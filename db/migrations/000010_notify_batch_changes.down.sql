@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS batches_notify_change ON batches;
+DROP FUNCTION IF EXISTS notify_batch_change();
@@ -0,0 +1,12 @@
+-- Tell every instance when a batch changes, so that cached rules and expiry
+-- are dropped straight away rather than when the cache entry expires.
+CREATE OR REPLACE FUNCTION notify_batch_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('ango_batch_changes', OLD.id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER batches_notify_change
+AFTER UPDATE OR DELETE ON batches
+FOR EACH ROW EXECUTE FUNCTION notify_batch_change();
@@ -0,0 +1,6 @@
+ALTER TABLE batches
+DROP COLUMN archived_at;
+
+DROP TABLE IF EXISTS codes_archive;
+DROP INDEX IF EXISTS idx_code_usage_customer_used_at;
+DROP INDEX IF EXISTS idx_codes_unclaimed;
@@ -0,0 +1,21 @@
+-- Redemptions look for an unclaimed code by batch and client. Only unclaimed
+-- codes are indexed, so the index shrinks as a batch is redeemed.
+CREATE INDEX IF NOT EXISTS idx_codes_unclaimed ON codes (batch_id, client_id) WHERE customer_id IS NULL;
+
+-- MaxPerCustomerRule counts a customer's redemptions within a time limit
+CREATE INDEX IF NOT EXISTS idx_code_usage_customer_used_at ON code_usage (customer_id, used_at);
+
+-- Codes from batches that are expired or fully redeemed are moved here by
+-- "ango archive", keeping the codes table to the batches still in use.
+CREATE TABLE IF NOT EXISTS codes_archive (
+    code TEXT NOT NULL,
+    batch_id UUID NOT NULL,
+    client_id UUID NOT NULL,
+    customer_id UUID,
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_codes_archive_batch_id ON codes_archive (batch_id);
+
+ALTER TABLE batches
+ADD COLUMN archived_at TIMESTAMPTZ;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_code_usage_batch_used_at;
+
+ALTER TABLE code_usage
+DROP COLUMN request_id;
@@ -0,0 +1,7 @@
+-- Redemptions are recorded with the X-Request-ID of the request that made
+-- them, so support can trace a code back to the caller's logs.
+ALTER TABLE code_usage
+ADD COLUMN request_id TEXT;
+
+-- Redemption history is listed per batch as well as per customer
+CREATE INDEX IF NOT EXISTS idx_code_usage_batch_used_at ON code_usage (batch_id, used_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_code_usage_pending_anonymisation;
+
+ALTER TABLE code_usage
+DROP COLUMN anonymised_at;
@@ -0,0 +1,8 @@
+-- Redemptions whose customer has been erased, or that are older than the
+-- retention period, are anonymised. Claimed codes keep a random customer_id
+-- in place of the real one, so inventory counts are unchanged.
+ALTER TABLE code_usage
+ADD COLUMN anonymised_at TIMESTAMP;
+
+-- The retention job only looks at redemptions it hasn't anonymised yet
+CREATE INDEX IF NOT EXISTS idx_code_usage_pending_anonymisation ON code_usage (used_at) WHERE anonymised_at IS NULL;
@@ -0,0 +1,9 @@
+-- Fails if any customer ID is not a UUID, including hashed IDs
+ALTER TABLE codes_archive
+ALTER COLUMN customer_id TYPE UUID USING customer_id::uuid;
+
+ALTER TABLE code_usage
+ALTER COLUMN customer_id TYPE UUID USING customer_id::uuid;
+
+ALTER TABLE codes
+ALTER COLUMN customer_id TYPE UUID USING customer_id::uuid;
@@ -0,0 +1,11 @@
+-- Customer IDs are opaque strings from the caller's systems, such as numbers
+-- or email addresses, or a keyed hash of them. Existing UUIDs are kept in
+-- their lower case text form, which is how they are looked up.
+ALTER TABLE codes
+ALTER COLUMN customer_id TYPE TEXT USING customer_id::text;
+
+ALTER TABLE code_usage
+ALTER COLUMN customer_id TYPE TEXT USING customer_id::text;
+
+ALTER TABLE codes_archive
+ALTER COLUMN customer_id TYPE TEXT USING customer_id::text;
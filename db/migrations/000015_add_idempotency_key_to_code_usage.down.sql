@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_code_usage_idempotency_key;
+
+ALTER TABLE code_usage
+DROP COLUMN idempotency_key;
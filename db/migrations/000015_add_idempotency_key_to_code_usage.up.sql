@@ -0,0 +1,7 @@
+-- Redemptions are recorded with the caller's Idempotency-Key, so that a
+-- retried redemption returns the code claimed by the first attempt. The index
+-- is unique so that concurrent retries can't both claim a code
+ALTER TABLE code_usage
+ADD COLUMN idempotency_key TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_code_usage_idempotency_key ON code_usage (batch_id, customer_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
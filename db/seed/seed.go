@@ -17,6 +17,16 @@ func main() {
 	}
 	defer db.Close()
 
+	_, err = db.Exec(`
+        INSERT INTO clients (id, name) VALUES
+        ('217be7c8-679c-4e08-bffc-db3451bdcdbf', 'Acme Retail'),
+        ('2ee73a08-ac6f-457d-934f-dcbc61840ae6', 'Globex Tickets')
+        ON CONFLICT DO NOTHING;
+    `)
+	if err != nil {
+		log.Fatalf("Failed to insert into clients: %v\n", err)
+	}
+
 	_, err = db.Exec(`
         INSERT INTO batches (id, name, rules, expired) VALUES
         ('11111111-1111-1111-1111-111111111111', 'Summer Sale', '{"maxpercustomer": 1, "timelimit": 30}', false),
@@ -0,0 +1,43 @@
+-- SQLite schema, equivalent to the Postgres schema after every migration in
+-- db/migrations. Statements must be idempotent as they run on every start.
+CREATE TABLE IF NOT EXISTS batches (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL DEFAULT '',
+    rules TEXT,
+    expired BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS clients (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    metadata TEXT NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    code TEXT UNIQUE NOT NULL,
+    batch_id TEXT NOT NULL,
+    client_id TEXT NOT NULL REFERENCES clients (id),
+    customer_id TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_codes_unclaimed ON codes (batch_id, client_id) WHERE customer_id IS NULL;
+
+CREATE TABLE IF NOT EXISTS code_usage (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    code TEXT NOT NULL,
+    batch_id TEXT NOT NULL,
+    client_id TEXT NOT NULL REFERENCES clients (id),
+    customer_id TEXT NOT NULL,
+    used_at TIMESTAMP NOT NULL,
+    request_id TEXT,
+    anonymised_at TIMESTAMP,
+    idempotency_key TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_code_usage_customer ON code_usage (customer_id, used_at);
+CREATE INDEX IF NOT EXISTS idx_code_usage_batch ON code_usage (batch_id, used_at);
+CREATE INDEX IF NOT EXISTS idx_code_usage_pending_anonymisation ON code_usage (used_at) WHERE anonymised_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_code_usage_idempotency_key ON code_usage (batch_id, customer_id, idempotency_key) WHERE idempotency_key IS NOT NULL;
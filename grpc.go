@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joshghent/ango/angopb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// grpcErrorDomain is the domain of the ErrorInfo attached to gRPC errors.
+const grpcErrorDomain = "ango"
+
+// grpcScopes is the scope each gRPC method requires, the same as its HTTP route.
+var grpcScopes = map[string]string{
+	angopb.Ango_Redeem_FullMethodName:        ScopeCodesRedeem,
+	angopb.Ango_ListBatches_FullMethodName:   ScopeBatchesRead,
+	angopb.Ango_GetBatch_FullMethodName:      ScopeBatchesRead,
+	angopb.Ango_UploadCodes_FullMethodName:   ScopeCodesUpload,
+	angopb.Ango_GetBatchStats_FullMethodName: ScopeBatchesRead,
+}
+
+// grpcCodes maps error codes to gRPC status codes. Codes not listed are
+// reported as Internal.
+var grpcCodes = map[string]codes.Code{
+	ProblemInvalidRequest:     codes.InvalidArgument,
+	ProblemUnknownClient:      codes.InvalidArgument,
+	ProblemUnauthorized:       codes.Unauthenticated,
+	ProblemForbidden:          codes.PermissionDenied,
+	ProblemBatchNotFound:      codes.NotFound,
+	ProblemClientNotFound:     codes.NotFound,
+	ProblemBatchExpired:       codes.FailedPrecondition,
+	ProblemClientInUse:        codes.FailedPrecondition,
+	ProblemInventoryExhausted: codes.ResourceExhausted,
+	ProblemRateLimited:        codes.ResourceExhausted,
+}
+
+type principalContextKey struct{}
+
+// grpcPrincipal returns the authenticated caller of a gRPC call, if auth is enabled.
+func grpcPrincipal(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(Principal)
+	return principal, ok
+}
+
+// grpcServer implements the gRPC API on top of the same service functions as
+// the HTTP handlers.
+type grpcServer struct {
+	angopb.UnimplementedAngoServer
+	store Store
+}
+
+func newGRPCServer(store Store) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	)
+	angopb.RegisterAngoServer(srv, &grpcServer{store: store})
+	return srv
+}
+
+// serveGRPC serves gRPC calls on lis until ctx is cancelled, then gives
+// in-flight calls up to timeout to complete.
+func serveGRPC(ctx context.Context, srv *grpc.Server, lis net.Listener, timeout time.Duration) {
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("gRPC server listening", "addr", lis.Addr().String())
+		errs <- srv.Serve(lis)
+	}()
+
+	select {
+	case err := <-errs:
+		slog.Error("gRPC server error", "error", err)
+		return
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		srv.Stop()
+	}
+	slog.Info("gRPC server stopped")
+}
+
+func (s *grpcServer) Redeem(ctx context.Context, in *angopb.RedeemRequest) (*angopb.RedeemResponse, error) {
+	req := Request{BatchID: in.BatchId, ClientID: in.ClientId, CustomerID: in.CustomerId}
+
+	// When the credentials carry a client_id, it takes precedence over the request
+	principal, authenticated := grpcPrincipal(ctx)
+	if authenticated && principal.ClientID != "" {
+		if req.ClientID != "" && req.ClientID != principal.ClientID {
+			return nil, grpcStatus(codes.PermissionDenied, ProblemForbidden, "client_id does not match credentials")
+		}
+		req.ClientID = principal.ClientID
+	}
+
+	if retryAfter, limited := redeemRateLimited(ctx, principal, authenticated, req); limited {
+		st, err := status.New(codes.ResourceExhausted, "rate limit exceeded").WithDetails(
+			&errdetails.ErrorInfo{Reason: ProblemRateLimited, Domain: grpcErrorDomain},
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(retryAfterSeconds(retryAfter)) * time.Second)},
+		)
+		if err != nil {
+			return nil, grpcStatus(codes.ResourceExhausted, ProblemRateLimited, "rate limit exceeded")
+		}
+		return nil, st.Err()
+	}
+
+	if key := in.IdempotencyKey; key != "" {
+		if !validIdempotencyKey(key) {
+			return nil, grpcStatus(codes.InvalidArgument, ProblemInvalidRequest, "invalid idempotency_key")
+		}
+		ctx = withIdempotencyKey(ctx, key)
+	}
+
+	code, err := getCode(ctx, s.store, req)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &angopb.RedeemResponse{Code: code}, nil
+}
+
+func (s *grpcServer) ListBatches(ctx context.Context, in *angopb.ListBatchesRequest) (*angopb.ListBatchesResponse, error) {
+	batches, err := getBatches(ctx, s.store)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &angopb.ListBatchesResponse{Batches: make([]*angopb.Batch, len(batches))}
+	for i, batch := range batches {
+		resp.Batches[i] = batchToProto(batch)
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) GetBatch(ctx context.Context, in *angopb.GetBatchRequest) (*angopb.Batch, error) {
+	batch, err := getBatch(ctx, s.store, in.Id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return batchToProto(batch), nil
+}
+
+func (s *grpcServer) GetBatchStats(ctx context.Context, in *angopb.GetBatchStatsRequest) (*angopb.BatchStats, error) {
+	inventory, err := getBatchInventory(ctx, s.store, in.Id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &angopb.BatchStats{
+		Batch:     batchToProto(inventory.Batch),
+		Total:     int64(inventory.Total),
+		Redeemed:  int64(inventory.Redeemed),
+		Available: int64(inventory.Available),
+	}, nil
+}
+
+// UploadCodes collects every code in the stream before uploading them, as
+// the batch and its codes are created together.
+func (s *grpcServer) UploadCodes(stream angopb.Ango_UploadCodesServer) error {
+	ctx := stream.Context()
+
+	first, err := stream.Recv()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	newBatch := first.GetBatch()
+	if newBatch == nil {
+		return grpcError(&ValidationError{Detail: "the first message must describe the batch"})
+	}
+
+	var newCodes []NewCode
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk := msg.GetCodes()
+		if chunk == nil {
+			return grpcError(&ValidationError{Detail: "only the first message may describe the batch"})
+		}
+		// Stop reading once the upload is too big, rather than hold the
+		// whole stream in memory
+		if len(newCodes)+len(chunk.Codes) > maxUploadCodes {
+			return grpcError(errTooManyCodes)
+		}
+		for _, code := range chunk.Codes {
+			newCodes = append(newCodes, NewCode{ClientID: code.ClientId, Code: code.Code})
+		}
+	}
+
+	rules := Rules{MaxPerCustomer: int(newBatch.Rules.GetMaxPerCustomer()), TimeLimit: int(newBatch.Rules.GetTimeLimit())}
+	batchID, err := uploadBatch(ctx, s.store, newBatch.Name, rules, newCodes)
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(&angopb.UploadCodesResponse{BatchId: batchID, Count: int64(len(newCodes))})
+}
+
+func batchToProto(batch Batch) *angopb.Batch {
+	return &angopb.Batch{
+		Id:      batch.ID,
+		Name:    batch.Name,
+		Expired: batch.Expired,
+		Rules: &angopb.Rules{
+			MaxPerCustomer: int32(batch.Rules.MaxPerCustomer),
+			TimeLimit:      int32(batch.Rules.TimeLimit),
+		},
+	}
+}
+
+// grpcError converts an error returned by the service functions to a gRPC
+// status, described the same way as the HTTP API's problem responses.
+func grpcError(err error) error {
+	_, code := problemForError(err)
+	grpcCode, found := grpcCodes[code]
+	switch {
+	case strings.HasPrefix(code, ProblemRuleFailed):
+		grpcCode = codes.FailedPrecondition
+	case !found:
+		grpcCode = codes.Internal
+	}
+	return grpcStatus(grpcCode, code, errorDetail(err, code))
+}
+
+// grpcStatus returns a gRPC error with an ErrorInfo whose reason is the error code.
+func grpcStatus(grpcCode codes.Code, code, detail string) error {
+	st := status.New(grpcCode, detail)
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{Reason: code, Domain: grpcErrorDomain}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// grpcContext prepares the context of a gRPC call the same way as the HTTP
+// middleware: it carries the request ID and, if auth is enabled, the
+// authenticated caller, who must have the method's scope.
+func grpcContext(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+
+	id := first(strings.ToLower(requestIDHeader))
+	if id == "" || len(id) > 128 {
+		id = uuid.New().String()
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(strings.ToLower(requestIDHeader), id))
+
+	if !authConfig.Enabled {
+		return ctx, nil
+	}
+	principal, err := authenticateCredentials(ctx, first("authorization"), first("x-api-key"))
+	if err != nil {
+		return ctx, grpcStatus(codes.Unauthenticated, ProblemUnauthorized, "unauthorized")
+	}
+	if scope := grpcScopes[method]; !principal.HasScope(scope) {
+		return ctx, grpcStatus(codes.PermissionDenied, ProblemForbidden, "insufficient scope, requires "+scope)
+	}
+	return context.WithValue(ctx, principalContextKey{}, principal), nil
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, err := grpcContext(ctx, info.FullMethod)
+	var resp interface{}
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	logGRPCCall(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func grpcStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := grpcContext(stream.Context(), info.FullMethod)
+	if err == nil {
+		err = handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	}
+	logGRPCCall(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// contextStream replaces the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// logGRPCCall logs and records metrics for a gRPC call, like requestLogger
+// and metricsMiddleware do for HTTP requests.
+func logGRPCCall(ctx context.Context, method string, start time.Time, err error) {
+	duration := time.Since(start)
+	code := status.Code(err)
+	grpcRequestsTotal.WithLabelValues(method, code.String()).Inc()
+	grpcRequestDuration.WithLabelValues(method, code.String()).Observe(duration.Seconds())
+
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK:
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+	loggerFromContext(ctx).LogAttrs(ctx, level, "grpc request",
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		durationAttr(duration),
+	)
+}
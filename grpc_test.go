@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/joshghent/ango/angopb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGRPCClient serves the gRPC API for store over an in-memory listener.
+func newTestGRPCClient(t *testing.T, store Store) angopb.AngoClient {
+	lis := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serveGRPC(ctx, newGRPCServer(store), lis, time.Second)
+		close(done)
+	}()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Unable to dial the gRPC server: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		<-done
+	})
+	return angopb.NewAngoClient(conn)
+}
+
+// errorReason returns the error code in the ErrorInfo of a gRPC error.
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestGRPCServer(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	batchID, clientID := newTestBatch(t, store, Rules{MaxPerCustomer: 1}, 2)
+	client := newTestGRPCClient(t, store)
+	customerID := uuid.New().String()
+
+	t.Run("Redeem", func(t *testing.T) {
+		resp, err := client.Redeem(ctx, &angopb.RedeemRequest{BatchId: batchID, ClientId: clientID, CustomerId: customerID})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, resp.GetCode())
+
+		_, err = client.Redeem(ctx, &angopb.RedeemRequest{BatchId: batchID, ClientId: clientID, CustomerId: customerID})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		assert.Equal(t, "rule_failed:maxpercustomer", errorReason(err))
+		assert.Equal(t, "maxpercustomer: customer has 1/1 codes", status.Convert(err).Message())
+
+		_, err = client.Redeem(ctx, &angopb.RedeemRequest{BatchId: "nope", ClientId: clientID, CustomerId: customerID})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, ProblemInvalidRequest, errorReason(err))
+	})
+
+	t.Run("Batches", func(t *testing.T) {
+		list, err := client.ListBatches(ctx, &angopb.ListBatchesRequest{})
+		assert.NoError(t, err)
+		assert.Len(t, list.GetBatches(), 1)
+
+		batch, err := client.GetBatch(ctx, &angopb.GetBatchRequest{Id: batchID})
+		assert.NoError(t, err)
+		assert.Equal(t, "Test Batch", batch.GetName())
+		assert.Equal(t, int32(1), batch.GetRules().GetMaxPerCustomer())
+
+		_, err = client.GetBatch(ctx, &angopb.GetBatchRequest{Id: uuid.New().String()})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		assert.Equal(t, ProblemBatchNotFound, errorReason(err))
+
+		stats, err := client.GetBatchStats(ctx, &angopb.GetBatchStatsRequest{Id: batchID})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), stats.GetTotal())
+		assert.Equal(t, int64(1), stats.GetRedeemed())
+		assert.Equal(t, int64(1), stats.GetAvailable())
+	})
+
+	t.Run("UploadCodes", func(t *testing.T) {
+		upload := func(messages ...*angopb.UploadCodesRequest) (*angopb.UploadCodesResponse, error) {
+			stream, err := client.UploadCodes(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, msg := range messages {
+				if err := stream.Send(msg); err != nil {
+					// The server has already replied, with the status
+					break
+				}
+			}
+			return stream.CloseAndRecv()
+		}
+		header := &angopb.UploadCodesRequest{Payload: &angopb.UploadCodesRequest_Batch{
+			Batch: &angopb.NewBatch{Name: "Streamed", Rules: &angopb.Rules{MaxPerCustomer: 2}},
+		}}
+		chunk := func(clientID string, codes ...string) *angopb.UploadCodesRequest {
+			newCodes := &angopb.NewCodes{}
+			for _, code := range codes {
+				newCodes.Codes = append(newCodes.Codes, &angopb.NewCode{ClientId: clientID, Code: code})
+			}
+			return &angopb.UploadCodesRequest{Payload: &angopb.UploadCodesRequest_Codes{Codes: newCodes}}
+		}
+
+		resp, err := upload(header, chunk(clientID, "STREAM-1", "STREAM-2"), chunk(clientID, "STREAM-3"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), resp.GetCount())
+
+		stats, err := client.GetBatchStats(ctx, &angopb.GetBatchStatsRequest{Id: resp.GetBatchId()})
+		assert.NoError(t, err)
+		assert.Equal(t, "Streamed", stats.GetBatch().GetName())
+		assert.Equal(t, int64(3), stats.GetAvailable())
+
+		before, _ := store.GetBatches(ctx)
+		_, err = upload(header, chunk(uuid.New().String(), "STREAM-4"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, ProblemUnknownClient, errorReason(err))
+		after, _ := store.GetBatches(ctx)
+		assert.Equal(t, len(before), len(after), "Expected no batch to be created")
+
+		_, err = upload(chunk(clientID, "STREAM-5"))
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		_, err = upload(header)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+		var tooMany []*angopb.UploadCodesRequest
+		for i := 0; i <= maxUploadCodes; i += 5000 {
+			var chunkCodes []string
+			for j := i; j < i+5000 && j <= maxUploadCodes; j++ {
+				chunkCodes = append(chunkCodes, fmt.Sprintf("MANY-%d", j))
+			}
+			tooMany = append(tooMany, chunk(clientID, chunkCodes...))
+		}
+		_, err = upload(append([]*angopb.UploadCodesRequest{header}, tooMany...)...)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "at most")
+	})
+}
+
+func TestGRPCAuth(t *testing.T) {
+	previous := authConfig
+	defer func() { authConfig = previous }()
+	authConfig = AuthConfig{Enabled: true, JWTSecret: []byte("test-secret")}
+
+	store := NewMemoryStore()
+	batchID, _ := newTestBatch(t, store, Rules{}, 1)
+	client := newTestGRPCClient(t, store)
+	expiry := time.Now().Add(time.Hour).Unix()
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		code  codes.Code
+	}{
+		{"No credentials", "", codes.Unauthenticated},
+		{"Wrong secret", signHS256(t, "other-secret", map[string]interface{}{"scope": "batches:read", "exp": expiry}), codes.Unauthenticated},
+		{"Missing scope", signHS256(t, "test-secret", map[string]interface{}{"scope": "codes:redeem", "exp": expiry}), codes.PermissionDenied},
+		{"Valid token with scope", signHS256(t, "test-secret", map[string]interface{}{"scope": "batches:read", "exp": expiry}), codes.OK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tt.token)
+			}
+			_, err := client.GetBatch(ctx, &angopb.GetBatchRequest{Id: batchID})
+			assert.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// expectedSchemaVersion is the latest embedded migration. Readiness fails
+// until the database has been migrated to it.
+var expectedSchemaVersion = latestMigrationVersion()
+
+type CheckResult struct {
+	Status    string  `json:"status"` // "pass" or "fail"
+	LatencyMs float64 `json:"latency_ms"`
+	Message   string  `json:"message,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"` // "ready" or "not_ready"
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type readinessCheck func(ctx context.Context) error
+
+// livezHandler only reports that the process is up and serving requests, so
+// that a database outage does not cause every instance to be restarted.
+func livezHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "alive"})
+}
+
+// readyzHandler reports whether this instance should receive traffic.
+func readyzHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		checks := map[string]readinessCheck{
+			"shutdown": checkNotShuttingDown,
+			"database": store.Ping,
+		}
+		// The schema and pool checks only apply to Postgres
+		if db != nil {
+			checks["migrations"] = checkSchemaVersion
+			checks["pool"] = checkPoolSaturation
+		}
+
+		response := ReadinessResponse{Status: "ready", Checks: map[string]CheckResult{}}
+		for name, check := range checks {
+			result := runCheck(c.Request.Context(), check)
+			if result.Status != "pass" {
+				response.Status = "not_ready"
+			}
+			response.Checks[name] = result
+		}
+
+		status := 200
+		if response.Status != "ready" {
+			status = 503
+		}
+		c.JSON(status, response)
+	}
+}
+
+func runCheck(ctx context.Context, check readinessCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Health.CheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := CheckResult{Status: "pass", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = "fail"
+		result.Message = err.Error()
+	}
+	return result
+}
+
+func checkNotShuttingDown(ctx context.Context) error {
+	if shuttingDown.Load() {
+		return fmt.Errorf("server is shutting down")
+	}
+	return nil
+}
+
+// checkSchemaVersion compares the applied version with the embedded migrations.
+func checkSchemaVersion(ctx context.Context) error {
+	version, dirty, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("migration %d is dirty", version)
+	}
+	if version == 0 {
+		return fmt.Errorf("no migrations have been applied, expected version %d", expectedSchemaVersion)
+	}
+	if version != expectedSchemaVersion {
+		return fmt.Errorf("schema is at version %d, expected %d", version, expectedSchemaVersion)
+	}
+	return nil
+}
+
+// checkPoolSaturation fails when nearly every connection is in use, as new
+// requests would queue waiting for a connection.
+func checkPoolSaturation(ctx context.Context) error {
+	stats := db.Stat()
+	if stats.MaxConns() == 0 {
+		return nil
+	}
+	usage := float64(stats.AcquiredConns()) / float64(stats.MaxConns())
+	if usage >= appConfig.Health.PoolSaturationThreshold {
+		return fmt.Errorf("%d of %d connections in use", stats.AcquiredConns(), stats.MaxConns())
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLivezHandler(t *testing.T) {
+	defer shuttingDown.Store(false)
+	shuttingDown.Store(true)
+
+	router := gin.New()
+	router.GET("/livez", livezHandler)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/livez", nil))
+	assert.Equal(t, 200, w.Code, "Expected liveness to pass even while shutting down")
+}
+
+func TestRunCheck(t *testing.T) {
+	pass := runCheck(context.Background(), func(ctx context.Context) error { return nil })
+	assert.Equal(t, "pass", pass.Status)
+	assert.Empty(t, pass.Message)
+
+	fail := runCheck(context.Background(), func(ctx context.Context) error { return errors.New("connection refused") })
+	assert.Equal(t, "fail", fail.Status)
+	assert.Equal(t, "connection refused", fail.Message)
+
+	defer shuttingDown.Store(false)
+	shuttingDown.Store(true)
+	assert.Equal(t, "fail", runCheck(context.Background(), checkNotShuttingDown).Status)
+}
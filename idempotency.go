@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// idempotencyKeyHeader lets callers retry a redemption safely. A redemption
+// with the same key, batch and customer as an earlier one returns the code it
+// claimed instead of claiming another.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+// ErrDuplicateIdempotencyKey is returned by the stores when a redemption is
+// recorded with the same key, batch and customer as one already recorded,
+// which happens when retries race each other.
+var ErrDuplicateIdempotencyKey = errors.New("a redemption with the same idempotency key was already recorded")
+
+type idempotencyKeyKey struct{}
+
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	return strings.IndexFunc(key, func(r rune) bool { return r > unicode.MaxASCII || !unicode.IsPrint(r) }) == -1
+}
+
+// withIdempotencyKey returns a context whose redemptions are recorded with key.
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey{}, key)
+}
+
+func idempotencyKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey{}).(string)
+	return key
+}
+
+// findIdempotentRedemption returns the code claimed by an earlier redemption
+// of the batch for the customer with the context's idempotency key, if any.
+// It is only a shortcut: a retry that races the first attempt past it is
+// stopped by the stores' unique index on the key.
+func findIdempotentRedemption(ctx context.Context, store Store, batchID, customerID string) (string, bool, error) {
+	key := idempotencyKeyFromContext(ctx)
+	if key == "" {
+		return "", false, nil
+	}
+	redemptions, err := store.GetRedemptions(ctx, RedemptionFilter{
+		BatchID:        strings.ToLower(batchID),
+		CustomerID:     customerID,
+		IdempotencyKey: key,
+		Limit:          1,
+	})
+	if err != nil || len(redemptions) == 0 {
+		return "", false, err
+	}
+	return redemptions[0].Code, true, nil
+}
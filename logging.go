@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type requestIDKey struct{}
+
+const requestIDHeader = "X-Request-ID"
+
+var redactCustomerIDs = true // Customer IDs are hashed in logs unless log.redact_customer_ids is false
+
+// setupLogging installs a JSON (or text) slog handler writing to w as the
+// default logger. The level accepts debug, info, warn or error.
+func setupLogging(cfg LogConfig, w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return fmt.Errorf("invalid log level: %v", err)
+	}
+	redactCustomerIDs = cfg.RedactCustomerIDs
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := cfg.Format; format {
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// CustomerID redacts itself when logged so that identifiers from the calling
+// system do not end up in log storage.
+type CustomerID string
+
+func (id CustomerID) LogValue() slog.Value {
+	if !redactCustomerIDs || id == "" {
+		return slog.StringValue(string(id))
+	}
+	sum := sha256.Sum256([]byte(id))
+	return slog.StringValue("sha256:" + hex.EncodeToString(sum[:])[:12])
+}
+
+// requestID assigns every request an ID, reusing the caller's X-Request-ID if
+// it sent one, and makes it available through the request context.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := strings.TrimSpace(c.GetHeader(requestIDHeader))
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		c.Header(requestIDHeader, id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+		c.Next()
+	}
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggerFromContext returns the default logger annotated with the request ID
+// and, when the request is being traced, the trace ID.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := requestIDFromContext(ctx); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+// durationAttr logs a duration as fractional milliseconds.
+func durationAttr(d time.Duration) slog.Attr {
+	return slog.Float64("duration_ms", float64(d.Microseconds())/1000)
+}
+
+// requestLogger replaces gin's text logger with one structured log line per request.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+
+		loggerFromContext(c.Request.Context()).LogAttrs(c.Request.Context(), level, "request",
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.Int("status", status),
+			durationAttr(time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		)
+	}
+}
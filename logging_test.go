@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	router := gin.New()
+	router.Use(requestID())
+	router.GET("/id", func(c *gin.Context) {
+		c.String(200, requestIDFromContext(c.Request.Context()))
+	})
+
+	t.Run("Generates an ID", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/id", nil))
+		assert.NotEmpty(t, w.Body.String())
+		assert.Equal(t, w.Body.String(), w.Header().Get(requestIDHeader))
+	})
+
+	t.Run("Reuses the caller's ID", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/id", nil)
+		req.Header.Set(requestIDHeader, "abc-123")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, "abc-123", w.Body.String())
+		assert.Equal(t, "abc-123", w.Header().Get(requestIDHeader))
+	})
+}
+
+func TestCustomerIDRedaction(t *testing.T) {
+	previous := redactCustomerIDs
+	defer func() { redactCustomerIDs = previous }()
+
+	id := CustomerID("fba9230a-a521-430e-aaf8-8aefbf588071")
+
+	redactCustomerIDs = true
+	redacted := id.LogValue().String()
+	assert.NotContains(t, redacted, string(id))
+	assert.Equal(t, redacted, id.LogValue().String(), "Expected redaction to be stable so requests can be correlated")
+
+	redactCustomerIDs = false
+	assert.Equal(t, string(id), id.LogValue().String())
+}
@@ -2,56 +2,287 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 
 	// "net/http"
 	// _ "net/http/pprof" // Register pprof handlers
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/joshghent/ango/cmd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 var db *pgxpool.Pool
 
 func main() {
-	log.SetOutput(os.Stdout)
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	showConfig := flag.Bool("print-config", false, "print the resolved configuration and exit")
+	autoMigrate := flag.Bool("auto-migrate", false, "apply pending migrations on startup")
+	apiURL := flag.String("url", os.Getenv("ANGO_URL"), "run the batches, codes and redemptions commands against the API at this URL rather than the database, authenticating with ANGO_API_KEY or ANGO_TOKEN")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate up|down [N]|status] [partition apply [N]|status] [archive [--dry-run]] [customers hash]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] COMMAND SUBCOMMAND [args], where COMMAND is one of:\n%s\n", os.Args[0], cmd.Usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var err error
+	appConfig, err = loadConfig(*configPath)
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if *showConfig {
+		if err := printConfig(appConfig); err != nil {
+			fatal("Unable to print configuration", err)
+		}
+		return
+	}
+
+	// Commands write their results to stdout, so they log to stderr
+	logOutput := io.Writer(os.Stdout)
+	if flag.NArg() > 0 && cmd.IsCommand(flag.Arg(0)) {
+		logOutput = os.Stderr
+	}
+	if err := setupLogging(appConfig.Log, logOutput); err != nil {
+		fatal("Unable to configure logging", err)
+	}
+	if *autoMigrate {
+		appConfig.Database.AutoMigrate = true
+	}
+
+	if flag.NArg() > 0 && cmd.IsCommand(flag.Arg(0)) {
+		closeBackend := func() {}
+		env := cmd.Env{
+			Open: func(ctx context.Context) (cmd.Backend, error) {
+				backend, done, err := openAdminBackend(ctx, *apiURL)
+				if err != nil {
+					return nil, err
+				}
+				closeBackend = done
+				return backend, nil
+			},
+			Stdin:  os.Stdin,
+			Stdout: os.Stdout,
+		}
+		err := cmd.Run(context.Background(), env, flag.Args())
+		closeBackend()
+		if err != nil {
+			fatal(fmt.Sprintf("%s failed", flag.Arg(0)), err)
+		}
+		return
+	}
+
+	if flag.NArg() > 0 {
+		commands := map[string]func(context.Context, *pgxpool.Pool, []string, io.Writer) error{
+			"migrate":   runMigrateCommand,
+			"customers": runCustomersCommand,
+			"partition": runPartitionCommand,
+			"archive":   runArchiveCommand,
+		}
+		command, found := commands[flag.Arg(0)]
+		if !found {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if isSQLiteURL(appConfig.Database.URL) {
+			fatal("Only Postgres databases can be managed", errors.New("the SQLite schema is created when the database is opened"))
+		}
+		db, err = connectToDB()
+		if err != nil {
+			fatal("Unable to connect to database", err)
+		}
+		defer db.Close()
+		if err := command(context.Background(), db, flag.Args()[1:], os.Stdout); err != nil {
+			fatal(fmt.Sprintf("%s failed", flag.Arg(0)), err)
+		}
+		return
+	}
 	// go func() {
 	// 	log.Println("Starting pprof on :6060")
 	// 	http.ListenAndServe(":6060", nil)
 	// }()
 
-	var err error
-	db, err = connectToDB()
+	shutdownTracing, err := setupTracing(context.Background(), appConfig.Tracing)
+	if err != nil {
+		fatal("Unable to configure tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	authConfig, err = loadAuthConfig(appConfig.Auth)
+	if err != nil {
+		fatal("Unable to load auth configuration", err)
+	}
+
+	var store Store
+	workers := newWorkerGroup()
+	if isSQLiteURL(appConfig.Database.URL) {
+		sqliteStore, err := OpenSQLiteStore(context.Background(), appConfig.Database.URL)
+		if err != nil {
+			fatal("Unable to open SQLite database", err)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+		slog.Info("Opened the SQLite database successfully")
+	} else {
+		db, err = connectToDB()
+		if err != nil {
+			fatal("Unable to connect to database", err)
+		}
+		defer db.Close()
+		slog.Info("Connected to the database successfully")
+
+		if appConfig.Database.AutoMigrate {
+			if err := migrateUp(context.Background(), db); err != nil {
+				fatal("Unable to migrate the database", err)
+			}
+		}
+		if err := checkSchema(context.Background(), db); err != nil {
+			fatal("Database schema does not match this build, run \"migrate up\" or enable database.auto_migrate", err)
+		}
+		pgStore := NewPostgresStore(db)
+		store = pgStore
+		if appConfig.Database.ReadURL != "" {
+			replicaPool, err := connectToReplica()
+			if err != nil {
+				fatal("Invalid read replica url", err)
+			}
+			defer replicaPool.Close()
+			replicaStore := NewReplicaStore(pgStore, NewPostgresStore(replicaPool), replicaPool)
+			store = replicaStore
+			workers.Go("monitorReplica", replicaStore.Run)
+			slog.Info("Read replica enabled")
+		}
+		if len(appConfig.Allocator.Batches) > 0 {
+			allocator := NewAllocator(store, pgStore, appConfig.Allocator)
+			store = allocator
+			workers.Go("allocator", allocator.Run)
+			slog.Info("Code allocator enabled", "batches", len(appConfig.Allocator.Batches), "owner", allocator.owner)
+		}
+
+		workers.Go("monitorDBConnections", func(ctx context.Context) { monitorDBConnections(ctx, db) })
+		workers.Go("listenForBatchChanges", func(ctx context.Context) { listenForBatchChanges(ctx, db) })
+
+		prometheus.MustRegister(newPoolCollector(db))
+		workers.Go("refreshInventoryMetrics", func(ctx context.Context) { refreshInventoryMetrics(ctx, db) })
+	}
+
+	limits, err := loadRateLimitConfig(appConfig.RateLimit)
 	if err != nil {
-		log.Fatalf("Unable to connect to database: %v\n", err)
+		fatal("Unable to load rate limit configuration", err)
+	}
+	switch backend := appConfig.RateLimit.Backend; backend {
+	case "memory":
+		rateLimiter = NewMemoryRateLimiter()
+	case "postgres":
+		rateLimiter = NewPostgresRateLimiter(db)
+	}
+	if rateLimiter != nil {
+		rateLimits = limits
+		workers.Go("sweepRateLimitBuckets", func(ctx context.Context) { sweepRateLimitBuckets(ctx, rateLimiter) })
+		slog.Info("Rate limiting enabled", "backend", appConfig.RateLimit.Backend)
+	}
+
+	if appConfig.Retention.Days > 0 {
+		workers.Go("anonymiseExpiredRedemptions", func(ctx context.Context) { anonymiseExpiredRedemptions(ctx, store, appConfig.Retention) })
+		slog.Info("Redemption retention enabled", "days", appConfig.Retention.Days)
+	}
+
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		fatal("Unable to load the OpenAPI document", err)
 	}
-	defer db.Close()
-	log.Println("Connected to the database successfully.")
 
-	go monitorDBConnections(db)
+	r := gin.New()
+	r.Use(otelgin.Middleware("ango"), requestID(), requestLogger(), metricsMiddleware(), gin.Recovery())
+	if appConfig.OpenAPI.ValidateResponses {
+		r.Use(validateResponses(spec, logResponseMismatch))
+	}
+	registerRoutes(r, store, spec)
+
+	if appConfig.GRPC.Port > 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", appConfig.GRPC.Port))
+		if err != nil {
+			fatal("Unable to listen for gRPC", err)
+		}
+		grpcServer := newGRPCServer(store)
+		workers.Go("serveGRPC", func(ctx context.Context) { serveGRPC(ctx, grpcServer, lis, appConfig.Server.ShutdownTimeout) })
+	}
 
-	r := gin.Default()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	r.GET("/healthcheck", healthcheckHandler)
-	r.POST("/api/v1/code/redeem", getCodeHandler)
-	r.GET("/api/v1/batches", getBatchesHandler)
-	r.POST("/api/v1/codes/upload", uploadCodesHandler)
+	err = serve(ctx, r, appConfig.Server)
+	workers.Stop()
+	if err != nil {
+		slog.Error("Server error", "error", err)
+	}
+}
 
-	if err := r.Run(":3000"); err != nil {
-		log.Fatalf("Unable to start server: %v\n", err)
+// registerRoutes adds every route to r. Each route must be described in
+// openapi.yaml, which requests to the API are validated against when
+// openapi.validate_requests is set.
+func registerRoutes(r *gin.Engine, store Store, spec *openapi3.T) {
+	// api returns the handlers for a route that requires scope
+	api := func(scope string, handlers ...gin.HandlerFunc) []gin.HandlerFunc {
+		chain := []gin.HandlerFunc{requireScope(scope)}
+		if appConfig.OpenAPI.ValidateRequests {
+			chain = append(chain, validateRequest(spec))
+		}
+		return append(chain, handlers...)
 	}
+
+	r.NoRoute(func(c *gin.Context) { respondWithProblem(c, 404, ProblemNotFound, "no route matches the request") })
+
+	r.GET("/openapi.json", openAPIHandler(spec))
+	r.GET("/healthcheck", healthcheckHandler(store))
+	r.GET("/livez", livezHandler)
+	r.GET("/readyz", readyzHandler(store))
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.POST("/api/v1/code/redeem", api(ScopeCodesRedeem, rateLimitRedeem(), getCodeHandler(store))...)
+	r.POST("/api/v1/code/eligibility", api(ScopeCodesRedeem, checkEligibilityHandler(store))...)
+	r.GET("/api/v1/batches", api(ScopeBatchesRead, getBatchesHandler(store))...)
+	r.POST("/api/v1/batches", api(ScopeBatchesAdmin, createBatchHandler(store))...)
+	r.GET("/api/v1/batches/:id/inventory", api(ScopeBatchesRead, getBatchInventoryHandler(store))...)
+	r.POST("/api/v1/batches/:id/expire", api(ScopeBatchesAdmin, expireBatchHandler(store))...)
+	r.POST("/api/v1/codes/upload", api(ScopeCodesUpload, uploadCodesHandler(store))...)
+	r.GET("/api/v1/batches/:id/redemptions", api(ScopeBatchesRead, getBatchRedemptionsHandler(store))...)
+	r.GET("/api/v1/customers/:id/redemptions", api(ScopeBatchesRead, getCustomerRedemptionsHandler(store))...)
+	r.DELETE("/api/v1/customers/:id", api(ScopeBatchesAdmin, eraseCustomerHandler(store))...)
+
+	r.GET("/api/v1/clients", api(ScopeBatchesRead, getClientsHandler(store))...)
+	r.POST("/api/v1/clients", api(ScopeBatchesAdmin, createClientHandler(store))...)
+	r.GET("/api/v1/clients/:id", api(ScopeBatchesRead, getClientHandler(store))...)
+	r.PUT("/api/v1/clients/:id", api(ScopeBatchesAdmin, updateClientHandler(store))...)
+	r.DELETE("/api/v1/clients/:id", api(ScopeBatchesAdmin, deleteClientHandler(store))...)
+	r.GET("/api/v1/clients/:id/batches", api(ScopeBatchesRead, getClientBatchesHandler(store))...)
+	r.GET("/api/v1/clients/:id/inventory", api(ScopeBatchesRead, getClientInventoryHandler(store))...)
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 type Request struct {
 	BatchID    string `json:"batchid"`
 	ClientID   string `json:"clientid"`   // this is the client identifier that the codes are tied to
-	CustomerID string `json:"customerid"` // this is the external systems customerId. Provided from your systems when making the request
+	CustomerID string `json:"customerid"` // this is the external systems customerId, any string up to 255 characters. Provided from your systems when making the request
 }
 
 type Code struct {
@@ -67,18 +298,14 @@ type Batch struct {
 
 func connectToDB() (*pgxpool.Pool, error) {
 	var db *pgxpool.Pool
-	var err error
-	maxRetries := 5
-	databaseURL := os.Getenv("DATABASE_URL")
+	maxRetries := appConfig.Database.ConnectRetries
 
-	for i := 0; i < maxRetries; i++ {
-		config, _ := pgxpool.ParseConfig(databaseURL)
-		config.MaxConns = 50
-		config.MaxConnIdleTime = 30 * time.Second
-		config.MaxConnLifetime = 1 * time.Hour
-		config.HealthCheckPeriod = 1 * time.Minute
-		config.ConnConfig.ConnectTimeout = 5 * time.Second
+	config, err := newPoolConfig(appConfig.Database.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid database url: %v", err)
+	}
 
+	for i := 0; i < maxRetries; i++ {
 		db, err = pgxpool.ConnectConfig(context.Background(), config)
 		if err == nil {
 			err = testDBConnection(db)
@@ -86,40 +313,63 @@ func connectToDB() (*pgxpool.Pool, error) {
 				break
 			}
 		}
-		log.Printf("Error connecting to database (attempt %d/%d): %v\nDatabase URL: %s", i+1, maxRetries, err, databaseURL)
-		time.Sleep(5 * time.Second)
+		slog.Warn("Error connecting to database", "attempt", i+1, "max_attempts", maxRetries, "error", err)
+		time.Sleep(appConfig.Database.RetryInterval)
 	}
 
 	return db, err
 }
 
-func monitorDBConnections(pool *pgxpool.Pool) {
+func newPoolConfig(url string) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, err
+	}
+	config.MaxConns = appConfig.Database.MaxConns
+	config.MaxConnIdleTime = 30 * time.Second
+	config.MaxConnLifetime = 1 * time.Hour
+	config.HealthCheckPeriod = 1 * time.Minute
+	config.ConnConfig.ConnectTimeout = 5 * time.Second
+	if tracingEnabled {
+		config.ConnConfig.Logger = queryTracer{}
+		config.ConnConfig.LogLevel = pgx.LogLevelInfo
+	}
+	return config, nil
+}
+
+func monitorDBConnections(ctx context.Context, pool *pgxpool.Pool) {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		stats := pool.Stat()
-		log.Printf("DB Pool Stats - Total: %d, Idle: %d, In Use: %d, Max: %d",
-			stats.TotalConns(), stats.IdleConns(), stats.AcquiredConns(), stats.MaxConns())
+		slog.Info("DB pool stats",
+			"total", stats.TotalConns(), "idle", stats.IdleConns(), "in_use", stats.AcquiredConns(), "max", stats.MaxConns())
 
 		// Check and reset stalled connections with extended timeout
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		err := pool.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
-			_, err := conn.Exec(ctx, "SELECT 1")
+		checkCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := pool.AcquireFunc(checkCtx, func(conn *pgxpool.Conn) error {
+			_, err := conn.Exec(checkCtx, "SELECT 1")
 			if err != nil {
-				log.Printf("Resetting stalled connection: %v", err)
+				slog.Warn("Resetting stalled connection", "error", err)
 				conn.Hijack()
 			}
 			return nil
 		})
 		cancel()
 		if err != nil {
-			log.Printf("Error checking for stalled connections: %v", err)
+			slog.Error("Error checking for stalled connections", "error", err)
 		}
 
 		// Terminate long-running idle connections with extended timeout
-		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-		_, err = pool.Exec(ctx, `
+		checkCtx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		_, err = pool.Exec(checkCtx, `
 			SELECT pg_terminate_backend(pid)
 			FROM pg_stat_activity
 			WHERE state = 'idle in transaction'
@@ -128,27 +378,16 @@ func monitorDBConnections(pool *pgxpool.Pool) {
 		`)
 		cancel()
 		if err != nil {
-			log.Printf("Error terminating long-running transactions: %v", err)
+			slog.Error("Error terminating long-running transactions", "error", err)
 		}
 	}
 }
 
 
 func testDBConnection(db *pgxpool.Pool) error {
-	// Check if the required tables exist
-	tables := []string{"batches", "codes"}
-	for _, table := range tables {
-		var exists bool
-		err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT FROM information_schema.tables WHERE table_name = $1)", table).Scan(&exists)
-		if err != nil {
-			return fmt.Errorf("error checking if table %s exists: %v", table, err)
-		}
-		if !exists {
-			return fmt.Errorf("required table %s does not exist", table)
-		}
-	}
-
-	// Test the connection by querying the database
+	// Test the connection by querying the database. Whether the schema is
+	// up to date is checked separately, so that "migrate up" can run against
+	// an empty database.
 	var testResult int
 	err := db.QueryRow(context.Background(), "SELECT 1").Scan(&testResult)
 	if err != nil {
@@ -157,130 +396,198 @@ func testDBConnection(db *pgxpool.Pool) error {
 	return nil
 }
 
-func getCodeHandler(c *gin.Context) {
+// bindRedeemRequest reads and validates the body of the redeem and
+// eligibility routes. It writes the error response and returns false if the
+// request is invalid.
+func bindRedeemRequest(c *gin.Context) (Request, bool) {
 	var req Request
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"error": "cannot parse json"})
-		return
+		respondWithProblem(c, 400, ProblemInvalidRequest, "cannot parse json")
+		return Request{}, false
+	}
+
+	// When the token carries a client_id, it takes precedence over the request body
+	if principal, ok := principalFromContext(c); ok && principal.ClientID != "" {
+		if req.ClientID != "" && req.ClientID != principal.ClientID {
+			respondWithProblem(c, 403, ProblemForbidden, "client_id does not match credentials")
+			return Request{}, false
+		}
+		req.ClientID = principal.ClientID
 	}
 
-	// Validate UUIDs immediately after parsing JSON
+	// Validate IDs immediately after parsing JSON
 	if _, err := uuid.Parse(req.BatchID); err != nil {
-		c.JSON(400, gin.H{"error": "invalid batch_id format"})
-		return
+		respondWithProblem(c, 400, ProblemInvalidRequest, "invalid batch_id format")
+		return Request{}, false
 	}
 	if _, err := uuid.Parse(req.ClientID); err != nil {
-		c.JSON(400, gin.H{"error": "invalid client_id format"})
-		return
+		respondWithProblem(c, 400, ProblemInvalidRequest, "invalid client_id format")
+		return Request{}, false
 	}
-	if _, err := uuid.Parse(req.CustomerID); err != nil {
-		c.JSON(400, gin.H{"error": "invalid customer_id format"})
-		return
+	if !validCustomerID(req.CustomerID) {
+		respondWithProblem(c, 400, ProblemInvalidRequest, "invalid customer_id format")
+		return Request{}, false
 	}
+	return req, true
+}
 
-	code, err := getCode(context.Background(), req)
-	if err != nil {
-		if err == ErrNoCodeFound {
-			c.JSON(404, gin.H{"error": "no code found"})
-		} else if err == ErrConditionNotMet {
-			c.JSON(403, gin.H{"error": "rule conditions not met"})
-		} else {
-			log.Printf("Error: %v", err)
-			c.JSON(500, gin.H{"error": "database error"})
+func getCodeHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, ok := bindRedeemRequest(c)
+		if !ok {
+			return
 		}
-		return
-	}
 
-	c.JSON(200, Code{Code: code})
-}
+		ctx := c.Request.Context()
+		if key := c.GetHeader(idempotencyKeyHeader); key != "" {
+			if !validIdempotencyKey(key) {
+				respondWithProblem(c, 400, ProblemInvalidRequest, "invalid Idempotency-Key header")
+				return
+			}
+			ctx = withIdempotencyKey(ctx, key)
+		}
 
-func getBatchesHandler(c *gin.Context) {
-	batches, err := getBatches(context.Background())
-	if err != nil {
-		c.JSON(500, gin.H{"error": "database error"})
-		return
+		code, err := getCode(ctx, store, req)
+		if err != nil {
+			if status, _ := problemForError(err); status == 500 {
+				loggerFromContext(ctx).Error("Error redeeming code", "batch_id", req.BatchID, "customer_id", CustomerID(req.CustomerID), "error", err)
+			}
+			respondWithError(c, err)
+			return
+		}
+
+		c.JSON(200, Code{Code: code})
 	}
-	c.JSON(200, batches)
 }
 
-func uploadCodesHandler(c *gin.Context) {
-	// Get the CSV file from the request
-	file, header, err := c.Request.FormFile("file")
-	if err != nil {
-		c.JSON(400, gin.H{"error": "No CSV file provided"})
-		return
-	}
-	defer file.Close()
+// checkEligibilityHandler reports whether a redemption would pass the
+// batch's rules, without claiming a code.
+func checkEligibilityHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, ok := bindRedeemRequest(c)
+		if !ok {
+			return
+		}
 
-	// Check if the file is a CSV
-	if !strings.HasSuffix(header.Filename, ".csv") {
-		c.JSON(400, gin.H{"error": "File must be a CSV"})
-		return
+		eligibility, err := checkEligibility(c.Request.Context(), store, req)
+		if err != nil {
+			if status, _ := problemForError(err); status == 500 {
+				loggerFromContext(c.Request.Context()).Error("Error checking eligibility", "batch_id", req.BatchID, "customer_id", CustomerID(req.CustomerID), "error", err)
+			}
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, eligibility)
 	}
+}
 
-	// Check if the CSV contains required columns
-	csvReader := csv.NewReader(file)
-	headers, err := csvReader.Read()
-	if err != nil {
-		c.JSON(400, gin.H{"error": "Failed to read CSV headers"})
-		return
-	}
-	if !containsColumns(headers, []string{"code", "client_id"}) {
-		c.JSON(400, gin.H{"error": "CSV must contain 'code' and 'client_id' columns"})
-		return
+func getBatchesHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		batches, err := getBatches(c.Request.Context(), store)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, batches)
 	}
+}
 
-	// Reset file pointer to the beginning
-	file.Seek(0, 0)
+func createBatchHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BatchRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "cannot parse json")
+			return
+		}
 
-	// Get batch name from form data
-	batchName := c.PostForm("batch_name")
-	if batchName == "" {
-		c.JSON(400, gin.H{"error": "Batch name is required"})
-		return
+		batch, err := newBatch(c.Request.Context(), store, req)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(201, batch)
 	}
+}
 
-	// Get rules from form data (optional)
-	rules := c.PostForm("rules")
-
-	// Create a new batch with the given name and rules
-	batchID, err := createBatch(c.Request.Context(), batchName, rules)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to create batch: " + err.Error()})
-		return
+func getBatchInventoryHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		inventory, err := getBatchInventory(c.Request.Context(), store, c.Param("id"))
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, inventory)
 	}
+}
 
-	// Call the service function to handle the upload
-	err = uploadCodes(c.Request.Context(), file, batchID)
-	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to upload codes: " + err.Error()})
-		return
+func expireBatchHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		batch, err := expireBatch(c.Request.Context(), store, c.Param("id"))
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.JSON(200, batch)
 	}
-
-	c.JSON(200, gin.H{"message": "Codes uploaded successfully"})
 }
 
-// Used to check if the CSV contains the required columns
-func containsColumns(headers []string, requiredColumns []string) bool {
-	headerSet := make(map[string]bool)
-	for _, h := range headers {
-		headerSet[h] = true
-	}
-	for _, rc := range requiredColumns {
-		if !headerSet[rc] {
-			return false
+func uploadCodesHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the CSV file from the request
+		file, header, err := c.Request.FormFile("file")
+		if err != nil {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "No CSV file provided")
+			return
 		}
+		defer file.Close()
+
+		// Check if the file is a CSV
+		if !strings.HasSuffix(header.Filename, ".csv") {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "File must be a CSV")
+			return
+		}
+
+		// Get rules from form data (optional)
+		rules, err := parseRules(c.PostForm("rules"))
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+
+		codes, err := readCodesCSV(file)
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+
+		// Call the service function to create the batch with its codes
+		batchID, err := uploadBatch(c.Request.Context(), store, c.PostForm("batch_name"), rules, codes)
+		if err != nil {
+			if !isServiceError(err) {
+				loggerFromContext(c.Request.Context()).Error("Error uploading codes", "error", err)
+			}
+			respondWithError(c, err)
+			return
+		}
+
+		c.JSON(200, gin.H{"message": "Codes uploaded successfully", "batch_id": batchID})
 	}
-	return true
 }
 
 // Add this new function at the end of the file
-func healthcheckHandler(c *gin.Context) {
-	err := db.Ping(context.Background())
-	if err != nil {
-		log.Printf("Healthcheck failed: %v", err)
-		c.JSON(500, gin.H{"status": "unhealthy", "message": "Unable to connect to the database"})
-		return
+func healthcheckHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if shuttingDown.Load() {
+			c.JSON(503, gin.H{"status": "unhealthy", "message": "Server is shutting down"})
+			return
+		}
+
+		err := store.Ping(c.Request.Context())
+		if err != nil {
+			slog.Error("Healthcheck failed", "error", err)
+			c.JSON(500, gin.H{"status": "unhealthy", "message": "Unable to connect to the database"})
+			return
+		}
+		c.JSON(200, gin.H{"status": "healthy", "message": "System is operational"})
 	}
-	c.JSON(200, gin.H{"status": "healthy", "message": "System is operational"})
 }
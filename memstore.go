@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type memCode struct {
+	code        string
+	batchID     string
+	clientID    string
+	customerID  string
+	held        bool // Held by an in-progress ClaimCode, like a row lock
+	leasedBy    string
+	leasedUntil time.Time
+}
+
+func (c *memCode) leased(now time.Time) bool {
+	return c.leasedBy != "" && c.leasedUntil.After(now)
+}
+
+type memUsage struct {
+	id             int64
+	code           string
+	batchID        string
+	clientID       string
+	customerID     string
+	usedAt         time.Time
+	requestID      string
+	idempotencyKey string
+	anonymised     bool
+}
+
+// MemoryStore keeps everything in process. It mirrors PostgresStore so that
+// the service logic can be tested without a database.
+type MemoryStore struct {
+	mu      sync.Mutex
+	batches map[string]Batch
+	codes   []*memCode
+	usage   []memUsage
+	clients map[string]Client
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		batches: map[string]Batch{},
+		clients: map[string]Client{},
+	}
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) GetBatch(ctx context.Context, batchID string) (Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch, found := s.batches[strings.ToLower(batchID)]
+	if !found {
+		return Batch{}, ErrNoBatchFound
+	}
+	return batch, nil
+}
+
+func (s *MemoryStore) GetBatches(ctx context.Context) ([]Batch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var batches []Batch
+	for _, batch := range s.batches {
+		if !batch.Expired {
+			batches = append(batches, batch)
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].Name < batches[j].Name })
+	return batches, nil
+}
+
+func (s *MemoryStore) CreateBatch(ctx context.Context, name string, rules Rules) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch := Batch{ID: uuid.New().String(), Name: name, Rules: rules}
+	s.batches[batch.ID] = batch
+	return batch.ID, nil
+}
+
+func (s *MemoryStore) ExpireBatch(ctx context.Context, batchID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch, found := s.batches[strings.ToLower(batchID)]
+	if !found {
+		return ErrNoBatchFound
+	}
+	batch.Expired = true
+	s.batches[batch.ID] = batch
+	return nil
+}
+
+func (s *MemoryStore) CreateBatchWithCodes(ctx context.Context, name string, rules Rules, codes []NewCode) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check every constraint before creating anything, as the transaction would
+	existing := make(map[string]bool, len(s.codes)+len(codes))
+	for _, c := range s.codes {
+		existing[c.code] = true
+	}
+	for _, c := range codes {
+		if existing[c.Code] {
+			return "", fmt.Errorf("error executing bulk insert: duplicate code %s", c.Code)
+		}
+		existing[c.Code] = true
+		if _, found := s.clients[strings.ToLower(c.ClientID)]; !found {
+			return "", fmt.Errorf("error executing bulk insert: client %s does not exist", c.ClientID)
+		}
+	}
+
+	batch := Batch{ID: uuid.New().String(), Name: name, Rules: rules}
+	s.batches[batch.ID] = batch
+	for _, c := range codes {
+		s.codes = append(s.codes, &memCode{code: c.Code, batchID: batch.ID, clientID: strings.ToLower(c.ClientID)})
+	}
+	return batch.ID, nil
+}
+
+func (s *MemoryStore) ClaimCode(ctx context.Context, batchID, clientID, customerID string, check func(ctx context.Context) error) (string, error) {
+	s.mu.Lock()
+	var claimed *memCode
+	for _, c := range s.codes {
+		if c.batchID == strings.ToLower(batchID) && c.clientID == strings.ToLower(clientID) && c.customerID == "" && !c.held && !c.leased(time.Now()) {
+			claimed = c
+			break
+		}
+	}
+	if claimed == nil {
+		s.mu.Unlock()
+		return "", ErrNoCodeFound
+	}
+	claimed.held = true
+	s.mu.Unlock()
+
+	// check may call back into the store, so it runs without the mutex held
+	err := check(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	claimed.held = false
+	if err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if key := idempotencyKeyFromContext(ctx); key != "" && s.hasIdempotencyKey(claimed.batchID, customerID, key) {
+		return "", ErrDuplicateIdempotencyKey
+	}
+	claimed.customerID = customerID
+	s.recordUsage(claimed, requestIDFromContext(ctx), idempotencyKeyFromContext(ctx))
+	return claimed.code, nil
+}
+
+func (s *MemoryStore) CountRedemptions(ctx context.Context, customerID string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, u := range s.usage {
+		if u.customerID == customerID && !u.usedAt.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// hasIdempotencyKey reports whether a redemption of the batch by the customer
+// was recorded with the key, as the unique index checks. s.mu must be held.
+func (s *MemoryStore) hasIdempotencyKey(batchID, customerID, key string) bool {
+	for _, u := range s.usage {
+		if u.batchID == batchID && u.customerID == customerID && u.idempotencyKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// recordUsage adds a claimed code to the usage ledger. s.mu must be held.
+func (s *MemoryStore) recordUsage(c *memCode, requestID, idempotencyKey string) {
+	s.usage = append(s.usage, memUsage{
+		id:             int64(len(s.usage) + 1),
+		code:           c.code,
+		batchID:        c.batchID,
+		clientID:       c.clientID,
+		customerID:     c.customerID,
+		usedAt:         time.Now(),
+		requestID:      requestID,
+		idempotencyKey: idempotencyKey,
+	})
+}
+
+func (s *MemoryStore) GetRedemptions(ctx context.Context, filter RedemptionFilter) ([]Redemption, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	redemptions := []Redemption{}
+	for _, u := range s.usage {
+		switch {
+		case filter.CustomerID != "" && u.customerID != filter.CustomerID,
+			filter.BatchID != "" && u.batchID != filter.BatchID,
+			filter.ClientID != "" && u.clientID != filter.ClientID,
+			filter.IdempotencyKey != "" && u.idempotencyKey != filter.IdempotencyKey,
+			!filter.From.IsZero() && u.usedAt.Before(filter.From),
+			!filter.To.IsZero() && !u.usedAt.Before(filter.To):
+			continue
+		}
+		if c := filter.Cursor; c != nil && (u.usedAt.After(c.UsedAt) || (u.usedAt.Equal(c.UsedAt) && u.id >= c.ID)) {
+			continue
+		}
+		redemptions = append(redemptions, Redemption{
+			ID:         u.id,
+			Code:       u.code,
+			BatchID:    u.batchID,
+			BatchName:  s.batches[u.batchID].Name,
+			ClientID:   u.clientID,
+			CustomerID: u.customerID,
+			RedeemedAt: u.usedAt,
+			RequestID:  u.requestID,
+		})
+	}
+
+	sort.Slice(redemptions, func(i, j int) bool {
+		if !redemptions[i].RedeemedAt.Equal(redemptions[j].RedeemedAt) {
+			return redemptions[i].RedeemedAt.After(redemptions[j].RedeemedAt)
+		}
+		return redemptions[i].ID > redemptions[j].ID
+	})
+	if len(redemptions) > filter.Limit {
+		redemptions = redemptions[:filter.Limit]
+	}
+	return redemptions, nil
+}
+
+func (s *MemoryStore) EraseCustomer(ctx context.Context, customerID string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.codes {
+		if c.customerID == customerID {
+			c.customerID = uuid.New().String()
+		}
+	}
+	erased := 0
+	for i := range s.usage {
+		if s.usage[i].customerID == customerID {
+			s.anonymise(&s.usage[i])
+			erased++
+		}
+	}
+	return erased, nil
+}
+
+func (s *MemoryStore) AnonymiseRedemptions(ctx context.Context, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	anonymised := 0
+	for i := range s.usage {
+		u := &s.usage[i]
+		if u.anonymised || !u.usedAt.Before(before) {
+			continue
+		}
+		for _, c := range s.codes {
+			if c.batchID == u.batchID && c.code == u.code && c.customerID != "" {
+				c.customerID = uuid.New().String()
+			}
+		}
+		s.anonymise(u)
+		anonymised++
+	}
+	return anonymised, nil
+}
+
+// anonymise replaces the customer ID and clears the request ID and
+// idempotency key of a redemption. s.mu must be held.
+func (s *MemoryStore) anonymise(u *memUsage) {
+	u.customerID = uuid.New().String()
+	u.requestID = ""
+	u.idempotencyKey = ""
+	u.anonymised = true
+}
+
+func (s *MemoryStore) CreateClient(ctx context.Context, client Client) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.clients[client.ID]; found {
+		return Client{}, fmt.Errorf("client %s already exists", client.ID)
+	}
+	client.CreatedAt = time.Now()
+	client.UpdatedAt = client.CreatedAt
+	s.clients[client.ID] = client
+	return client, nil
+}
+
+func (s *MemoryStore) GetClients(ctx context.Context) ([]Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clients := []Client{}
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Name < clients[j].Name })
+	return clients, nil
+}
+
+func (s *MemoryStore) GetClient(ctx context.Context, clientID string) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, found := s.clients[strings.ToLower(clientID)]
+	if !found {
+		return Client{}, ErrNoClientFound
+	}
+	return client, nil
+}
+
+func (s *MemoryStore) UpdateClient(ctx context.Context, client Client) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, found := s.clients[strings.ToLower(client.ID)]
+	if !found {
+		return Client{}, ErrNoClientFound
+	}
+	existing.Name = client.Name
+	existing.Metadata = client.Metadata
+	existing.UpdatedAt = time.Now()
+	s.clients[existing.ID] = existing
+	return existing, nil
+}
+
+func (s *MemoryStore) DeleteClient(ctx context.Context, clientID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientID = strings.ToLower(clientID)
+	if _, found := s.clients[clientID]; !found {
+		return ErrNoClientFound
+	}
+	for _, c := range s.codes {
+		if c.clientID == clientID {
+			return ErrClientInUse
+		}
+	}
+	delete(s.clients, clientID)
+	return nil
+}
+
+func (s *MemoryStore) GetClientBatches(ctx context.Context, clientID string) ([]BatchInventory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byBatch := map[string]*BatchInventory{}
+	for _, c := range s.codes {
+		if c.clientID != strings.ToLower(clientID) {
+			continue
+		}
+		inventory, found := byBatch[c.batchID]
+		if !found {
+			inventory = &BatchInventory{Batch: s.batches[c.batchID]}
+			byBatch[c.batchID] = inventory
+		}
+		inventory.Total++
+		if c.customerID != "" {
+			inventory.Redeemed++
+		}
+	}
+
+	batches := []BatchInventory{}
+	for _, inventory := range byBatch {
+		inventory.Available = inventory.Total - inventory.Redeemed
+		batches = append(batches, *inventory)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].Name < batches[j].Name })
+	return batches, nil
+}
+
+func (s *MemoryStore) GetBatchInventory(ctx context.Context, batchID string) (BatchInventory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	batch, found := s.batches[strings.ToLower(batchID)]
+	if !found {
+		return BatchInventory{}, ErrNoBatchFound
+	}
+	inventory := BatchInventory{Batch: batch}
+	for _, c := range s.codes {
+		if c.batchID != batch.ID {
+			continue
+		}
+		inventory.Total++
+		if c.customerID != "" {
+			inventory.Redeemed++
+		}
+	}
+	inventory.Available = inventory.Total - inventory.Redeemed
+	return inventory, nil
+}
+
+func (s *MemoryStore) GetClientInventory(ctx context.Context, clientID string) (ClientInventory, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inventory := ClientInventory{ClientID: clientID}
+	for _, c := range s.codes {
+		if c.clientID != strings.ToLower(clientID) {
+			continue
+		}
+		inventory.Total++
+		if c.customerID != "" {
+			inventory.Redeemed++
+		}
+	}
+	inventory.Available = inventory.Total - inventory.Redeemed
+	return inventory, nil
+}
+
+func (s *MemoryStore) ClientExists(ctx context.Context, clientID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.clients[strings.ToLower(clientID)]
+	return found, nil
+}
+
+func (s *MemoryStore) FindClients(ctx context.Context, clientIDs []string) (map[string]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := make(map[string]bool)
+	for _, id := range clientIDs {
+		if _, ok := s.clients[strings.ToLower(id)]; ok {
+			found[strings.ToLower(id)] = true
+		}
+	}
+	return found, nil
+}
+
+func (s *MemoryStore) LeaseCodes(ctx context.Context, batchID, clientID, owner string, n int, d time.Duration) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var codes []string
+	for _, c := range s.codes {
+		if len(codes) == n {
+			break
+		}
+		if c.batchID == strings.ToLower(batchID) && c.clientID == strings.ToLower(clientID) && c.customerID == "" && !c.held && !c.leased(now) {
+			c.leasedBy = owner
+			c.leasedUntil = now.Add(d)
+			codes = append(codes, c.code)
+		}
+	}
+	return codes, nil
+}
+
+func (s *MemoryStore) AssignLeasedCodes(ctx context.Context, owner string, assignments []CodeAssignment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byCode := make(map[string]*memCode, len(s.codes))
+	for _, c := range s.codes {
+		byCode[c.code] = c
+	}
+	keys := map[[3]string]bool{}
+	for _, a := range assignments {
+		// As in Postgres, a lapsed lease is still honoured until someone else takes the code
+		if c := byCode[a.Code]; c == nil || c.batchID != strings.ToLower(a.BatchID) || c.leasedBy != owner || c.customerID != "" {
+			return ErrLeaseLost
+		}
+		if a.IdempotencyKey != "" {
+			key := [3]string{strings.ToLower(a.BatchID), a.CustomerID, a.IdempotencyKey}
+			if keys[key] || s.hasIdempotencyKey(key[0], key[1], key[2]) {
+				return ErrDuplicateIdempotencyKey
+			}
+			keys[key] = true
+		}
+	}
+	for _, a := range assignments {
+		c := byCode[a.Code]
+		c.customerID = a.CustomerID
+		c.leasedBy = ""
+		c.leasedUntil = time.Time{}
+		s.recordUsage(c, a.RequestID, a.IdempotencyKey)
+	}
+	return nil
+}
+
+func (s *MemoryStore) RenewLeases(ctx context.Context, owner string, d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.codes {
+		if c.leasedBy == owner && c.customerID == "" {
+			c.leasedUntil = time.Now().Add(d)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ReleaseLeases(ctx context.Context, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.codes {
+		if c.leasedBy == owner && c.customerID == "" {
+			c.leasedBy = ""
+			c.leasedUntil = time.Time{}
+		}
+	}
+	return nil
+}
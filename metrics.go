@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ango_http_requests_total",
+		Help: "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ango_http_request_duration_seconds",
+		Help:    "HTTP request latency by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	grpcRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ango_grpc_requests_total",
+		Help: "Number of gRPC calls by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ango_grpc_request_duration_seconds",
+		Help:    "gRPC call latency by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	redemptionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ango_redemptions_total",
+		Help: "Number of redemption attempts by outcome.",
+	}, []string{"outcome"})
+
+	ruleCheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ango_rule_check_duration_seconds",
+		Help:    "Time taken to evaluate each batch rule.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"rule"})
+
+	batchCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ango_batch_cache_requests_total",
+		Help: "Batch cache lookups by result (hit or miss).",
+	}, []string{"result"})
+
+	batchCacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ango_batch_cache_evictions_total",
+		Help: "Batch cache entries removed by reason (expired, capacity or invalidated).",
+	}, []string{"reason"})
+
+	batchCacheEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ango_batch_cache_entries",
+		Help: "Batches currently held in the batch cache.",
+	})
+
+	replicaLagSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ango_db_replica_lag_seconds",
+		Help: "Replication lag of the read replica when it was last checked.",
+	})
+
+	replicaHealthy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ango_db_replica_healthy",
+		Help: "Whether reads are being served from the replica (1) or the primary (0).",
+	})
+
+	databaseReadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ango_db_reads_total",
+		Help: "Read-only queries by the database that served them (primary or replica).",
+	}, []string{"target"})
+
+	redemptionsAnonymisedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ango_redemptions_anonymised_total",
+		Help: "Redemptions whose customer ID was erased, by reason (erasure or retention).",
+	}, []string{"reason"})
+
+	batchCodesRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ango_batch_codes_remaining",
+		Help: "Unclaimed codes in each active batch.",
+	}, []string{"batch_id", "batch_name"})
+
+	inventoryRefreshPeriod = 1 * time.Minute // How often batchCodesRemaining is recalculated
+)
+
+// redemptionOutcome maps the result of getCode to the outcome label.
+func redemptionOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, ErrNoCodeFound):
+		return "no_code"
+	case errors.Is(err, ErrConditionNotMet):
+		return "rule_failed"
+	case errors.Is(err, ErrBatchExpired):
+		return "expired"
+	case errors.Is(err, ErrNoBatchFound):
+		return "batch_not_found"
+	case errors.Is(err, ErrNoClientFound):
+		return "client_not_found"
+	default:
+		return "error"
+	}
+}
+
+// metricsMiddleware records the count and latency of every request. Routes are
+// labelled by their pattern so that path parameters do not create new series.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequestsTotal.WithLabelValues(route, c.Request.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// poolCollector exposes pgxpool statistics as gauges, read at scrape time.
+type poolCollector struct {
+	pool     *pgxpool.Pool
+	total    *prometheus.Desc
+	idle     *prometheus.Desc
+	acquired *prometheus.Desc
+	max      *prometheus.Desc
+	acquires *prometheus.Desc
+	waits    *prometheus.Desc
+}
+
+func newPoolCollector(pool *pgxpool.Pool) *poolCollector {
+	return &poolCollector{
+		pool:     pool,
+		total:    prometheus.NewDesc("ango_db_pool_total_connections", "Total connections in the pool.", nil, nil),
+		idle:     prometheus.NewDesc("ango_db_pool_idle_connections", "Idle connections in the pool.", nil, nil),
+		acquired: prometheus.NewDesc("ango_db_pool_acquired_connections", "Connections currently in use.", nil, nil),
+		max:      prometheus.NewDesc("ango_db_pool_max_connections", "Maximum size of the pool.", nil, nil),
+		acquires: prometheus.NewDesc("ango_db_pool_acquires_total", "Successful connection acquires.", nil, nil),
+		waits:    prometheus.NewDesc("ango_db_pool_empty_acquires_total", "Acquires that had to wait for a connection.", nil, nil),
+	}
+}
+
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.total
+	ch <- p.idle
+	ch <- p.acquired
+	ch <- p.max
+	ch <- p.acquires
+	ch <- p.waits
+}
+
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := p.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(p.total, prometheus.GaugeValue, float64(stats.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(stats.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(p.acquired, prometheus.GaugeValue, float64(stats.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(p.max, prometheus.GaugeValue, float64(stats.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(p.acquires, prometheus.CounterValue, float64(stats.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(p.waits, prometheus.CounterValue, float64(stats.EmptyAcquireCount()))
+}
+
+// refreshInventoryMetrics periodically recalculates the remaining codes per
+// batch. Counting is done in the background rather than on scrape because it
+// scans the codes table.
+func refreshInventoryMetrics(ctx context.Context, pool *pgxpool.Pool) {
+	ticker := time.NewTicker(inventoryRefreshPeriod)
+	defer ticker.Stop()
+
+	for {
+		refreshCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		if err := updateInventoryMetrics(refreshCtx, pool); err != nil && ctx.Err() == nil {
+			slog.Error("Error refreshing inventory metrics", "error", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func updateInventoryMetrics(ctx context.Context, pool *pgxpool.Pool) error {
+	rows, err := pool.Query(ctx, `
+		SELECT b.id, b.name, COUNT(c.id)
+		FROM batches b
+		LEFT JOIN codes c ON c.batch_id = b.id AND c.customer_id IS NULL
+		WHERE b.expired = false
+		GROUP BY b.id, b.name
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type inventory struct {
+		id, name  string
+		remaining int
+	}
+	var batches []inventory
+	for rows.Next() {
+		var b inventory
+		if err := rows.Scan(&b.id, &b.name, &b.remaining); err != nil {
+			return err
+		}
+		batches = append(batches, b)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Reset so that batches which expired since the last refresh are dropped
+	batchCodesRemaining.Reset()
+	for _, b := range batches {
+		batchCodesRemaining.WithLabelValues(b.id, b.name).Set(float64(b.remaining))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedemptionOutcome(t *testing.T) {
+	assert.Equal(t, "success", redemptionOutcome(nil))
+	assert.Equal(t, "no_code", redemptionOutcome(ErrNoCodeFound))
+	assert.Equal(t, "rule_failed", redemptionOutcome(ErrConditionNotMet))
+	assert.Equal(t, "expired", redemptionOutcome(ErrBatchExpired))
+	assert.Equal(t, "batch_not_found", redemptionOutcome(ErrNoBatchFound))
+	assert.Equal(t, "error", redemptionOutcome(errors.New("connection reset")))
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	router := gin.New()
+	router.Use(metricsMiddleware())
+	router.GET("/api/v1/clients/:id", func(c *gin.Context) {
+		c.JSON(404, gin.H{"error": "no client found"})
+	})
+
+	before := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/api/v1/clients/:id", "GET", "404"))
+	for _, id := range []string{"a", "b"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/clients/"+id, nil))
+	}
+	after := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/api/v1/clients/:id", "GET", "404"))
+
+	assert.Equal(t, 2.0, after-before, "Expected both requests to be recorded under the route pattern")
+}
+
+func TestRuleCheckDuration(t *testing.T) {
+	ruleCheckDuration.Reset()
+	evaluateRules(context.Background(), NewMemoryStore(), Rules{MaxPerCustomer: 1}, "customer")
+
+	// Rules are labelled with the name they have in the batch rules
+	assert.Equal(t, 1, testutil.CollectAndCount(ruleCheckDuration))
+	assert.True(t, ruleCheckDuration.DeleteLabelValues("maxpercustomer"))
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//go:embed db/migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// migrationLockID is the pg_advisory_lock key held while migrating, so that
+// several instances starting with auto_migrate do not run migrations twice.
+const migrationLockID = 7264031
+
+var ErrDirtySchema = errors.New("the schema is dirty, a previous migration failed part way through")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads the embedded migrations, sorted by version.
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "db/migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		contents, err := fs.ReadFile(migrationFiles, path.Join("db/migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, found := byVersion[version]
+		if !found {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if match[3] == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing its up or down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// latestMigrationVersion is the schema version this build expects.
+func latestMigrationVersion() int {
+	migrations, err := loadMigrations()
+	if err != nil || len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// The schema_migrations table uses the same layout as golang-migrate, so
+// databases that were migrated with the migrate CLI carry on from where they are.
+func ensureMigrationsTable(ctx context.Context, pool *pgxpool.Pool) error {
+	_, err := pool.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)")
+	return err
+}
+
+// schemaVersion returns the applied version, or 0 if no migrations have run.
+func schemaVersion(ctx context.Context, pool *pgxpool.Pool) (int, bool, error) {
+	var version int
+	var dirty bool
+	err := pool.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err == pgx.ErrNoRows {
+		return 0, false, nil
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42P01" { // undefined_table
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+func setSchemaVersion(ctx context.Context, pool *pgxpool.Pool, version int, dirty bool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+	if version > 0 {
+		if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", version, dirty); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// runMigration marks the schema dirty at version, runs sql and marks it clean.
+// Migrations are not wrapped in a transaction so they may use statements such
+// as CREATE INDEX CONCURRENTLY; if one fails the schema is left dirty.
+func runMigration(ctx context.Context, pool *pgxpool.Pool, sql string, dirtyVersion, cleanVersion int) error {
+	if err := setSchemaVersion(ctx, pool, dirtyVersion, true); err != nil {
+		return err
+	}
+	if _, err := pool.Exec(ctx, sql); err != nil {
+		return err
+	}
+	return setSchemaVersion(ctx, pool, cleanVersion, false)
+}
+
+// withMigrationLock runs fn while holding the migration advisory lock.
+func withMigrationLock(ctx context.Context, pool *pgxpool.Pool, fn func() error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	if err := ensureMigrationsTable(ctx, pool); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// migrateUp applies every migration newer than the current version.
+func migrateUp(ctx context.Context, pool *pgxpool.Pool) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return withMigrationLock(ctx, pool, func() error {
+		return applyUp(ctx, pool, migrations)
+	})
+}
+
+func applyUp(ctx context.Context, pool *pgxpool.Pool, migrations []Migration) error {
+	current, dirty, err := schemaVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w (version %d)", ErrDirtySchema, current)
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+		if err := runMigration(ctx, pool, m.Up, m.Version, m.Version); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// migrateDown rolls back the given number of migrations.
+func migrateDown(ctx context.Context, pool *pgxpool.Pool, steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	return withMigrationLock(ctx, pool, func() error {
+		return applyDown(ctx, pool, migrations, steps)
+	})
+}
+
+func applyDown(ctx context.Context, pool *pgxpool.Pool, migrations []Migration, steps int) error {
+	current, dirty, err := schemaVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w (version %d)", ErrDirtySchema, current)
+	}
+
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if m.Version > current {
+			continue
+		}
+		previous := 0
+		if i > 0 {
+			previous = migrations[i-1].Version
+		}
+		slog.Info("Reverting migration", "version", m.Version, "name", m.Name)
+		if err := runMigration(ctx, pool, m.Down, m.Version, previous); err != nil {
+			return fmt.Errorf("reverting migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		current = previous
+		steps--
+	}
+	return nil
+}
+
+func migrationStatus(ctx context.Context, pool *pgxpool.Pool, w io.Writer) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	current, dirty, err := schemaVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Current version: %d (dirty: %t)\n", current, dirty)
+	fmt.Fprintf(w, "Expected version: %d\n\n", latestMigrationVersion())
+	for _, m := range migrations {
+		state := "pending"
+		if m.Version < current || (m.Version == current && !dirty) {
+			state = "applied"
+		} else if m.Version == current {
+			state = "dirty"
+		}
+		fmt.Fprintf(w, "%06d  %-8s  %s\n", m.Version, state, m.Name)
+	}
+	return nil
+}
+
+// checkSchema is run on startup and fails unless the database is at exactly
+// the version this build expects.
+func checkSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	version, dirty, err := schemaVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w (version %d)", ErrDirtySchema, version)
+	}
+	if expected := latestMigrationVersion(); version != expected {
+		return fmt.Errorf("schema is at version %d, expected %d", version, expected)
+	}
+	return nil
+}
+
+// runMigrateCommand implements "ango migrate up|down [N]|status".
+func runMigrateCommand(ctx context.Context, pool *pgxpool.Pool, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ango migrate up|down [N]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		if err := migrateUp(ctx, pool); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		if err := migrateDown(ctx, pool, steps); err != nil {
+			return err
+		}
+	case "status":
+		return migrationStatus(ctx, pool, w)
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+	return migrationStatus(ctx, pool, w)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	// Versions are sequential and every migration can be reverted
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Up, "migration %d has no up file", m.Version)
+		assert.NotEmpty(t, m.Down, "migration %d has no down file", m.Version)
+	}
+	assert.Equal(t, migrations[len(migrations)-1].Version, latestMigrationVersion())
+	assert.Equal(t, latestMigrationVersion(), expectedSchemaVersion)
+}
+
+func TestRunMigrateCommand_InvalidArgs(t *testing.T) {
+	assert.Error(t, runMigrateCommand(context.Background(), nil, nil, nil))
+	assert.Error(t, runMigrateCommand(context.Background(), nil, []string{"sideways"}, nil))
+	assert.Error(t, runMigrateCommand(context.Background(), nil, []string{"down", "zero"}, nil))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+func init() {
+	// Accept the same IDs as the handlers, which check them with uuid.Parse
+	openapi3.DefineStringFormatCallback("uuid", func(value string) error {
+		_, err := uuid.Parse(value)
+		return err
+	})
+}
+
+// loadOpenAPISpec parses and validates the OpenAPI document embedded from
+// openapi.yaml.
+func loadOpenAPISpec() (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(openAPISpec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse openapi.yaml: %w", err)
+	}
+	if err := doc.Validate(loader.Context); err != nil {
+		return nil, fmt.Errorf("invalid openapi.yaml: %w", err)
+	}
+	return doc, nil
+}
+
+func openAPIHandler(doc *openapi3.T) gin.HandlerFunc {
+	body, err := json.Marshal(doc)
+	return func(c *gin.Context) {
+		if err != nil {
+			respondWithError(c, err)
+			return
+		}
+		c.Data(200, "application/json; charset=utf-8", body)
+	}
+}
+
+// openAPIOptions keeps schema errors short enough to use as a problem's
+// detail. Authentication is left to requireScope, and defaults are not
+// written into requests so that handlers see what the caller sent.
+func openAPIOptions() *openapi3filter.Options {
+	options := &openapi3filter.Options{
+		AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+		IncludeResponseStatus: true,
+		SkipSettingDefaults:   true,
+	}
+	options.WithCustomSchemaErrorFunc(func(err *openapi3.SchemaError) string {
+		if path := err.JSONPointer(); len(path) > 0 {
+			return fmt.Sprintf("%s: %s", strings.Join(path, "."), err.Reason)
+		}
+		return err.Reason
+	})
+	return options
+}
+
+// openAPIInput returns the validation input for the operation matching the
+// request's gin route, or nil if the document doesn't describe the route.
+func openAPIInput(doc *openapi3.T, c *gin.Context, options *openapi3filter.Options) *openapi3filter.RequestValidationInput {
+	path := openAPIPath(c.FullPath())
+	pathItem := doc.Paths.Value(path)
+	if pathItem == nil {
+		return nil
+	}
+	operation := pathItem.GetOperation(c.Request.Method)
+	if operation == nil {
+		return nil
+	}
+
+	params := make(map[string]string, len(c.Params))
+	for _, param := range c.Params {
+		params[param.Key] = param.Value
+	}
+	return &openapi3filter.RequestValidationInput{
+		Request:    c.Request,
+		PathParams: params,
+		Route: &routers.Route{
+			Spec:      doc,
+			Path:      path,
+			PathItem:  pathItem,
+			Method:    c.Request.Method,
+			Operation: operation,
+		},
+		Options: options,
+	}
+}
+
+// openAPIPath converts a gin route such as /api/v1/clients/:id to its
+// OpenAPI path template, /api/v1/clients/{id}.
+func openAPIPath(route string) string {
+	segments := strings.Split(route, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// validateRequest rejects requests that don't match the OpenAPI document with
+// an invalid_request problem. Multipart bodies are left to the handler, which
+// streams the uploaded file rather than reading it into memory.
+func validateRequest(doc *openapi3.T) gin.HandlerFunc {
+	options := openAPIOptions()
+	multipartOptions := *options
+	multipartOptions.ExcludeRequestBody = true
+
+	return func(c *gin.Context) {
+		input := openAPIInput(doc, c, options)
+		if input == nil {
+			c.Next()
+			return
+		}
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			input.Options = &multipartOptions
+		}
+
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			respondWithProblem(c, 400, ProblemInvalidRequest, err.Error())
+			return
+		}
+		c.Next()
+	}
+}
+
+// validateResponses checks each response against the OpenAPI document and
+// passes any mismatch to report. It never changes the response, which has
+// already been written by the time it is checked.
+func validateResponses(doc *openapi3.T, report func(c *gin.Context, err error)) gin.HandlerFunc {
+	options := openAPIOptions()
+
+	return func(c *gin.Context) {
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		input := openAPIInput(doc, c, options)
+		if input == nil {
+			return
+		}
+		response := &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 writer.Status(),
+			Header:                 writer.Header(),
+			Options:                options,
+		}
+		response.SetBodyBytes(writer.body.Bytes())
+		if err := openapi3filter.ValidateResponse(c.Request.Context(), response); err != nil {
+			report(c, err)
+		}
+	}
+}
+
+// logResponseMismatch is the report function for validateResponses when
+// openapi.validate_responses is set.
+func logResponseMismatch(c *gin.Context, err error) {
+	loggerFromContext(c.Request.Context()).Warn("Response does not match the OpenAPI document",
+		"method", c.Request.Method, "route", c.FullPath(), "status", c.Writer.Status(), "error", err)
+}
+
+// recordingWriter keeps a copy of the response body as it is written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
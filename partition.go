@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const defaultPartitions = 16
+
+// partitionedTable is a table that "ango partition apply" rebuilds as a hash
+// partitioned table. Both tables are partitioned by batch, so that a
+// redemption, which always filters by batch, only touches one partition.
+type partitionedTable struct {
+	name string
+	// constraints recreates the keys and indexes on the new table. Primary and
+	// unique keys must include batch_id, the partition key. Keep these in step
+	// with the migrations, as anything not listed here is lost.
+	constraints []string
+}
+
+var partitionedTables = []partitionedTable{
+	{
+		name: "codes",
+		constraints: []string{
+			"ALTER TABLE codes ADD CONSTRAINT codes_pkey PRIMARY KEY (batch_id, id)",
+			"ALTER TABLE codes ADD CONSTRAINT codes_batch_id_code_key UNIQUE (batch_id, code)",
+			"ALTER TABLE codes ADD CONSTRAINT fk_codes_client FOREIGN KEY (client_id) REFERENCES clients (id)",
+			"CREATE INDEX idx_codes_unclaimed ON codes (batch_id, client_id) WHERE customer_id IS NULL",
+			"CREATE INDEX idx_codes_leased_by ON codes (leased_by) WHERE leased_by IS NOT NULL",
+		},
+	},
+	{
+		name: "code_usage",
+		constraints: []string{
+			"ALTER TABLE code_usage ADD CONSTRAINT code_usage_pkey PRIMARY KEY (batch_id, id)",
+			"ALTER TABLE code_usage ADD CONSTRAINT fk_code_usage_client FOREIGN KEY (client_id) REFERENCES clients (id)",
+			"CREATE INDEX idx_code_usage_code_batch_client_customer ON code_usage (code, batch_id, client_id, customer_id)",
+			"CREATE INDEX idx_code_usage_customer_used_at ON code_usage (customer_id, used_at)",
+			"CREATE INDEX idx_code_usage_batch_used_at ON code_usage (batch_id, used_at)",
+			"CREATE INDEX idx_code_usage_pending_anonymisation ON code_usage (used_at) WHERE anonymised_at IS NULL",
+			"CREATE UNIQUE INDEX idx_code_usage_idempotency_key ON code_usage (batch_id, customer_id, idempotency_key) WHERE idempotency_key IS NOT NULL",
+		},
+	},
+}
+
+// runPartitionCommand implements "ango partition".
+func runPartitionCommand(ctx context.Context, pool *pgxpool.Pool, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ango partition apply [N]|status")
+	}
+
+	switch args[0] {
+	case "apply":
+		partitions := defaultPartitions
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 2 {
+				return fmt.Errorf("invalid number of partitions %q, expected at least 2", args[1])
+			}
+			partitions = n
+		}
+		if err := partitionTables(ctx, pool, partitions, w); err != nil {
+			return err
+		}
+	case "status":
+	default:
+		return fmt.Errorf("unknown partition command %q, expected apply or status", args[0])
+	}
+	return partitionStatus(ctx, pool, w)
+}
+
+// partitionCounts returns the number of partitions of each partitioned table.
+func partitionCounts(ctx context.Context, pool *pgxpool.Pool) (map[string]int, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT c.relname, COUNT(i.inhrelid)
+		FROM pg_partitioned_table p
+		JOIN pg_class c ON c.oid = p.partrelid
+		LEFT JOIN pg_inherits i ON i.inhparent = c.oid
+		WHERE pg_table_is_visible(c.oid)
+		GROUP BY c.relname
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var name string
+		var n int
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		counts[name] = n
+	}
+	return counts, rows.Err()
+}
+
+func partitionStatus(ctx context.Context, pool *pgxpool.Pool, w io.Writer) error {
+	counts, err := partitionCounts(ctx, pool)
+	if err != nil {
+		return err
+	}
+	for _, table := range partitionedTables {
+		if n, found := counts[table.name]; found {
+			fmt.Fprintf(w, "%-12s partitioned by hash of batch_id into %d partitions\n", table.name, n)
+		} else {
+			fmt.Fprintf(w, "%-12s not partitioned\n", table.name)
+		}
+	}
+	return nil
+}
+
+// partitionTables rebuilds each table that is not yet partitioned. Each table
+// is copied in a single transaction that blocks reads and writes to it, so
+// this should be run during a maintenance window.
+func partitionTables(ctx context.Context, pool *pgxpool.Pool, partitions int, w io.Writer) error {
+	return withMigrationLock(ctx, pool, func() error {
+		counts, err := partitionCounts(ctx, pool)
+		if err != nil {
+			return err
+		}
+		for _, table := range partitionedTables {
+			if _, found := counts[table.name]; found {
+				continue
+			}
+			fmt.Fprintf(w, "Partitioning %s into %d partitions\n", table.name, partitions)
+			if err := partitionTable(ctx, pool, table, partitions); err != nil {
+				return fmt.Errorf("partitioning %s: %w", table.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func partitionTable(ctx context.Context, pool *pgxpool.Pool, table partitionedTable, partitions int) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	name := table.name
+	if _, err := tx.Exec(ctx, fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE", name)); err != nil {
+		return err
+	}
+	var rows int64
+	if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s", name)).Scan(&rows); err != nil {
+		return err
+	}
+
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE %[1]s_partitioned (LIKE %[1]s INCLUDING DEFAULTS) PARTITION BY HASH (batch_id)", name),
+	}
+	for i := 0; i < partitions; i++ {
+		stmts = append(stmts, fmt.Sprintf("CREATE TABLE %[1]s_p%[2]d PARTITION OF %[1]s_partitioned FOR VALUES WITH (MODULUS %[3]d, REMAINDER %[2]d)", name, i, partitions))
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	// Rows are copied before the indexes are built, which is much faster
+	tag, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %[1]s_partitioned SELECT * FROM %[1]s", name))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() != rows {
+		return fmt.Errorf("copied %d of %d rows", tag.RowsAffected(), rows)
+	}
+
+	stmts = []string{
+		// The id sequence would otherwise be dropped with the old table
+		fmt.Sprintf("ALTER SEQUENCE %[1]s_id_seq OWNED BY %[1]s_partitioned.id", name),
+		fmt.Sprintf("DROP TABLE %s", name),
+		fmt.Sprintf("ALTER TABLE %[1]s_partitioned RENAME TO %[1]s", name),
+	}
+	for _, stmt := range append(stmts, table.constraints...) {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
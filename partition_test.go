@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunPartitionCommand_InvalidArgs(t *testing.T) {
+	assert.Error(t, runPartitionCommand(context.Background(), nil, nil, nil))
+	assert.Error(t, runPartitionCommand(context.Background(), nil, []string{"sideways"}, nil))
+	assert.Error(t, runPartitionCommand(context.Background(), nil, []string{"apply", "1"}, nil))
+}
+
+func TestRunArchiveCommand_InvalidArgs(t *testing.T) {
+	assert.Error(t, runArchiveCommand(context.Background(), nil, []string{"--force"}, io.Discard))
+	assert.Error(t, runArchiveCommand(context.Background(), nil, []string{"everything"}, io.Discard))
+}
+
+func TestPartitionedTablesIncludeBatchID(t *testing.T) {
+	// Postgres rejects primary and unique keys that leave out the partition key
+	for _, table := range partitionedTables {
+		for _, stmt := range table.constraints {
+			if strings.Contains(stmt, "PRIMARY KEY") || strings.Contains(stmt, "UNIQUE") {
+				assert.Contains(t, stmt, "(batch_id, ", "%s: %s", table.name, stmt)
+			}
+		}
+	}
+}
+
+// TestPartitionedTablesMatchMigrations checks that every key and index the
+// migrations create on a partitioned table is recreated when it is rebuilt.
+func TestPartitionedTablesMatchMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("Unable to load migrations: %v", err)
+	}
+
+	var (
+		comment     = regexp.MustCompile(`--[^\n]*`)
+		createTable = regexp.MustCompile(`(?is)^CREATE TABLE (?:IF NOT EXISTS )?(\w+)\s*\((.*)\)$`)
+		alterTable  = regexp.MustCompile(`(?i)^ALTER TABLE (\w+)`)
+		constraint  = regexp.MustCompile(`(?i)ADD CONSTRAINT (\w+)`)
+		dropped     = regexp.MustCompile(`(?i)DROP (?:CONSTRAINT|INDEX) (?:IF EXISTS )?(\w+)`)
+		createIndex = regexp.MustCompile(`(?i)^CREATE (UNIQUE )?INDEX (?:IF NOT EXISTS )?(\w+)\s+ON (\w+)`)
+	)
+
+	// want maps each table to the text its constraints must contain
+	want := map[string]map[string]string{}
+	for _, table := range partitionedTables {
+		want[table.name] = map[string]string{}
+	}
+	for _, m := range migrations {
+		for _, stmt := range strings.Split(comment.ReplaceAllString(m.Up, ""), ";") {
+			stmt = strings.Join(strings.Fields(stmt), " ")
+			if match := createTable.FindStringSubmatch(stmt); match != nil && want[match[1]] != nil {
+				for _, column := range strings.Split(match[2], ",") {
+					name := strings.Fields(column)[0]
+					if strings.Contains(column, "PRIMARY KEY") {
+						want[match[1]][match[1]+"_pkey"] = "PRIMARY KEY"
+					}
+					if strings.Contains(column, "UNIQUE") {
+						// Unique keys gain the partition key
+						want[match[1]][match[1]+"."+name] = "UNIQUE (batch_id, " + name + ")"
+					}
+				}
+			}
+			if match := alterTable.FindStringSubmatch(stmt); match != nil && want[match[1]] != nil {
+				for _, c := range constraint.FindAllStringSubmatch(stmt, -1) {
+					want[match[1]][c[1]] = "ADD CONSTRAINT " + c[1] + " "
+				}
+			}
+			if match := createIndex.FindStringSubmatch(stmt); match != nil && want[match[3]] != nil {
+				want[match[3]][match[2]] = "CREATE " + match[1] + "INDEX " + match[2] + " "
+			}
+			for _, d := range dropped.FindAllStringSubmatch(stmt, -1) {
+				for _, constraints := range want {
+					delete(constraints, d[1])
+				}
+			}
+		}
+	}
+
+	for _, table := range partitionedTables {
+		all := strings.Join(table.constraints, "\n")
+		for name, text := range want[table.name] {
+			assert.Contains(t, all, text, "%s: %s is not recreated", table.name, name)
+		}
+	}
+	assert.NotEmpty(t, want["code_usage"]["idx_code_usage_idempotency_key"], "Expected the migrations to be parsed")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes are stable identifiers for each kind of error, so that callers
+// can handle errors without matching on the detail message.
+const (
+	ProblemInvalidRequest     = "invalid_request"
+	ProblemUnauthorized       = "unauthorized"
+	ProblemForbidden          = "forbidden"
+	ProblemNotFound           = "not_found"
+	ProblemBatchNotFound      = "batch_not_found"
+	ProblemBatchExpired       = "batch_expired"
+	ProblemClientNotFound     = "client_not_found"
+	ProblemClientInUse        = "client_in_use"
+	ProblemUnknownClient      = "unknown_client"
+	ProblemInventoryExhausted = "inventory_exhausted"
+	ProblemRuleFailed         = "rule_failed" // Reported as rule_failed:<rule>, e.g. rule_failed:maxpercustomer
+	ProblemRateLimited        = "rate_limited"
+	ProblemInternal           = "internal_error"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:ango:problem:"
+)
+
+// Problem is an RFC 7807 problem details response. Code is an extension
+// member holding the error code, which is also the last part of Type, and
+// Rules explains a rule_failed problem.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Rules     []RuleResult `json:"rules,omitempty"`
+}
+
+// respondWithProblem writes a problem response and aborts the request.
+func respondWithProblem(c *gin.Context, status int, code, detail string) {
+	writeProblem(c, newProblem(c, status, code, detail))
+}
+
+func newProblem(c *gin.Context, status int, code, detail string) Problem {
+	return Problem{
+		Type:      problemTypePrefix + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  c.Request.URL.Path,
+		Code:      code,
+		RequestID: requestIDFromContext(c.Request.Context()),
+	}
+}
+
+func writeProblem(c *gin.Context, problem Problem) {
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(problem.Status, problem)
+}
+
+// respondWithError writes the problem response for an error returned by the
+// service functions. Errors that aren't one of the service's errors are
+// reported as internal errors, without their message.
+func respondWithError(c *gin.Context, err error) {
+	status, code := problemForError(err)
+	problem := newProblem(c, status, code, errorDetail(err, code))
+	var ruleErr *RuleError
+	if errors.As(err, &ruleErr) {
+		problem.Rules = ruleErr.Results
+	}
+	writeProblem(c, problem)
+}
+
+// errorDetail describes err for the caller. Internal errors are not
+// described, as their messages may leak details of the database.
+func errorDetail(err error, code string) string {
+	var ruleErr *RuleError
+	switch {
+	case code == ProblemInternal:
+		return "Internal server error"
+	case errors.As(err, &ruleErr):
+		return ruleErr.Reason()
+	}
+	return err.Error()
+}
+
+// isServiceError reports whether err is one of the service's own errors, such
+// as ErrNoBatchFound, rather than a failure.
+func isServiceError(err error) bool {
+	_, code := problemForError(err)
+	return code != ProblemInternal
+}
+
+// problemForError returns the HTTP status and error code for err.
+func problemForError(err error) (int, string) {
+	var ruleErr *RuleError
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &ruleErr):
+		return 403, ProblemRuleFailed + ":" + ruleErr.Rule
+	case errors.Is(err, ErrConditionNotMet):
+		return 403, ProblemRuleFailed
+	case errors.As(err, &validationErr), errors.Is(err, ErrInvalidCursor):
+		return 400, ProblemInvalidRequest
+	case errors.Is(err, ErrNoBatchFound):
+		return 404, ProblemBatchNotFound
+	case errors.Is(err, ErrBatchExpired):
+		return 410, ProblemBatchExpired
+	case errors.Is(err, ErrNoCodeFound):
+		return 404, ProblemInventoryExhausted
+	case errors.Is(err, ErrNoClientFound):
+		return 404, ProblemClientNotFound
+	case errors.Is(err, ErrClientInUse):
+		return 409, ProblemClientInUse
+	case errors.Is(err, ErrUnknownClient):
+		return 400, ProblemUnknownClient
+	default:
+		return 500, ProblemInternal
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemForError(t *testing.T) {
+	for _, tt := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrNoBatchFound, 404, ProblemBatchNotFound},
+		{ErrBatchExpired, 410, ProblemBatchExpired},
+		{ErrNoCodeFound, 404, ProblemInventoryExhausted},
+		{&RuleError{Rule: "maxpercustomer"}, 403, "rule_failed:maxpercustomer"},
+		{ErrConditionNotMet, 403, ProblemRuleFailed},
+		{ErrNoClientFound, 404, ProblemClientNotFound},
+		{ErrClientInUse, 409, ProblemClientInUse},
+		{fmt.Errorf("%w: 1 unknown", ErrUnknownClient), 400, ProblemUnknownClient},
+		{&ValidationError{Detail: "invalid batch_id format"}, 400, ProblemInvalidRequest},
+		{errors.New("connection reset"), 500, ProblemInternal},
+	} {
+		status, code := problemForError(tt.err)
+		assert.Equal(t, tt.status, status, tt.err.Error())
+		assert.Equal(t, tt.code, code, tt.err.Error())
+	}
+}
+
+func TestRedeemProblems(t *testing.T) {
+	store := NewMemoryStore()
+	batchID, clientID := newTestBatch(t, store, Rules{MaxPerCustomer: 1}, 2)
+	customerID := uuid.New().String()
+
+	router := gin.New()
+	router.Use(requestID())
+	router.POST("/api/v1/code/redeem", getCodeHandler(store))
+
+	redeem := func(req Request) (*httptest.ResponseRecorder, Problem) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/code/redeem", bytes.NewReader(body)))
+		var problem Problem
+		json.Unmarshal(w.Body.Bytes(), &problem)
+		return w, problem
+	}
+
+	_, err := getCode(context.Background(), store, Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+	assert.NoError(t, err)
+
+	w, problem := redeem(Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	assert.Equal(t, Problem{
+		Type:      "urn:ango:problem:rule_failed:maxpercustomer",
+		Title:     "Forbidden",
+		Status:    403,
+		Detail:    "maxpercustomer: customer has 1/1 codes",
+		Instance:  "/api/v1/code/redeem",
+		Code:      "rule_failed:maxpercustomer",
+		RequestID: w.Header().Get(requestIDHeader),
+		Rules:     []RuleResult{{Rule: "maxpercustomer", Reason: "customer has 1/1 codes"}},
+	}, problem)
+
+	for i := 0; i < 2; i++ {
+		w, problem = redeem(Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+	}
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, ProblemInventoryExhausted, problem.Code)
+
+	w, problem = redeem(Request{BatchID: uuid.New().String(), ClientID: clientID, CustomerID: customerID})
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, ProblemBatchNotFound, problem.Code)
+
+	expiredID, _ := newTestBatch(t, store, Rules{}, 1)
+	batch := store.batches[expiredID]
+	batch.Expired = true
+	store.batches[expiredID] = batch
+	w, problem = redeem(Request{BatchID: expiredID, ClientID: clientID, CustomerID: customerID})
+	assert.Equal(t, 410, w.Code)
+	assert.Equal(t, ProblemBatchExpired, problem.Code)
+
+	w, problem = redeem(Request{BatchID: "nope", ClientID: clientID, CustomerID: customerID})
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, ProblemInvalidRequest, problem.Code)
+	assert.Equal(t, "invalid batch_id format", problem.Detail)
+}
+
+func TestUploadProblems(t *testing.T) {
+	store := NewMemoryStore()
+	_, clientID := newTestBatch(t, store, Rules{}, 0)
+
+	router := gin.New()
+	router.POST("/api/v1/codes/upload", uploadCodesHandler(store))
+
+	upload := func(rules, csv string) (int, Problem) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("batch_name", "Spring")
+		form.WriteField("rules", rules)
+		file, _ := form.CreateFormFile("file", "codes.csv")
+		file.Write([]byte(csv))
+		form.Close()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/v1/codes/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		router.ServeHTTP(w, req)
+		var problem Problem
+		json.Unmarshal(w.Body.Bytes(), &problem)
+		return w.Code, problem
+	}
+
+	for _, tt := range []struct {
+		name, rules, csv string
+		status           int
+		code             string
+	}{
+		{"Invalid rules", `{"maxpercustomer": "one"}`, "client_id,code,extra\n" + clientID + ",A,\n", 400, ProblemInvalidRequest},
+		{"Invalid row", "", "client_id,code\n" + clientID + ",\n", 400, ProblemInvalidRequest},
+		{"No codes", "", "client_id,code,extra\n", 400, ProblemInvalidRequest},
+		{"Too many codes", "", "client_id,code\n" + strings.Repeat(clientID+",A\n", maxUploadCodes+1), 400, ProblemInvalidRequest},
+		{"Unknown client", "", "client_id,code,extra\n" + uuid.New().String() + ",A,\n", 400, ProblemUnknownClient},
+	} {
+		status, problem := upload(tt.rules, tt.csv)
+		assert.Equal(t, tt.status, status, tt.name)
+		assert.Equal(t, tt.code, problem.Code, tt.name)
+	}
+}
+
+func TestEligibilityHandler(t *testing.T) {
+	store := NewMemoryStore()
+	batchID, clientID := newTestBatch(t, store, Rules{MaxPerCustomer: 1, TimeLimit: 30}, 2)
+	customerID := uuid.New().String()
+
+	router := gin.New()
+	router.POST("/api/v1/code/eligibility", checkEligibilityHandler(store))
+
+	check := func(req Request) (int, Eligibility) {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/code/eligibility", bytes.NewReader(body)))
+		var eligibility Eligibility
+		json.Unmarshal(w.Body.Bytes(), &eligibility)
+		return w.Code, eligibility
+	}
+
+	status, eligibility := check(Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+	assert.Equal(t, 200, status)
+	assert.True(t, eligibility.Eligible)
+
+	// Checking eligibility does not claim a code
+	inventory, err := getClientInventory(context.Background(), store, clientID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, inventory.Available)
+
+	_, err = getCode(context.Background(), store, Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+	assert.NoError(t, err)
+
+	status, eligibility = check(Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+	assert.Equal(t, 200, status)
+	assert.False(t, eligibility.Eligible)
+	if assert.Len(t, eligibility.Rules, 1) {
+		assert.Contains(t, eligibility.Rules[0].Reason, "customer has 1/1 codes in the last 30 days, next eligible at ")
+		assert.NotNil(t, eligibility.Rules[0].NextEligibleAt)
+	}
+
+	status, _ = check(Request{BatchID: uuid.New().String(), ClientID: clientID, CustomerID: customerID})
+	assert.Equal(t, 404, status)
+}
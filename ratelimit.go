@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var (
+	rateLimiter RateLimiter       // nil when rate limiting is disabled
+	rateLimits  RateLimitConfig   // Limits applied in front of the redeem endpoint
+	bucketTTL   = 1 * time.Hour   // Idle buckets older than this are removed
+	sweepPeriod = 1 * time.Minute // How often idle buckets are removed
+)
+
+// RateLimit is a token bucket that refills at Rate tokens per second up to Burst tokens.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitConfig holds the limits for each key type. A zero RateLimit disables that key.
+type RateLimitConfig struct {
+	PerAPIKey   RateLimit
+	PerClient   RateLimit
+	PerCustomer RateLimit
+}
+
+// RateLimitKey names a bucket and the limit it refills at.
+type RateLimitKey struct {
+	Key   string
+	Limit RateLimit
+}
+
+type RateLimiter interface {
+	// Allow takes a token from the bucket of every key, or from none of them
+	// if any is empty, so that a refused request does not use up the other
+	// limits. When refused it returns false along with how long until every
+	// bucket will have a token.
+	Allow(ctx context.Context, keys ...RateLimitKey) (bool, time.Duration, error)
+	// Sweep removes buckets that have not been used since before the given time.
+	Sweep(ctx context.Context, before time.Time) error
+}
+
+// loadRateLimitConfig parses the per key limits, which are written as
+// "<requests>/<s|m|h>", e.g. "100/m".
+func loadRateLimitConfig(settings RateLimitSettings) (RateLimitConfig, error) {
+	var cfg RateLimitConfig
+	var err error
+
+	if cfg.PerAPIKey, err = parseRateLimit(settings.PerAPIKey); err != nil {
+		return cfg, fmt.Errorf("invalid rate_limit.per_api_key: %v", err)
+	}
+	if cfg.PerClient, err = parseRateLimit(settings.PerClient); err != nil {
+		return cfg, fmt.Errorf("invalid rate_limit.per_client: %v", err)
+	}
+	if cfg.PerCustomer, err = parseRateLimit(settings.PerCustomer); err != nil {
+		return cfg, fmt.Errorf("invalid rate_limit.per_customer: %v", err)
+	}
+	return cfg, nil
+}
+
+func parseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+	count, unit, found := strings.Cut(s, "/")
+	if !found {
+		return RateLimit{}, fmt.Errorf("expected <requests>/<s|m|h>, got %q", s)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid request count %q", count)
+	}
+
+	var period time.Duration
+	switch strings.TrimSpace(unit) {
+	case "s":
+		period = time.Second
+	case "m":
+		period = time.Minute
+	case "h":
+		period = time.Hour
+	default:
+		return RateLimit{}, fmt.Errorf("invalid period %q", unit)
+	}
+
+	return RateLimit{Rate: float64(n) / period.Seconds(), Burst: n}, nil
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// bucket holds the token bucket state shared by both backends.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newBucket(now time.Time, limit RateLimit) bucket {
+	return bucket{tokens: float64(limit.Burst), updated: now}
+}
+
+// refill adds the tokens earned since the bucket was last updated.
+func (b *bucket) refill(now time.Time, limit RateLimit) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+		b.updated = now
+	}
+}
+
+// wait returns how long until the bucket has a token, or 0 if it has one.
+func (b *bucket) wait(limit RateLimit) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	wait := (1 - b.tokens) / limit.Rate
+	return time.Duration(wait * float64(time.Second))
+}
+
+// takeAll refills the buckets, one per key, and takes a token from each of
+// them if every one has a token.
+func takeAll(now time.Time, buckets []*bucket, keys []RateLimitKey) (bool, time.Duration) {
+	var retryAfter time.Duration
+	for i, b := range buckets {
+		b.refill(now, keys[i].Limit)
+		if wait := b.wait(keys[i].Limit); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// MemoryRateLimiter keeps buckets in process memory. It is only suitable when
+// running a single instance.
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (m *MemoryRateLimiter) Allow(ctx context.Context, keys ...RateLimitKey) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	buckets := make([]*bucket, len(keys))
+	for i, k := range keys {
+		b, found := m.buckets[k.Key]
+		if !found {
+			nb := newBucket(now, k.Limit)
+			b = &nb
+			m.buckets[k.Key] = b
+		}
+		buckets[i] = b
+	}
+	allowed, retryAfter := takeAll(now, buckets, keys)
+	return allowed, retryAfter, nil
+}
+
+func (m *MemoryRateLimiter) Sweep(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, b := range m.buckets {
+		if b.updated.Before(before) {
+			delete(m.buckets, key)
+		}
+	}
+	return nil
+}
+
+// PostgresRateLimiter stores buckets in the rate_limit_buckets table so that
+// limits are shared between replicas.
+type PostgresRateLimiter struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresRateLimiter(pool *pgxpool.Pool) *PostgresRateLimiter {
+	return &PostgresRateLimiter{pool: pool}
+}
+
+// Allow locks every bucket in one transaction, in key order so that
+// concurrent requests sharing buckets can't deadlock.
+func (p *PostgresRateLimiter) Allow(ctx context.Context, keys ...RateLimitKey) (bool, time.Duration, error) {
+	keys = append([]RateLimitKey(nil), keys...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+
+	tx, err := p.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	buckets := make([]*bucket, len(keys))
+	for i, k := range keys {
+		initial := newBucket(now, k.Limit)
+
+		// Insert a full bucket or lock the existing one, returning its state either way
+		var b bucket
+		err = tx.QueryRow(ctx, `
+			INSERT INTO rate_limit_buckets (key, tokens, updated_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (key) DO UPDATE SET key = EXCLUDED.key
+			RETURNING tokens, updated_at
+		`, k.Key, initial.tokens, initial.updated).Scan(&b.tokens, &b.updated)
+		if err != nil {
+			return false, 0, err
+		}
+		buckets[i] = &b
+	}
+
+	allowed, retryAfter := takeAll(now, buckets, keys)
+
+	for i, b := range buckets {
+		_, err = tx.Exec(ctx, "UPDATE rate_limit_buckets SET tokens = $2, updated_at = $3 WHERE key = $1", keys[i].Key, b.tokens, b.updated)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+func (p *PostgresRateLimiter) Sweep(ctx context.Context, before time.Time) error {
+	_, err := p.pool.Exec(ctx, "DELETE FROM rate_limit_buckets WHERE updated_at < $1", before)
+	return err
+}
+
+func sweepRateLimitBuckets(ctx context.Context, limiter RateLimiter) {
+	ticker := time.NewTicker(sweepPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sweepCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		if err := limiter.Sweep(sweepCtx, time.Now().Add(-bucketTTL)); err != nil {
+			slog.Error("Error sweeping rate limit buckets", "error", err)
+		}
+		cancel()
+	}
+}
+
+// maxRedeemBodyBytes caps how much of a redeem request is read before it has
+// been rate limited. A valid request is well under 1KB.
+const maxRedeemBodyBytes = 64 << 10
+
+// rateLimitRedeem limits redemptions by API key, client and customer. The
+// request body is read here and restored so the handler can bind it again.
+func rateLimitRedeem() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rateLimiter == nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxRedeemBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				respondWithProblem(c, 413, ProblemInvalidRequest, "request body is too large")
+				return
+			}
+			respondWithProblem(c, 400, ProblemInvalidRequest, "cannot read request body")
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Malformed bodies are rejected by the handler, so only the keys we can read are limited
+		var req Request
+		_ = json.Unmarshal(body, &req)
+
+		principal, authenticated := principalFromContext(c)
+		if retryAfter, limited := redeemRateLimited(c.Request.Context(), principal, authenticated, req); limited {
+			c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+			respondWithProblem(c, 429, ProblemRateLimited, "rate limit exceeded")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// redeemRateLimited takes a token from each of the rate limits that apply to
+// the redemption. If any of them is exhausted no token is taken, and it
+// returns how long the caller should wait before retrying.
+func redeemRateLimited(ctx context.Context, principal Principal, authenticated bool, req Request) (time.Duration, bool) {
+	if rateLimiter == nil {
+		return 0, false
+	}
+
+	var keys []RateLimitKey
+
+	if authenticated && principal.ClientID != "" {
+		req.ClientID = principal.ClientID
+	}
+	if authenticated && rateLimits.PerAPIKey.enabled() {
+		id := principal.APIKeyID
+		if id == "" {
+			id = "sub:" + principal.Subject
+		}
+		keys = append(keys, RateLimitKey{"apikey:" + id, rateLimits.PerAPIKey})
+	}
+	if req.ClientID != "" && rateLimits.PerClient.enabled() {
+		keys = append(keys, RateLimitKey{"client:" + strings.ToLower(req.ClientID), rateLimits.PerClient})
+	}
+	if req.CustomerID != "" && rateLimits.PerCustomer.enabled() {
+		keys = append(keys, RateLimitKey{"customer:" + storedCustomerID(req.CustomerID), rateLimits.PerCustomer})
+	}
+
+	if len(keys) == 0 {
+		return 0, false
+	}
+	allowed, retryAfter, err := rateLimiter.Allow(ctx, keys...)
+	if err != nil {
+		// Fail open so that a rate limiter outage does not stop redemptions
+		loggerFromContext(ctx).Error("Error checking rate limit", "error", err)
+		return 0, false
+	}
+	return retryAfter, !allowed
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds, and at least one.
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("120/m")
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, limit.Rate)
+	assert.Equal(t, 120, limit.Burst)
+
+	limit, err = parseRateLimit("")
+	assert.NoError(t, err)
+	assert.False(t, limit.enabled())
+
+	for _, invalid := range []string{"100", "abc/s", "0/s", "10/d"} {
+		_, err := parseRateLimit(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := RateLimit{Rate: 1, Burst: 2}
+	ctx := context.Background()
+
+	allowed, _, _ := limiter.Allow(ctx, RateLimitKey{"customer:a", limit})
+	assert.True(t, allowed)
+	allowed, _, _ = limiter.Allow(ctx, RateLimitKey{"customer:a", limit})
+	assert.True(t, allowed)
+
+	allowed, retryAfter, _ := limiter.Allow(ctx, RateLimitKey{"customer:a", limit})
+	assert.False(t, allowed, "Expected the bucket to be empty after the burst")
+	assert.Equal(t, time.Second, retryAfter)
+
+	// Other keys have their own bucket
+	allowed, _, _ = limiter.Allow(ctx, RateLimitKey{"customer:b", limit})
+	assert.True(t, allowed)
+
+	now = now.Add(time.Second)
+	allowed, _, _ = limiter.Allow(ctx, RateLimitKey{"customer:a", limit})
+	assert.True(t, allowed, "Expected a token to be refilled after a second")
+
+	assert.NoError(t, limiter.Sweep(ctx, now))
+	assert.Len(t, limiter.buckets, 1)
+
+	// A token is only taken if every bucket has one
+	allowed, retryAfter, _ = limiter.Allow(ctx, RateLimitKey{"apikey:k", limit}, RateLimitKey{"customer:a", limit})
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, retryAfter)
+	assert.Equal(t, 2.0, limiter.buckets["apikey:k"].tokens)
+}
+
+func TestRedeemRateLimited(t *testing.T) {
+	previousLimiter, previousLimits := rateLimiter, rateLimits
+	defer func() { rateLimiter, rateLimits = previousLimiter, previousLimits }()
+	rateLimiter = NewMemoryRateLimiter()
+	rateLimits = RateLimitConfig{
+		PerAPIKey:   RateLimit{Rate: 1.0 / 60, Burst: 2},
+		PerCustomer: RateLimit{Rate: 1.0 / 60, Burst: 1},
+	}
+	ctx := context.Background()
+	principal := Principal{APIKeyID: "key-1"}
+
+	_, limited := redeemRateLimited(ctx, principal, true, Request{CustomerID: "a"})
+	assert.False(t, limited)
+	_, limited = redeemRateLimited(ctx, principal, true, Request{CustomerID: "a"})
+	assert.True(t, limited, "Expected the customer's bucket to be empty")
+
+	// The refused redemption didn't take the API key's second token
+	_, limited = redeemRateLimited(ctx, principal, true, Request{CustomerID: "b"})
+	assert.False(t, limited)
+	_, limited = redeemRateLimited(ctx, principal, true, Request{CustomerID: "c"})
+	assert.True(t, limited, "Expected the API key's bucket to be empty")
+}
+
+func TestRateLimitRedeem(t *testing.T) {
+	previousLimiter, previousLimits := rateLimiter, rateLimits
+	defer func() { rateLimiter, rateLimits = previousLimiter, previousLimits }()
+	rateLimiter = NewMemoryRateLimiter()
+	rateLimits = RateLimitConfig{PerCustomer: RateLimit{Rate: 1.0 / 60, Burst: 1}}
+
+	router := gin.New()
+	router.POST("/api/v1/code/redeem", rateLimitRedeem(), func(c *gin.Context) {
+		var req Request
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "cannot parse json"})
+			return
+		}
+		c.JSON(200, Code{Code: req.CustomerID})
+	})
+
+	body := `{"batchid": "11111111-1111-1111-1111-111111111111", "clientid": "217be7c8-679c-4e08-bffc-db3451bdcdbf", "customerid": "fba9230a-a521-430e-aaf8-8aefbf588071"}`
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/code/redeem", strings.NewReader(body)))
+	assert.Equal(t, 200, w.Code, "Expected the body to still be readable by the handler")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/code/redeem", strings.NewReader(body)))
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/code/redeem", strings.NewReader(strings.Repeat(" ", maxRedeemBodyBytes+1))))
+	assert.Equal(t, 413, w.Code)
+
+	// Client IDs are case-insensitive, so changing the case doesn't get a new bucket
+	rateLimits = RateLimitConfig{PerClient: RateLimit{Rate: 1.0 / 60, Burst: 1}}
+	assert.Equal(t, 200, postRedeem(router, `{"clientid": "217be7c8-679c-4e08-bffc-db3451bdcdbf", "customerid": "a"}`))
+	assert.Equal(t, 429, postRedeem(router, `{"clientid": "217BE7C8-679C-4E08-BFFC-DB3451BDCDBF", "customerid": "b"}`))
+}
+
+func postRedeem(router http.Handler, body string) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/code/redeem", strings.NewReader(body)))
+	return w.Code
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRedemptionsLimit = 50
+	maxRedemptionsLimit     = 500
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Redemption is an entry in the usage ledger.
+type Redemption struct {
+	ID         int64     `json:"-"`
+	Code       string    `json:"code"`
+	BatchID    string    `json:"batch_id"`
+	BatchName  string    `json:"batch_name"`
+	ClientID   string    `json:"client_id"`
+	CustomerID string    `json:"customer_id"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+	RequestID  string    `json:"request_id,omitempty"` // The X-Request-ID of the redeem request
+}
+
+type RedemptionFilter struct {
+	CustomerID     string
+	BatchID        string
+	ClientID       string
+	IdempotencyKey string
+	From           time.Time // Inclusive, ignored if zero
+	To             time.Time // Exclusive, ignored if zero
+	Cursor         *RedemptionCursor
+	Limit          int
+}
+
+// RedemptionCursor is the position of the last redemption on a page. The
+// next page starts with the redemption after it.
+type RedemptionCursor struct {
+	UsedAt time.Time
+	ID     int64
+}
+
+func (c RedemptionCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.UsedAt.UnixNano(), c.ID)))
+}
+
+func parseRedemptionCursor(s string) (*RedemptionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	usedAt, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return nil, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(usedAt, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &RedemptionCursor{UsedAt: time.Unix(0, nanos).UTC()}
+	if cursor.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+type RedemptionPage struct {
+	Redemptions []Redemption `json:"redemptions"`
+	NextCursor  string       `json:"next_cursor,omitempty"` // Pass as cursor to get the next page, empty on the last page
+}
+
+func getCustomerRedemptionsHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		customerID := c.Param("id")
+		if !validCustomerID(customerID) {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "invalid customer_id format")
+			return
+		}
+		filter, ok := parseRedemptionFilter(c)
+		if !ok {
+			return
+		}
+		filter.CustomerID = storedCustomerID(customerID)
+
+		page, err := getRedemptions(c.Request.Context(), store, filter)
+		if err != nil {
+			loggerFromContext(c.Request.Context()).Error("Error getting redemptions", "error", err)
+			respondWithError(c, err)
+			return
+		}
+		// Show the ID the caller knows the customer by, rather than its hash
+		for i := range page.Redemptions {
+			page.Redemptions[i].CustomerID = customerID
+		}
+		c.JSON(200, page)
+	}
+}
+
+func getBatchRedemptionsHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := uuid.Parse(c.Param("id")); err != nil {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "invalid batch_id format")
+			return
+		}
+		// The batch is taken from the path, and checked to exist below
+		if c.Query("batch_id") != "" {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "batch_id can't be used with this route")
+			return
+		}
+		filter, ok := parseRedemptionFilter(c)
+		if !ok {
+			return
+		}
+		filter.BatchID = strings.ToLower(c.Param("id"))
+
+		if _, err := store.GetBatch(c.Request.Context(), filter.BatchID); err != nil {
+			if !errors.Is(err, ErrNoBatchFound) {
+				loggerFromContext(c.Request.Context()).Error("Error getting batch", "error", err)
+			}
+			respondWithError(c, err)
+			return
+		}
+		respondWithRedemptions(c, store, filter)
+	}
+}
+
+// parseRedemptionFilter reads the query parameters shared by the redemption
+// endpoints. It writes the error response and returns false if any are invalid.
+func parseRedemptionFilter(c *gin.Context) (RedemptionFilter, bool) {
+	filter := RedemptionFilter{Limit: defaultRedemptionsLimit}
+	fail := func(msg string) (RedemptionFilter, bool) {
+		respondWithProblem(c, 400, ProblemInvalidRequest, msg)
+		return RedemptionFilter{}, false
+	}
+
+	for param, dest := range map[string]*string{"client_id": &filter.ClientID, "batch_id": &filter.BatchID} {
+		if value := c.Query(param); value != "" {
+			if _, err := uuid.Parse(value); err != nil {
+				return fail(fmt.Sprintf("invalid %s format", param))
+			}
+			*dest = strings.ToLower(value)
+		}
+	}
+
+	// A credential tied to a client only sees that client's redemptions
+	if principal, ok := principalFromContext(c); ok && principal.ClientID != "" {
+		if filter.ClientID != "" && filter.ClientID != strings.ToLower(principal.ClientID) {
+			respondWithProblem(c, 403, ProblemForbidden, "client_id does not match credentials")
+			return RedemptionFilter{}, false
+		}
+		filter.ClientID = strings.ToLower(principal.ClientID)
+	}
+
+	for param, dest := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return fail(fmt.Sprintf("%s must be an RFC 3339 timestamp", param))
+			}
+			*dest = t
+		}
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxRedemptionsLimit {
+			return fail(fmt.Sprintf("limit must be between 1 and %d", maxRedemptionsLimit))
+		}
+		filter.Limit = limit
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		cursor, err := parseRedemptionCursor(value)
+		if err != nil {
+			return fail(err.Error())
+		}
+		filter.Cursor = cursor
+	}
+	return filter, true
+}
+
+func respondWithRedemptions(c *gin.Context, store Store, filter RedemptionFilter) {
+	page, err := getRedemptions(c.Request.Context(), store, filter)
+	if err != nil {
+		loggerFromContext(c.Request.Context()).Error("Error getting redemptions", "error", err)
+		respondWithError(c, err)
+		return
+	}
+	c.JSON(200, page)
+}
+
+// getRedemptions returns a page of redemptions. One more row than the limit
+// is read to find out whether there is another page.
+func getRedemptions(ctx context.Context, store Store, filter RedemptionFilter) (RedemptionPage, error) {
+	limit := filter.Limit
+	filter.Limit++
+	redemptions, err := store.GetRedemptions(ctx, filter)
+	if err != nil {
+		return RedemptionPage{}, err
+	}
+
+	page := RedemptionPage{Redemptions: redemptions}
+	if len(redemptions) > limit {
+		page.Redemptions = redemptions[:limit]
+		last := page.Redemptions[limit-1]
+		page.NextCursor = RedemptionCursor{UsedAt: last.RedeemedAt, ID: last.ID}.String()
+	}
+	return page, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// replicaLagQuery reports whether the replica is streaming WAL from the
+// primary, and how far behind it is. A replica that has replayed everything it
+// has received is not lagging, even if the last transaction it replayed is old
+// because the primary has been idle, but only while it is still receiving.
+// Reading pg_stat_wal_receiver's status needs the pg_read_all_stats role.
+const replicaLagQuery = `
+	SELECT pg_is_in_recovery(),
+		EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming'),
+		CASE
+			WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp()), 0)
+		END::float8
+`
+
+// ReplicaStore serves the read-only endpoints from a read replica and
+// everything else, including redemptions and the lookups they depend on, from
+// the primary. The replica is only used while it is reachable and its lag is
+// within database.max_replica_lag; otherwise reads go to the primary.
+type ReplicaStore struct {
+	Store   // The primary
+	replica Store
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+func NewReplicaStore(primary, replica Store, pool *pgxpool.Pool) *ReplicaStore {
+	return &ReplicaStore{Store: primary, replica: replica, pool: pool}
+}
+
+// connectToReplica opens the replica pool without waiting for a connection,
+// so that an unavailable replica does not stop the server from starting.
+func connectToReplica() (*pgxpool.Pool, error) {
+	config, err := newPoolConfig(appConfig.Database.ReadURL)
+	if err != nil {
+		return nil, err
+	}
+	config.LazyConnect = true
+	return pgxpool.ConnectConfig(context.Background(), config)
+}
+
+// Run checks the replica every database.replica_check_interval until ctx is
+// cancelled.
+func (s *ReplicaStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(appConfig.Database.ReplicaCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.checkReplica(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *ReplicaStore) checkReplica(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Health.CheckTimeout)
+	defer cancel()
+
+	var inRecovery, streaming bool
+	var lag float64
+	err := s.pool.QueryRow(ctx, replicaLagQuery).Scan(&inRecovery, &streaming, &lag)
+	if err == nil {
+		replicaLagSeconds.Set(lag)
+		err = replicaStateError(inRecovery, streaming, lag, appConfig.Database.MaxReplicaLag)
+	}
+
+	healthy := err == nil
+	if s.healthy.Swap(healthy) != healthy {
+		if healthy {
+			slog.Info("Serving reads from the replica", "lag_seconds", lag)
+		} else {
+			slog.Warn("Serving reads from the primary", "error", err, "lag_seconds", lag)
+		}
+	}
+	if healthy {
+		replicaHealthy.Set(1)
+	} else {
+		replicaHealthy.Set(0)
+	}
+}
+
+// replicaStateError returns why a replica in the given state can't serve
+// reads, or nil if it can. A replica that has stopped receiving WAL reports no
+// lag however stale it is, so it is never healthy. A database that is not in
+// recovery is not replicating at all and is always up to date.
+func replicaStateError(inRecovery, streaming bool, lag float64, maxLag time.Duration) error {
+	switch {
+	case inRecovery && !streaming:
+		return errors.New("replica is not receiving WAL from the primary")
+	case lag > maxLag.Seconds():
+		return errors.New("replica is too far behind the primary")
+	}
+	return nil
+}
+
+// readFrom runs query against the replica when it is healthy, falling back to
+// the primary when it is not or the query fails.
+func readFrom[T any](ctx context.Context, s *ReplicaStore, query func(store Store) (T, error)) (T, error) {
+	if s.healthy.Load() {
+		result, err := query(s.replica)
+		switch {
+		case errors.Is(err, ErrNoClientFound), errors.Is(err, ErrNoBatchFound):
+			// Not found may only mean the replica is behind, so the primary
+			// is asked as well, but it does not make the replica unhealthy
+		case err == nil || isServiceError(err):
+			databaseReadsTotal.WithLabelValues("replica").Inc()
+			return result, err
+		case ctx.Err() == nil:
+			slog.Warn("Read from the replica failed, using the primary", "error", err)
+			s.healthy.Store(false)
+			replicaHealthy.Set(0)
+		}
+	}
+	databaseReadsTotal.WithLabelValues("primary").Inc()
+	return query(s.Store)
+}
+
+func (s *ReplicaStore) GetBatches(ctx context.Context) ([]Batch, error) {
+	return readFrom(ctx, s, func(store Store) ([]Batch, error) { return store.GetBatches(ctx) })
+}
+
+func (s *ReplicaStore) GetClients(ctx context.Context) ([]Client, error) {
+	return readFrom(ctx, s, func(store Store) ([]Client, error) { return store.GetClients(ctx) })
+}
+
+func (s *ReplicaStore) GetClient(ctx context.Context, clientID string) (Client, error) {
+	return readFrom(ctx, s, func(store Store) (Client, error) { return store.GetClient(ctx, clientID) })
+}
+
+func (s *ReplicaStore) GetClientBatches(ctx context.Context, clientID string) ([]BatchInventory, error) {
+	return readFrom(ctx, s, func(store Store) ([]BatchInventory, error) { return store.GetClientBatches(ctx, clientID) })
+}
+
+func (s *ReplicaStore) GetClientInventory(ctx context.Context, clientID string) (ClientInventory, error) {
+	return readFrom(ctx, s, func(store Store) (ClientInventory, error) { return store.GetClientInventory(ctx, clientID) })
+}
+
+func (s *ReplicaStore) GetBatchInventory(ctx context.Context, batchID string) (BatchInventory, error) {
+	return readFrom(ctx, s, func(store Store) (BatchInventory, error) { return store.GetBatchInventory(ctx, batchID) })
+}
+
+func (s *ReplicaStore) GetRedemptions(ctx context.Context, filter RedemptionFilter) ([]Redemption, error) {
+	// A retried redemption must see the first attempt, which the replica may
+	// not have yet
+	if filter.IdempotencyKey != "" {
+		return s.Store.GetRedemptions(ctx, filter)
+	}
+	return readFrom(ctx, s, func(store Store) ([]Redemption, error) { return store.GetRedemptions(ctx, filter) })
+}
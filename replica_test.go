@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// unavailableStore fails every read, like a replica that has gone away.
+type unavailableStore struct {
+	Store
+}
+
+func (unavailableStore) GetBatches(ctx context.Context) ([]Batch, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestReplicaStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Reads go to the replica only while it is healthy", func(t *testing.T) {
+		primary, replica := NewMemoryStore(), NewMemoryStore()
+		_, err := primary.CreateBatch(ctx, "Primary", Rules{})
+		assert.NoError(t, err)
+		store := NewReplicaStore(primary, replica, nil)
+
+		batches, err := getBatches(ctx, store)
+		assert.NoError(t, err)
+		assert.Len(t, batches, 1)
+
+		store.healthy.Store(true)
+		batches, err = getBatches(ctx, store)
+		assert.NoError(t, err)
+		assert.Empty(t, batches)
+	})
+
+	t.Run("Redemptions always go to the primary", func(t *testing.T) {
+		primary := NewMemoryStore()
+		batchID, clientID := newTestBatch(t, primary, Rules{}, 1)
+		store := NewReplicaStore(primary, NewMemoryStore(), nil)
+		store.healthy.Store(true)
+
+		code, err := getCode(ctx, store, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, code)
+	})
+
+	t.Run("Clients missing from the replica are read from the primary", func(t *testing.T) {
+		primary := NewMemoryStore()
+		_, clientID := newTestBatch(t, primary, Rules{}, 1)
+		store := NewReplicaStore(primary, NewMemoryStore(), nil)
+		store.healthy.Store(true)
+
+		client, err := getClient(ctx, store, clientID)
+		assert.NoError(t, err)
+		assert.Equal(t, clientID, client.ID)
+		assert.True(t, store.healthy.Load())
+	})
+
+	t.Run("Batches missing from the replica don't make it unhealthy", func(t *testing.T) {
+		primary := NewMemoryStore()
+		batchID, _ := newTestBatch(t, primary, Rules{}, 1)
+		store := NewReplicaStore(primary, NewMemoryStore(), nil)
+		store.healthy.Store(true)
+
+		inventory, err := getBatchInventory(ctx, store, batchID)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, inventory.Total)
+		_, err = getBatchInventory(ctx, store, uuid.New().String())
+		assert.ErrorIs(t, err, ErrNoBatchFound)
+		assert.True(t, store.healthy.Load())
+	})
+
+	t.Run("A failed read falls back to the primary", func(t *testing.T) {
+		primary := NewMemoryStore()
+		_, err := primary.CreateBatch(ctx, "Primary", Rules{})
+		assert.NoError(t, err)
+		store := NewReplicaStore(primary, unavailableStore{NewMemoryStore()}, nil)
+		store.healthy.Store(true)
+
+		batches, err := getBatches(ctx, store)
+		assert.NoError(t, err)
+		assert.Len(t, batches, 1)
+		assert.False(t, store.healthy.Load())
+	})
+}
+
+func TestReplicaStateError(t *testing.T) {
+	assert.NoError(t, replicaStateError(true, true, 0, 10*time.Second))
+	assert.NoError(t, replicaStateError(false, false, 0, 10*time.Second), "Expected a database that isn't a replica to be up to date")
+	assert.ErrorContains(t, replicaStateError(true, true, 11, 10*time.Second), "too far behind")
+
+	// A disconnected replica has replayed all it received, so reports no lag
+	assert.ErrorContains(t, replicaStateError(true, false, 0, 10*time.Second), "not receiving WAL")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ErasureResult struct {
+	CustomerID  string `json:"customer_id"`
+	Redemptions int    `json:"redemptions"` // Redemptions whose customer ID was erased
+}
+
+// eraseCustomerHandler handles right to erasure requests. The customer's ID
+// is replaced wherever it is stored, so their codes and redemptions can no
+// longer be linked to them. Erasing a customer twice is not an error.
+func eraseCustomerHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		customerID := c.Param("id")
+		if !validCustomerID(customerID) {
+			respondWithProblem(c, 400, ProblemInvalidRequest, "invalid customer_id format")
+			return
+		}
+
+		erased, err := store.EraseCustomer(c.Request.Context(), storedCustomerID(customerID))
+		if err != nil {
+			loggerFromContext(c.Request.Context()).Error("Error erasing customer", "error", err)
+			respondWithError(c, err)
+			return
+		}
+		redemptionsAnonymisedTotal.WithLabelValues("erasure").Add(float64(erased))
+		loggerFromContext(c.Request.Context()).Info("Erased customer", "redemptions", erased)
+		c.JSON(200, ErasureResult{CustomerID: customerID, Redemptions: erased})
+	}
+}
+
+// anonymiseExpiredRedemptions erases the customer IDs of redemptions older
+// than retention.days every retention.interval.
+func anonymiseExpiredRedemptions(ctx context.Context, store Store, cfg RetentionConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		before := time.Now().AddDate(0, 0, -cfg.Days)
+		runCtx, cancel := context.WithTimeout(ctx, cfg.Interval)
+		anonymised, err := store.AnonymiseRedemptions(runCtx, before)
+		cancel()
+		redemptionsAnonymisedTotal.WithLabelValues("retention").Add(float64(anonymised))
+		if err != nil {
+			loggerFromContext(ctx).Error("Error anonymising expired redemptions", "error", err)
+		} else if anonymised > 0 {
+			loggerFromContext(ctx).Info("Anonymised expired redemptions", "redemptions", anonymised, "before", before)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var shuttingDown atomic.Bool // Set once a shutdown signal is received, health checks then report unhealthy
+
+// workerGroup runs background goroutines that stop when their context is
+// cancelled, so shutdown can wait for them to finish.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+func (w *workerGroup) Go(name string, fn func(ctx context.Context)) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		fn(w.ctx)
+		slog.Debug("Background worker stopped", "worker", name)
+	}()
+}
+
+// Stop cancels every worker and waits for them to return.
+func (w *workerGroup) Stop() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// serve runs the HTTP server until ctx is cancelled, then drains it: health
+// checks start failing straight away, new requests are still accepted for
+// the drain period so load balancers can notice, and finally in-flight
+// requests are given up to the shutdown timeout to complete.
+func serve(ctx context.Context, handler http.Handler, cfg ServerConfig) error {
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("Server listening", "addr", srv.Addr)
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	slog.Info("Shutdown signal received, draining", "drain_period", cfg.DrainPeriod.String())
+	time.Sleep(cfg.DrainPeriod)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("error shutting down server: %v", err)
+	}
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("Server stopped")
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	defer shuttingDown.Store(false)
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(200)
+	})
+
+	cfg := ServerConfig{Port: freePort(t), DrainPeriod: 10 * time.Millisecond, ShutdownTimeout: 5 * time.Second}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serve(ctx, handler, cfg) }()
+
+	// Wait for the server to start listening
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.Port))
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	assert.Equal(t, 200, <-status, "Expected the in-flight request to complete")
+	assert.NoError(t, <-served)
+	assert.True(t, shuttingDown.Load())
+}
+
+func TestWorkerGroupStop(t *testing.T) {
+	var stopped atomic.Int32
+	workers := newWorkerGroup()
+	for i := 0; i < 3; i++ {
+		workers.Go("test", func(ctx context.Context) {
+			<-ctx.Done()
+			stopped.Add(1)
+		})
+	}
+
+	workers.Stop()
+	assert.Equal(t, int32(3), stopped.Load())
+}
@@ -3,16 +3,15 @@ package main
 import (
 	"context"
 	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"sync"
+	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -20,10 +19,43 @@ var (
 	ErrConditionNotMet = errors.New("the request did not meet the rule conditions defined for the batch")
 	ErrNoBatchFound    = errors.New("no batch was found")
 	ErrBatchExpired   = errors.New("the batch is expired")
-	batchCache         = sync.Map{}       // Cache for storing batch rules
-	cacheExpiration    = 15 * time.Minute // Cache expiration time
+	batchCache         = newBatchRulesCache() // Cache for storing batch rules, see cache.go
 )
 
+// RuleError is returned when a redemption fails one of the batch's rules. It
+// matches ErrConditionNotMet with errors.Is.
+type RuleError struct {
+	Rule    string       // The failed rule's name, e.g. maxpercustomer
+	Results []RuleResult // The results of every rule the batch has
+}
+
+func (e *RuleError) Error() string {
+	return ErrConditionNotMet.Error()
+}
+
+// Reason explains why the rule failed.
+func (e *RuleError) Reason() string {
+	for _, result := range e.Results {
+		if result.Rule == e.Rule && !result.Passed && result.Reason != "" {
+			return result.Rule + ": " + result.Reason
+		}
+	}
+	return e.Error()
+}
+
+func (e *RuleError) Is(target error) bool {
+	return target == ErrConditionNotMet
+}
+
+// ValidationError reports a missing or malformed request parameter.
+type ValidationError struct {
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Detail
+}
+
 type Rules struct {
 	MaxPerCustomer int `json:"maxpercustomer"`
 	TimeLimit      int `json:"timelimit"`
@@ -35,262 +67,399 @@ type CachedRules struct {
 	CacheTime time.Time
 }
 
-func getCode(ctx context.Context, req Request) (string, error) {
-    // Validate UUIDs
-    if _, err := uuid.Parse(req.BatchID); err != nil {
-        return "", gin.Error{
-            Err:  errors.New("invalid batch_id format"),
-            Type: gin.ErrorTypePublic,
-        }
-    }
-    if _, err := uuid.Parse(req.ClientID); err != nil {
-        return "", gin.Error{
-            Err:  errors.New("invalid client_id format"),
-            Type: gin.ErrorTypePublic,
-        }
-    }
-    if _, err := uuid.Parse(req.CustomerID); err != nil {
-        return "", gin.Error{
-            Err:  errors.New("invalid customer_id format"),
-            Type: gin.ErrorTypePublic,
-        }
-    }
+func getCode(ctx context.Context, store Store, req Request) (string, error) {
+	ctx, span := startSpan(ctx, "getCode",
+		attribute.String("ango.batch_id", req.BatchID),
+		attribute.String("ango.client_id", req.ClientID),
+	)
+	code, err := claimCode(ctx, store, req)
+	outcome := redemptionOutcome(err)
+	span.SetAttributes(attribute.String("ango.outcome", outcome))
+	endSpan(span, err)
+
+	redemptionsTotal.WithLabelValues(outcome).Inc()
+	return code, err
+}
 
-    ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+func claimCode(ctx context.Context, store Store, req Request) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, appConfig.Redeem.Timeout)
     defer cancel()
 
-    // Check batch expiration from cache
-    rules, batchExpired, err := getRulesForBatch(ctx, req.BatchID)
+    logger := loggerFromContext(ctx).With("batch_id", req.BatchID, "client_id", req.ClientID, "customer_id", CustomerID(req.CustomerID))
+
+    rules, err := prepareRedemption(ctx, store, req)
     if err != nil {
-        if err == pgx.ErrNoRows {
-            return "", ErrNoBatchFound
-        }
         return "", err
     }
-    if batchExpired {
-        return "", ErrBatchExpired
-    }
 
-    // Begin transaction after initial check
-    tx, err := db.BeginTx(ctx, pgx.TxOptions{})
-    if err != nil {
-        return "", err
+    customerID := storedCustomerID(req.CustomerID)
+    if code, found, err := findIdempotentRedemption(ctx, store, req.BatchID, customerID); err != nil || found {
+        if found {
+            logger.Debug("Returning the code from an earlier redemption with the same idempotency key")
+        }
+        return code, err
     }
-    defer func() {
-        if tx != nil {
-            tx.Rollback(ctx) // Ensure rollback if not committed
+
+    // The rules are checked while the store holds the code, so that a failed
+    // check releases it for the next request
+    code, err := store.ClaimCode(ctx, req.BatchID, req.ClientID, customerID, func(ctx context.Context) error {
+        rulesCtx, span := startSpan(ctx, "getCode.checkRules")
+        err := checkRules(rulesCtx, store, rules, customerID)
+        span.SetAttributes(attribute.Bool("ango.rules_passed", err == nil))
+        span.End()
+        return err
+    })
+    if errors.Is(err, ErrDuplicateIdempotencyKey) || errors.Is(err, ErrConditionNotMet) {
+        // A concurrent retry with the same key may have claimed a code
+        // first, in which case this attempt fails the rules or the key's
+        // unique index
+        if code, found, lookupErr := findIdempotentRedemption(ctx, store, req.BatchID, customerID); lookupErr != nil || found {
+            if found {
+                logger.Debug("Returning the code from a concurrent redemption with the same idempotency key")
+            }
+            return code, lookupErr
         }
-    }()
-
-    selectCodeTime := time.Now()
-
-    // Attempt to acquire a code
-    var code string
-    err = tx.QueryRow(ctx, `
-        SELECT code
-        FROM codes
-        WHERE batch_id = $1 AND client_id = $2 AND customer_id IS NULL
-        FOR NO KEY UPDATE SKIP LOCKED
-        LIMIT 1
-    `, req.BatchID, req.ClientID).Scan(&code)
+    }
     if err != nil {
-        if err == pgx.ErrNoRows {
-            return "", ErrNoCodeFound
-        }
         return "", err
     }
 
-    if time.Since(selectCodeTime) > 100*time.Millisecond {
-        log.Printf("Queries for selecting code took too long (%v)ms", time.Since(selectCodeTime))
-    }
+    logger.Debug("Code redeemed")
+    return code, nil
+}
 
-    if !checkRules(rules, req.CustomerID) {
-        return "", ErrConditionNotMet
-    }
 
-    // Code usage updates
-    updateCodesTime := time.Now()
-    _, err = tx.Exec(ctx, "UPDATE codes SET customer_id=$1 WHERE code=$2", req.CustomerID, code)
-    if err != nil {
-        return "", err
-    }
-    if time.Since(updateCodesTime) > 100*time.Millisecond {
-        log.Printf("Query for updating codes took too long (%v)ms", time.Since(updateCodesTime))
-    }
+// prepareRedemption validates a redemption request and returns the batch's
+// rules. It fails if the batch has expired or the client does not exist.
+func prepareRedemption(ctx context.Context, store Store, req Request) (Rules, error) {
+	if _, err := uuid.Parse(req.BatchID); err != nil {
+		return Rules{}, &ValidationError{Detail: "invalid batch_id format"}
+	}
+	if _, err := uuid.Parse(req.ClientID); err != nil {
+		return Rules{}, &ValidationError{Detail: "invalid client_id format"}
+	}
+	if !validCustomerID(req.CustomerID) {
+		return Rules{}, &ValidationError{Detail: "invalid customer_id format"}
+	}
 
-		// Remove code usage because it's not needed, will queue for later.
-    // insertCodeUsageTime := time.Now()
-    // _, err = tx.Exec(ctx, "INSERT INTO code_usage (code, batch_id, client_id, customer_id, used_at) VALUES ($1, $2, $3, $4, $5)", code, req.BatchID, req.ClientID, req.CustomerID, time.Now())
-    // if err != nil {
-    //     return "", err
-    // }
-    // if time.Since(insertCodeUsageTime) > 100*time.Millisecond {
-    //     log.Printf("Query for inserting code usage took too long (%v)ms", time.Since(insertCodeUsageTime))
-    // }
-
-    if err = tx.Commit(ctx); err != nil {
-        return "", err
-    }
-    tx = nil // Avoid rollback
+	// Check batch expiration from cache
+	lookupCtx, span := startSpan(ctx, "getCode.batchLookup")
+	rules, batchExpired, err := getRulesForBatch(lookupCtx, store, req.BatchID)
+	endSpan(span, err)
+	if err != nil {
+		return Rules{}, err
+	}
+	if batchExpired {
+		return Rules{}, ErrBatchExpired
+	}
 
-    return code, nil
+	lookupCtx, span = startSpan(ctx, "getCode.clientLookup")
+	exists, err := clientExists(lookupCtx, store, req.ClientID)
+	endSpan(span, err)
+	if err != nil {
+		return Rules{}, err
+	}
+	if !exists {
+		return Rules{}, ErrNoClientFound
+	}
+	return rules, nil
+}
+
+// Eligibility is the outcome of checking a redemption without making it.
+type Eligibility struct {
+	Eligible bool         `json:"eligible"`
+	Rules    []RuleResult `json:"rules"`
 }
 
+// checkEligibility evaluates the batch's rules for a redemption request
+// without claiming a code. Eligible customers may still find that the
+// batch has no codes left.
+func checkEligibility(ctx context.Context, store Store, req Request) (Eligibility, error) {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Redeem.Timeout)
+	defer cancel()
 
-func getRulesForBatch(ctx context.Context, batchID string) (Rules, bool, error) {
-	// Check cache first
-	if cached, found := batchCache.Load(batchID); found {
-		cachedRules := cached.(CachedRules)
-		// Check if the cache is still valid
-		if time.Since(cachedRules.CacheTime) < cacheExpiration {
-			return cachedRules.Rules, cachedRules.Expired, nil
+	rules, err := prepareRedemption(ctx, store, req)
+	if err != nil {
+		return Eligibility{}, err
+	}
+
+	eligibility := Eligibility{Eligible: true, Rules: evaluateRules(ctx, store, rules, storedCustomerID(req.CustomerID))}
+	for _, result := range eligibility.Rules {
+		if !result.Passed {
+			eligibility.Eligible = false
 		}
-		// Cache expired, delete it
-		batchCache.Delete(batchID)
+	}
+	return eligibility, nil
+}
+
+func getRulesForBatch(ctx context.Context, store Store, batchID string) (Rules, bool, error) {
+	// Check cache first
+	if cached, found := batchCache.Get(batchID); found {
+		return cached.Rules, cached.Expired, nil
 	}
 
 	// If not in cache or cache expired, fetch from database
-	var rules Rules
-	var expired bool
-	err := db.QueryRow(ctx, "SELECT rules, expired FROM batches WHERE id=$1", batchID).Scan(&rules, &expired)
+	version := batchCache.Version()
+	batch, err := store.GetBatch(ctx, batchID)
 	if err != nil {
 		return Rules{}, false, err
 	}
 
 	// Store the fetched rules in cache
-	batchCache.Store(batchID, CachedRules{
-		Rules:     rules,
-		Expired:   expired,
+	batchCache.Set(batchID, CachedRules{
+		Rules:     batch.Rules,
+		Expired:   batch.Expired,
 		CacheTime: time.Now(),
-	})
+	}, version)
 
-	return rules, expired, nil
+	return batch.Rules, batch.Expired, nil
 }
 
-func getBatches(ctx context.Context) ([]Batch, error) {
-	rows, err := db.Query(ctx, "SELECT id, name, rules, expired FROM batches WHERE expired = false")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+func getBatches(ctx context.Context, store Store) ([]Batch, error) {
+	return store.GetBatches(ctx)
+}
 
-	var batches []Batch
-	for rows.Next() {
-		var batch Batch
-		err := rows.Scan(&batch.ID, &batch.Name, &batch.Rules, &batch.Expired)
-		if err != nil {
-			return nil, err
-		}
-		batches = append(batches, batch)
+func getBatch(ctx context.Context, store Store, batchID string) (Batch, error) {
+	if _, err := uuid.Parse(batchID); err != nil {
+		return Batch{}, &ValidationError{Detail: "invalid batch_id format"}
 	}
+	return store.GetBatch(ctx, batchID)
+}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+func getBatchInventory(ctx context.Context, store Store, batchID string) (BatchInventory, error) {
+	if _, err := uuid.Parse(batchID); err != nil {
+		return BatchInventory{}, &ValidationError{Detail: "invalid batch_id format"}
 	}
-	return batches, nil
+	return store.GetBatchInventory(ctx, batchID)
 }
 
-func createBatch(ctx context.Context, name string, rules string) (string, error) {
-	// Generate a new UUID for the batch
-	batchID := uuid.New().String()
+// BatchRequest is the body of a request to create a batch without codes.
+type BatchRequest struct {
+	Name  string `json:"name"`
+	Rules Rules  `json:"rules"`
+}
 
-	// Insert the new batch into the database
-	_, err := db.Exec(ctx, "INSERT INTO batches (id, name, rules) VALUES ($1, $2, $3)", batchID, name, rules)
+func newBatch(ctx context.Context, store Store, req BatchRequest) (Batch, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return Batch{}, &ValidationError{Detail: "Batch name is required"}
+	}
+	if req.Rules.MaxPerCustomer < 0 || req.Rules.TimeLimit < 0 {
+		return Batch{}, &ValidationError{Detail: "rules must not be negative"}
+	}
+	batchID, err := store.CreateBatch(ctx, req.Name, req.Rules)
 	if err != nil {
-		return "", err
+		return Batch{}, err
 	}
+	loggerFromContext(ctx).Info("Batch created", "batch_id", batchID)
+	return store.GetBatch(ctx, batchID)
+}
 
-	return batchID, nil
+// expireBatch stops codes being redeemed from the batch. Other instances
+// drop the batch from their caches when the database notifies them.
+func expireBatch(ctx context.Context, store Store, batchID string) (Batch, error) {
+	if _, err := uuid.Parse(batchID); err != nil {
+		return Batch{}, &ValidationError{Detail: "invalid batch_id format"}
+	}
+	if err := store.ExpireBatch(ctx, batchID); err != nil {
+		return Batch{}, err
+	}
+	batchCache.Delete(batchID)
+	loggerFromContext(ctx).Info("Batch expired", "batch_id", batchID)
+	return store.GetBatch(ctx, batchID)
 }
 
-func uploadCodes(ctx context.Context, file io.Reader, batchID string) error {
-	// Create a new CSV reader
-	reader := csv.NewReader(file)
+// parseRules reads the rules sent with an upload. Rules are optional, a batch
+// without them has no restrictions.
+func parseRules(rules string) (Rules, error) {
+	var parsed Rules
+	if rules != "" {
+		if err := json.Unmarshal([]byte(rules), &parsed); err != nil {
+			return Rules{}, &ValidationError{Detail: fmt.Sprintf("invalid rules: %v", err)}
+		}
+	}
+	return parsed, nil
+}
 
-	// Read all CSV records
-	records, err := reader.ReadAll()
-	if err != nil {
-		return fmt.Errorf("error reading CSV: %v", err)
+// maxUploadCodes caps the codes in one upload, which are held in memory and
+// inserted by a single statement. Postgres allows 65535 parameters in a
+// statement, three per code.
+const maxUploadCodes = 20000
+
+// errTooManyCodes is returned once an upload has more than maxUploadCodes.
+var errTooManyCodes = &ValidationError{Detail: fmt.Sprintf("an upload may contain at most %d codes", maxUploadCodes)}
+
+// readCodesCSV reads the codes from an uploaded CSV. The header must name
+// the code and client_id columns, which may be in any order; other columns
+// are ignored.
+func readCodesCSV(file io.Reader) ([]NewCode, error) {
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil && err != io.EOF {
+		return nil, &ValidationError{Detail: fmt.Sprintf("error reading CSV: %v", err)}
 	}
 
-	// Start a transaction
-	tx, err := db.Begin(ctx)
-	if err != nil {
-		return fmt.Errorf("error starting transaction: %v", err)
+	columns := make(map[string]int)
+	for i, name := range header {
+		if _, found := columns[name]; !found {
+			columns[name] = i
+		}
+	}
+	codeColumn, hasCode := columns["code"]
+	clientColumn, hasClient := columns["client_id"]
+	if !hasCode || !hasClient {
+		return nil, &ValidationError{Detail: "CSV must contain 'code' and 'client_id' columns"}
 	}
-	defer tx.Rollback(ctx)
 
-	// Prepare the bulk insert statement
-	stmt := "INSERT INTO codes (client_id, batch_id, code) VALUES "
-	var values []interface{}
-	for i, record := range records[1:] { // Skip header row
-		if len(record) != 3 {
-			return fmt.Errorf("invalid record format at row %d", i+2)
+	// The CSV reader checks that every row has as many fields as the header
+	var codes []NewCode
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return codes, nil
+		}
+		if err != nil {
+			return nil, &ValidationError{Detail: fmt.Sprintf("error reading CSV: %v", err)}
 		}
-		stmt += fmt.Sprintf("($%d, $%d, $%d),", i*3+1, i*3+2, i*3+3)
-		values = append(values, record[0], batchID, record[1])
+		if len(codes) == maxUploadCodes {
+			return nil, errTooManyCodes
+		}
+		if record[codeColumn] == "" || record[clientColumn] == "" {
+			return nil, &ValidationError{Detail: fmt.Sprintf("invalid record format at row %d", row)}
+		}
+		codes = append(codes, NewCode{ClientID: record[clientColumn], Code: record[codeColumn]})
 	}
-	stmt = stmt[:len(stmt)-1] // Remove the trailing comma
+}
 
-	// Execute the bulk insert
-	_, err = tx.Exec(ctx, stmt, values...)
-	if err != nil {
-		return fmt.Errorf("error executing bulk insert: %v", err)
+// uploadBatch creates a batch holding the uploaded codes. The HTTP API, the
+// gRPC API and the CLI all upload through it. The batch and its codes are
+// created in one transaction, so a failed upload never leaves a batch behind.
+func uploadBatch(ctx context.Context, store Store, name string, rules Rules, codes []NewCode) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", &ValidationError{Detail: "Batch name is required"}
+	}
+	if rules.MaxPerCustomer < 0 || rules.TimeLimit < 0 {
+		return "", &ValidationError{Detail: "rules must not be negative"}
+	}
+	if len(codes) == 0 {
+		return "", &ValidationError{Detail: "no codes were uploaded"}
+	}
+	if len(codes) > maxUploadCodes {
+		return "", errTooManyCodes
 	}
 
-	// Commit the transaction
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("error committing transaction: %v", err)
+	// Every code must belong to a known client
+	clientIDs := make([]string, len(codes))
+	for i, code := range codes {
+		clientIDs[i] = code.ClientID
+	}
+	if err := validateClients(ctx, store, clientIDs); err != nil {
+		return "", err
 	}
 
-	return nil
+	batchID, err := store.CreateBatchWithCodes(ctx, name, rules, codes)
+	if err != nil {
+		return "", err
+	}
+
+	loggerFromContext(ctx).Info("Codes uploaded", "batch_id", batchID, "count", len(codes))
+
+	return batchID, nil
 }
 
 type Rule interface {
-	Check(ctx context.Context, customerID string) bool
+	// Name is the rule's key in the batch rules, and is reported when it fails.
+	Name() string
+	Check(ctx context.Context, customerID string) RuleResult
+}
+
+// RuleResult explains the outcome of a rule for a customer.
+type RuleResult struct {
+	Rule           string     `json:"rule"`
+	Passed         bool       `json:"passed"`
+	Reason         string     `json:"reason,omitempty"`
+	NextEligibleAt *time.Time `json:"next_eligible_at,omitempty"` // When a failed rule will pass again, if it will
 }
 
 type NoRule struct{}
 
-func (r NoRule) Check(ctx context.Context, customerID string) bool {
-	return true
+func (r NoRule) Name() string {
+	return "none"
+}
+
+func (r NoRule) Check(ctx context.Context, customerID string) RuleResult {
+	return RuleResult{Rule: r.Name(), Passed: true}
 }
 
 type MaxPerCustomerRule struct {
+	Store     Store
 	MaxCount  int
 	TimeLimit int // in days, 0 or null means no time limit
 }
 
-func (r MaxPerCustomerRule) Check(ctx context.Context, customerID string) bool {
-	query := `
-		SELECT COUNT(*)
-		FROM code_usage
-		WHERE customer_id = $1`
-	args := []interface{}{customerID}
+func (r MaxPerCustomerRule) Name() string {
+	return "maxpercustomer"
+}
 
+func (r MaxPerCustomerRule) Check(ctx context.Context, customerID string) RuleResult {
+	result := RuleResult{Rule: r.Name()}
+	var since time.Time
+	var window string
 	if r.TimeLimit > 0 {
-		query += ` AND used_at >= $2`
-		args = append(args, time.Now().AddDate(0, 0, -r.TimeLimit))
+		since = time.Now().AddDate(0, 0, -r.TimeLimit)
+		window = fmt.Sprintf(" in the last %d days", r.TimeLimit)
 	}
 
-	var count int
-	err := db.QueryRow(ctx, query, args...).Scan(&count)
-
+	count, err := r.Store.CountRedemptions(ctx, customerID, since)
 	if err != nil {
-		log.Printf("Error checking MaxPerCustomerRule: %v", err)
-		return false
+		loggerFromContext(ctx).Error("Error checking MaxPerCustomerRule", "customer_id", CustomerID(customerID), "error", err)
+		result.Reason = "the customer's codes could not be counted"
+		return result
+	}
+
+	result.Passed = count < r.MaxCount
+	result.Reason = fmt.Sprintf("customer has %d/%d codes%s", count, r.MaxCount, window)
+	if !result.Passed && r.TimeLimit > 0 {
+		next, err := r.nextEligibleAt(ctx, customerID, since)
+		if err != nil {
+			loggerFromContext(ctx).Error("Error finding when the customer is next eligible", "customer_id", CustomerID(customerID), "error", err)
+		} else if !next.IsZero() {
+			result.NextEligibleAt = &next
+			result.Reason += ", next eligible at " + next.Format(time.RFC3339)
+		}
 	}
+	return result
+}
 
-	return count < r.MaxCount
+// nextEligibleAt returns when the customer will have fewer than MaxCount
+// redemptions within the time limit, which is when the MaxCount-th most
+// recent one leaves it.
+func (r MaxPerCustomerRule) nextEligibleAt(ctx context.Context, customerID string, since time.Time) (time.Time, error) {
+	redemptions, err := r.Store.GetRedemptions(ctx, RedemptionFilter{CustomerID: customerID, From: since, Limit: r.MaxCount})
+	if err != nil || len(redemptions) < r.MaxCount {
+		return time.Time{}, err
+	}
+	return redemptions[r.MaxCount-1].RedeemedAt.AddDate(0, 0, r.TimeLimit).UTC(), nil
 }
 
-func checkRules(rules Rules, customerID string) bool {
-	ctx := context.Background()
+// checkRules returns a RuleError if the customer fails any of the batch's
+// rules, or nil if they pass them all.
+func checkRules(ctx context.Context, store Store, rules Rules, customerID string) error {
+	results := evaluateRules(ctx, store, rules, customerID)
+	for _, result := range results {
+		if !result.Passed {
+			return &RuleError{Rule: result.Rule, Results: results}
+		}
+	}
+	return nil
+}
 
+// evaluateRules checks each of the batch's rules for the customer.
+func evaluateRules(ctx context.Context, store Store, rules Rules, customerID string) []RuleResult {
 	var ruleCheckers []Rule
 
 	if rules.MaxPerCustomer > 0 {
 		ruleCheckers = append(ruleCheckers, MaxPerCustomerRule{
+			Store:     store,
 			MaxCount:  rules.MaxPerCustomer,
 			TimeLimit: rules.TimeLimit,
 		})
@@ -300,11 +469,16 @@ func checkRules(rules Rules, customerID string) bool {
 		ruleCheckers = append(ruleCheckers, NoRule{})
 	}
 
+	results := make([]RuleResult, 0, len(ruleCheckers))
 	for _, rule := range ruleCheckers {
-		if !rule.Check(ctx, customerID) {
-			return false
+		start := time.Now()
+		result := rule.Check(ctx, customerID)
+		ruleCheckDuration.WithLabelValues(rule.Name()).Observe(time.Since(start).Seconds())
+		if !result.Passed {
+			loggerFromContext(ctx).Info("Rule check failed", "rule", result.Rule, "reason", result.Reason, "customer_id", CustomerID(customerID))
 		}
+		results = append(results, result)
 	}
 
-	return true
+	return results
 }
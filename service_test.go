@@ -4,16 +4,33 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/joshghent/ango/client"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestMain(m *testing.M) {
+	// Tests are configured from the environment, the same way as the server
+	var err error
+	appConfig, err = loadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
 func TestGetCodeWithTimeout(t *testing.T) {
 	// Setup database connection for tests
 	var err error
@@ -22,6 +39,7 @@ func TestGetCodeWithTimeout(t *testing.T) {
 		t.Fatalf("Unable to connect to database: %v\n", err)
 	}
 	defer db.Close()
+	store := NewPostgresStore(db)
 
 	// Generate valid UUIDs for testing
 	// This is based on the seed data
@@ -36,7 +54,7 @@ func TestGetCodeWithTimeout(t *testing.T) {
 	}
 
 	t.Run("Successful Code Assignment", func(t *testing.T) {
-		code, err := getCode(context.Background(), req)
+		code, err := getCode(context.Background(), store, req)
 		assert.Nil(t, err, "Expected no error")
 		assert.NotEmpty(t, code, "Expected code to be returned")
 	})
@@ -47,7 +65,7 @@ func TestGetCodeWithTimeout(t *testing.T) {
 			ClientID:   validClientID,
 			CustomerID: validCustomerID,
 		}
-		code, err := getCode(context.Background(), req)
+		code, err := getCode(context.Background(), store, req)
 		assert.Equal(t, ErrNoBatchFound, err, "Expected no batch was found error")
 		assert.Empty(t, code, "Expected no code to be returned")
 	})
@@ -58,7 +76,7 @@ func TestGetCodeWithTimeout(t *testing.T) {
 			ClientID:   validClientID,
 			CustomerID: validCustomerID,
 		}
-		code, err := getCode(context.Background(), req)
+		code, err := getCode(context.Background(), store, req)
 		assert.Equal(t, ErrNoCodeFound, err, "Expected no code was found error")
 		assert.Empty(t, code, "Expected no code to be returned")
 	})
@@ -69,7 +87,7 @@ func TestGetCodeWithTimeout(t *testing.T) {
 			ClientID:   validClientID,
 			CustomerID: validCustomerID,
 		}
-		code, err := getCode(context.Background(), req)
+		code, err := getCode(context.Background(), store, req)
 		assert.Equal(t, ErrBatchExpired, err, "Expected batch expired error")
 		assert.Empty(t, code, "Expected no code to be returned")
 	})
@@ -80,7 +98,7 @@ func TestGetCodeWithTimeout(t *testing.T) {
 			ClientID:   validClientID,
 			CustomerID: validCustomerID,
 		}
-		code, err := getCode(context.Background(), req)
+		code, err := getCode(context.Background(), store, req)
 		assert.NotNil(t, err, "Expected error for invalid BatchID")
 		assert.Contains(t, err.Error(), "invalid batch_id format")
 		assert.Empty(t, code, "Expected no code to be returned")
@@ -92,7 +110,7 @@ func TestGetCodeWithTimeout(t *testing.T) {
 			ClientID:   "invalid-uuid",
 			CustomerID: validCustomerID,
 		}
-		code, err := getCode(context.Background(), req)
+		code, err := getCode(context.Background(), store, req)
 		assert.NotNil(t, err, "Expected error for invalid ClientID")
 		assert.Contains(t, err.Error(), "invalid client_id format")
 		assert.Empty(t, code, "Expected no code to be returned")
@@ -102,9 +120,9 @@ func TestGetCodeWithTimeout(t *testing.T) {
 		req := Request{
 			BatchID:    validBatchID,
 			ClientID:   validClientID,
-			CustomerID: "invalid-uuid",
+			CustomerID: strings.Repeat("x", maxCustomerIDLength+1),
 		}
-		code, err := getCode(context.Background(), req)
+		code, err := getCode(context.Background(), store, req)
 		assert.NotNil(t, err, "Expected error for invalid CustomerID")
 		assert.Contains(t, err.Error(), "invalid customer_id format")
 		assert.Empty(t, code, "Expected no code to be returned")
@@ -140,7 +158,7 @@ func TestGetCodeHandler_InvalidJSON(t *testing.T) {
 			request: `{
                 "batchid": "c6ffca2e-603b-4b14-a39d-9e37b6f1d63b",
                 "clientid": "217be7c8-679c-4e08-bffc-db3451bdcdbf",
-                "customerid": "invalid-customer-id"
+                "customerid": ""
             }`,
 			errorMsg: "invalid customer_id format",
 		},
@@ -153,7 +171,7 @@ func TestGetCodeHandler_InvalidJSON(t *testing.T) {
 			w := httptest.NewRecorder()
 
 			router := gin.Default()
-			router.POST("/api/v1/code/redeem", getCodeHandler)
+			router.POST("/api/v1/code/redeem", getCodeHandler(NewMemoryStore()))
 			router.ServeHTTP(w, req)
 
 			assert.Equal(t, 400, w.Code)
@@ -170,10 +188,11 @@ func TestGetBatchesHandler(t *testing.T) {
 		t.Fatalf("Unable to connect to database: %v\n", err)
 	}
 	defer db.Close()
+	store := NewPostgresStore(db)
 
 	// Create a new gin router
 	router := gin.Default()
-	router.GET("/api/v1/batches", getBatchesHandler)
+	router.GET("/api/v1/batches", getBatchesHandler(store))
 
 	t.Run("Fetch batches successfully", func(t *testing.T) {
 		// Create a new request
@@ -211,10 +230,11 @@ func TestUploadCodesHandler(t *testing.T) {
 		t.Fatalf("Unable to connect to database: %v\n", err)
 	}
 	defer db.Close()
+	store := NewPostgresStore(db)
 
 	// Create a new gin router
 	router := gin.Default()
-	router.POST("/api/v1/codes/upload", uploadCodesHandler)
+	router.POST("/api/v1/codes/upload", uploadCodesHandler(store))
 
 	t.Run("Successful upload", func(t *testing.T) {
 		// Create a new multipart writer
@@ -271,8 +291,8 @@ func TestUploadCodesHandler(t *testing.T) {
 
 		router.ServeHTTP(w, req)
 
-		assert.Equal(t, 500, w.Code)
-		assert.Contains(t, w.Body.String(), "Failed to upload codes")
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), ProblemInvalidRequest)
 	})
 
 	t.Run("CSV missing required columns", func(t *testing.T) {
@@ -280,7 +300,7 @@ func TestUploadCodesHandler(t *testing.T) {
 		writer := multipart.NewWriter(body)
 		_ = writer.WriteField("batch_name", "Test Batch")
 		part, _ := writer.CreateFormFile("file", "test.csv")
-		_, _ = part.Write([]byte("client_id,code\n217be7c8-679c-4e08-bffc-db3451bdcdbf,TESTCODE123"))
+		_, _ = part.Write([]byte("client_id,batch_id\n217be7c8-679c-4e08-bffc-db3451bdcdbf,11111111-1111-1111-1111-111111111111"))
 		writer.Close()
 
 		req, _ := http.NewRequest("POST", "/api/v1/codes/upload", body)
@@ -289,8 +309,8 @@ func TestUploadCodesHandler(t *testing.T) {
 
 		router.ServeHTTP(w, req)
 
-		assert.Equal(t, 500, w.Code)
-		assert.Contains(t, w.Body.String(), "Failed to upload codes")
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), ProblemInvalidRequest)
 	})
 
 	t.Run("No batch name provided", func(t *testing.T) {
@@ -362,3 +382,533 @@ func TestUploadCodesHandler(t *testing.T) {
 		assert.Contains(t, w.Body.String(), "File must be a CSV")
 	})
 }
+
+func TestClientHandlers_InvalidInput(t *testing.T) {
+	store := NewMemoryStore()
+	router := gin.Default()
+	router.POST("/api/v1/clients", createClientHandler(store))
+	router.GET("/api/v1/clients/:id", getClientHandler(store))
+
+	t.Run("Missing client name", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/api/v1/clients", bytes.NewBufferString(`{"metadata": {"tier": "gold"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "Client name is required")
+	})
+
+	t.Run("Invalid client id", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/v1/clients/not-a-uuid", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid client_id format")
+	})
+}
+
+func TestRedemptionHandlers(t *testing.T) {
+	store := NewMemoryStore()
+	batchID, clientID := newTestBatch(t, store, Rules{}, 3)
+	customerID := uuid.New().String()
+	for i := 0; i < 3; i++ {
+		_, err := getCode(context.Background(), store, Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+		assert.NoError(t, err)
+	}
+
+	router := gin.Default()
+	router.GET("/api/v1/batches/:id/redemptions", getBatchRedemptionsHandler(store))
+	router.GET("/api/v1/customers/:id/redemptions", getCustomerRedemptionsHandler(store))
+
+	get := func(path string) (int, RedemptionPage) {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page RedemptionPage
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return w.Code, page
+	}
+
+	t.Run("Pages through a customer's redemptions", func(t *testing.T) {
+		code, page := get("/api/v1/customers/" + customerID + "/redemptions?limit=2&client_id=" + clientID)
+		assert.Equal(t, 200, code)
+		assert.Len(t, page.Redemptions, 2)
+
+		code, page = get("/api/v1/customers/" + customerID + "/redemptions?limit=2&cursor=" + page.NextCursor)
+		assert.Equal(t, 200, code)
+		assert.Len(t, page.Redemptions, 1)
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("Lists a batch's redemptions", func(t *testing.T) {
+		code, page := get("/api/v1/batches/" + batchID + "/redemptions")
+		assert.Equal(t, 200, code)
+		assert.Len(t, page.Redemptions, 3)
+
+		code, _ = get("/api/v1/batches/" + uuid.New().String() + "/redemptions")
+		assert.Equal(t, 404, code)
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		for _, path := range []string{
+			"/api/v1/customers/" + strings.Repeat("x", maxCustomerIDLength+1) + "/redemptions",
+			"/api/v1/customers/" + customerID + "/redemptions?from=yesterday",
+			"/api/v1/customers/" + customerID + "/redemptions?limit=0",
+			"/api/v1/customers/" + customerID + "/redemptions?cursor=nonsense",
+			"/api/v1/batches/" + batchID + "/redemptions?client_id=nope",
+			"/api/v1/batches/" + batchID + "/redemptions?batch_id=" + uuid.New().String(),
+		} {
+			code, _ := get(path)
+			assert.Equal(t, 400, code, path)
+		}
+	})
+}
+
+func TestEraseCustomerHandler(t *testing.T) {
+	store := NewMemoryStore()
+	batchID, clientID := newTestBatch(t, store, Rules{}, 3)
+	customerID := uuid.New().String()
+	for i := 0; i < 2; i++ {
+		_, err := getCode(context.Background(), store, Request{BatchID: batchID, ClientID: clientID, CustomerID: customerID})
+		assert.NoError(t, err)
+	}
+
+	router := gin.Default()
+	router.DELETE("/api/v1/customers/:id", eraseCustomerHandler(store))
+
+	erase := func(id string) (int, ErasureResult) {
+		req, _ := http.NewRequest("DELETE", "/api/v1/customers/"+id, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var result ErasureResult
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+
+	code, result := erase(customerID)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, ErasureResult{CustomerID: customerID, Redemptions: 2}, result)
+
+	code, result = erase(customerID)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 0, result.Redemptions)
+
+	code, _ = erase(strings.Repeat("x", maxCustomerIDLength+1))
+	assert.Equal(t, 400, code)
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		t.Fatalf("Unable to load the OpenAPI document: %v", err)
+	}
+
+	store := NewMemoryStore()
+	batchID, clientID := newTestBatch(t, store, Rules{MaxPerCustomer: 1}, 3)
+	unusedClient, err := createClient(context.Background(), store, ClientRequest{Name: "Unused"})
+	assert.NoError(t, err)
+	customerID := uuid.New().String()
+
+	router := gin.New()
+	router.Use(requestID(), validateResponses(spec, func(c *gin.Context, err error) {
+		t.Errorf("%s %s returned %d, which does not match the spec: %v", c.Request.Method, c.Request.URL, c.Writer.Status(), err)
+	}))
+	registerRoutes(router, store, spec)
+
+	serve := func(method, path, contentType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Every route is documented", func(t *testing.T) {
+		routes := map[string]bool{}
+		for _, route := range router.Routes() {
+			routes[route.Method+" "+openAPIPath(route.Path)] = true
+		}
+		documented := map[string]bool{}
+		for path, item := range spec.Paths.Map() {
+			for method := range item.Operations() {
+				documented[method+" "+path] = true
+			}
+		}
+		assert.Equal(t, documented, routes)
+	})
+
+	t.Run("Responses match the spec", func(t *testing.T) {
+		redeem := fmt.Sprintf(`{"batchid": %q, "clientid": %q, "customerid": %q}`, batchID, clientID, customerID)
+
+		var upload bytes.Buffer
+		form := multipart.NewWriter(&upload)
+		file, _ := form.CreateFormFile("file", "codes.csv")
+		fmt.Fprintf(file, "client_id,code,extra\n%s,CONTRACT-1,x\n", clientID)
+		form.WriteField("batch_name", "Contract")
+		form.WriteField("rules", `{"maxpercustomer": 1}`)
+		form.Close()
+
+		for _, tt := range []struct {
+			method, path, body string
+			status             int
+		}{
+			{"GET", "/openapi.json", "", 200},
+			{"GET", "/healthcheck", "", 200},
+			{"GET", "/livez", "", 200},
+			{"GET", "/readyz", "", 200},
+			{"GET", "/metrics", "", 200},
+			{"POST", "/api/v1/code/eligibility", redeem, 200},
+			{"POST", "/api/v1/code/redeem", redeem, 200},
+			{"POST", "/api/v1/code/eligibility", redeem, 200},
+			{"POST", "/api/v1/code/redeem", redeem, 403},
+			{"POST", "/api/v1/code/redeem", fmt.Sprintf(`{"batchid": %q, "clientid": %q, "customerid": %q}`, uuid.New(), clientID, customerID), 404},
+			{"GET", "/api/v1/batches", "", 200},
+			{"POST", "/api/v1/batches", `{"name": "Contract", "rules": {"maxpercustomer": 2}}`, 201},
+			{"GET", "/api/v1/batches/" + batchID + "/inventory", "", 200},
+			{"GET", "/api/v1/batches/" + uuid.New().String() + "/inventory", "", 404},
+			{"GET", "/api/v1/batches/" + batchID + "/redemptions", "", 200},
+			{"GET", "/api/v1/customers/" + customerID + "/redemptions?limit=1", "", 200},
+			{"GET", "/api/v1/clients", "", 200},
+			{"POST", "/api/v1/clients", `{"name": "Contract"}`, 201},
+			{"GET", "/api/v1/clients/" + clientID, "", 200},
+			{"GET", "/api/v1/clients/" + uuid.New().String(), "", 404},
+			{"PUT", "/api/v1/clients/" + clientID, `{"name": "Renamed", "metadata": {"tier": "gold"}}`, 200},
+			{"GET", "/api/v1/clients/" + clientID + "/batches", "", 200},
+			{"GET", "/api/v1/clients/" + clientID + "/inventory", "", 200},
+			{"DELETE", "/api/v1/clients/" + clientID, "", 409},
+			{"DELETE", "/api/v1/clients/" + unusedClient.ID, "", 204},
+			{"DELETE", "/api/v1/customers/" + customerID, "", 200},
+			{"POST", "/api/v1/batches/" + batchID + "/expire", "", 200},
+			{"POST", "/api/v1/code/redeem", redeem, 410},
+			{"POST", "/api/v1/batches/" + uuid.New().String() + "/expire", "", 404},
+		} {
+			contentType := ""
+			if tt.body != "" {
+				contentType = "application/json"
+			}
+			w := serve(tt.method, tt.path, contentType, strings.NewReader(tt.body))
+			assert.Equal(t, tt.status, w.Code, "%s %s: %s", tt.method, tt.path, w.Body)
+		}
+
+		w := serve("POST", "/api/v1/codes/upload", form.FormDataContentType(), &upload)
+		assert.Equal(t, 200, w.Code, w.Body.String())
+	})
+
+	t.Run("Requests are validated", func(t *testing.T) {
+		for _, tt := range []struct {
+			method, path, body string
+			detail             string
+		}{
+			{"POST", "/api/v1/code/redeem", `{"batchid": 1, "customerid": "x"}`, "batchid"},
+			{"POST", "/api/v1/code/eligibility", `{"batchid": "` + batchID + `"}`, "customerid"},
+			{"POST", "/api/v1/clients", `{"metadata": {}}`, "name"},
+			{"POST", "/api/v1/batches", `{"name": ""}`, "name"},
+			{"GET", "/api/v1/clients/nope", "", `parameter "id"`},
+			{"GET", "/api/v1/batches/" + batchID + "/redemptions?limit=1000", "", `parameter "limit"`},
+		} {
+			contentType := ""
+			if tt.body != "" {
+				contentType = "application/json"
+			}
+			w := serve(tt.method, tt.path, contentType, strings.NewReader(tt.body))
+			var problem Problem
+			json.Unmarshal(w.Body.Bytes(), &problem)
+			assert.Equal(t, 400, w.Code, "%s %s", tt.method, tt.path)
+			assert.Equal(t, ProblemInvalidRequest, problem.Code)
+			assert.Contains(t, problem.Detail, tt.detail)
+		}
+	})
+}
+
+// TestClientSDK runs the client package against the real routes.
+func TestClientSDK(t *testing.T) {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		t.Fatalf("Unable to load the OpenAPI document: %v", err)
+	}
+
+	store := NewMemoryStore()
+	batchID, clientID := newTestBatch(t, store, Rules{MaxPerCustomer: 1}, 3)
+
+	router := gin.New()
+	router.Use(requestID(), validateResponses(spec, func(c *gin.Context, err error) {
+		t.Errorf("%s %s returned %d, which does not match the spec: %v", c.Request.Method, c.Request.URL, c.Writer.Status(), err)
+	}))
+	registerRoutes(router, store, spec)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	ctx := context.Background()
+	api := client.New(srv.URL)
+	req := client.RedeemRequest{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String(), IdempotencyKey: "key-1"}
+
+	code, err := api.Redeem(ctx, req)
+	assert.NoError(t, err)
+	retried, err := api.Redeem(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, code, retried)
+
+	req.IdempotencyKey = ""
+	_, err = api.Redeem(ctx, req)
+	assert.ErrorIs(t, err, client.ErrConditionNotMet)
+	var apiErr *client.Error
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, "maxpercustomer", apiErr.Rule())
+	}
+
+	_, err = api.Redeem(ctx, client.RedeemRequest{BatchID: uuid.New().String(), ClientID: clientID, CustomerID: "customer"})
+	assert.ErrorIs(t, err, client.ErrNoBatchFound)
+	_, err = api.GetClient(ctx, uuid.New().String())
+	assert.ErrorIs(t, err, client.ErrNoClientFound)
+
+	uploaded, err := api.UploadCodes(ctx, client.Upload{
+		BatchName: "Uploaded",
+		CSV:       strings.NewReader("client_id,code,extra\n" + clientID + ",SDK-1,\n"),
+	})
+	assert.NoError(t, err)
+	batches, err := api.ListClientBatches(ctx, clientID)
+	assert.NoError(t, err)
+	inventory := map[string]client.Inventory{}
+	for _, batch := range batches {
+		inventory[batch.ID] = batch.Inventory
+	}
+	assert.Equal(t, client.Inventory{Total: 1, Available: 1}, inventory[uploaded])
+	assert.Equal(t, client.Inventory{Total: 3, Redeemed: 1, Available: 2}, inventory[batchID])
+
+	created, err := api.CreateBatch(ctx, "Created", client.Rules{MaxPerCustomer: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, created.Rules.MaxPerCustomer)
+	expired, err := api.ExpireBatch(ctx, created.ID)
+	assert.NoError(t, err)
+	assert.True(t, expired.Expired)
+	stats, err := api.GetBatchInventory(ctx, uploaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "Uploaded", stats.Name)
+	assert.Equal(t, 1, stats.Available)
+}
+
+func TestClientHandlers(t *testing.T) {
+	// Setup database connection for tests
+	var err error
+	db, err = connectToDB() // Ensuring db is set globally as it might be used elsewhere
+	if err != nil {
+		t.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	defer db.Close()
+	store := NewPostgresStore(db)
+
+	router := gin.Default()
+	router.POST("/api/v1/clients", createClientHandler(store))
+	router.GET("/api/v1/clients/:id", getClientHandler(store))
+	router.PUT("/api/v1/clients/:id", updateClientHandler(store))
+	router.DELETE("/api/v1/clients/:id", deleteClientHandler(store))
+	router.GET("/api/v1/clients/:id/batches", getClientBatchesHandler(store))
+	router.POST("/api/v1/codes/upload", uploadCodesHandler(store))
+
+	var client Client
+
+	t.Run("Create client", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/api/v1/clients", bytes.NewBufferString(`{"name": "Test Client", "metadata": {"tier": "gold"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 201, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &client))
+		assert.NotEmpty(t, client.ID)
+		assert.Equal(t, "gold", client.Metadata["tier"])
+	})
+
+	t.Run("Update client", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", "/api/v1/clients/"+client.ID, bytes.NewBufferString(`{"name": "Renamed Client"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "Renamed Client")
+	})
+
+	t.Run("Unknown client", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/v1/clients/"+uuid.New().String(), nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 404, w.Code)
+	})
+
+	t.Run("Upload with unknown client is rejected", func(t *testing.T) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("batch_name", "Test Batch")
+		part, _ := writer.CreateFormFile("file", "test.csv")
+		_, _ = part.Write([]byte("client_id,batch_id,code\n" + uuid.New().String() + ",11111111-1111-1111-1111-111111111111,TESTCODE456"))
+		writer.Close()
+
+		req, _ := http.NewRequest("POST", "/api/v1/codes/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 400, w.Code)
+		assert.Contains(t, w.Body.String(), "clients that do not exist")
+	})
+
+	t.Run("Redeem with unknown client", func(t *testing.T) {
+		code, err := getCode(context.Background(), store, Request{
+			BatchID:    "11111111-1111-1111-1111-111111111111",
+			ClientID:   uuid.New().String(),
+			CustomerID: uuid.New().String(),
+		})
+		assert.Equal(t, ErrNoClientFound, err)
+		assert.Empty(t, code)
+	})
+
+	t.Run("List client batches", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/v1/clients/217be7c8-679c-4e08-bffc-db3451bdcdbf/batches", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 200, w.Code)
+		var batches []BatchInventory
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &batches))
+		assert.NotEmpty(t, batches)
+	})
+
+	t.Run("Delete client", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", "/api/v1/clients/"+client.ID, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 204, w.Code)
+	})
+}
+
+func TestReadyzHandler(t *testing.T) {
+	// Setup database connection for tests
+	var err error
+	db, err = connectToDB() // Ensuring db is set globally as it might be used elsewhere
+	if err != nil {
+		t.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	defer db.Close()
+
+	router := gin.Default()
+	router.GET("/readyz", readyzHandler(NewPostgresStore(db)))
+
+	t.Run("Ready", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		var response ReadinessResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, 200, w.Code, response.Checks)
+		assert.Equal(t, "ready", response.Status)
+		assert.Equal(t, "pass", response.Checks["database"].Status)
+		assert.Equal(t, "pass", response.Checks["migrations"].Status)
+	})
+
+	t.Run("Not ready while shutting down", func(t *testing.T) {
+		defer shuttingDown.Store(false)
+		shuttingDown.Store(true)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		assert.Equal(t, 503, w.Code)
+		assert.Contains(t, w.Body.String(), "server is shutting down")
+	})
+}
+
+func TestListenForBatchChanges(t *testing.T) {
+	var err error
+	db, err = connectToDB()
+	if err != nil {
+		t.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	defer db.Close()
+	store := NewPostgresStore(db)
+	ctx := context.Background()
+
+	batchID, _ := newTestBatch(t, store, Rules{}, 0)
+	_, _, err = getRulesForBatch(ctx, store, batchID)
+	assert.NoError(t, err)
+
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go listenForBatchChanges(listenCtx, db)
+
+	// The listener purges the cache when it connects, so re-populate it first
+	assert.Eventually(t, func() bool { return batchCache.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	_, _, err = getRulesForBatch(ctx, store, batchID)
+	assert.NoError(t, err)
+
+	_, err = db.Exec(ctx, "UPDATE batches SET expired = true WHERE id = $1", batchID)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, found := batchCache.Get(batchID)
+		return !found
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, expired, err := getRulesForBatch(ctx, store, batchID)
+	assert.NoError(t, err)
+	assert.True(t, expired)
+}
+
+func TestArchiveBatches(t *testing.T) {
+	var err error
+	db, err = connectToDB()
+	if err != nil {
+		t.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	defer db.Close()
+	store := NewPostgresStore(db)
+	ctx := context.Background()
+
+	batchID, clientID := newTestBatch(t, store, Rules{}, 2)
+	for i := 0; i < 2; i++ {
+		_, err := getCode(ctx, store, Request{BatchID: batchID, ClientID: clientID, CustomerID: uuid.New().String()})
+		assert.NoError(t, err)
+	}
+	activeID, _ := newTestBatch(t, store, Rules{}, 2)
+
+	var out bytes.Buffer
+	assert.NoError(t, runArchiveCommand(ctx, db, []string{"--dry-run"}, &out))
+	assert.Contains(t, out.String(), batchID)
+	assert.NotContains(t, out.String(), activeID)
+
+	out.Reset()
+	assert.NoError(t, runArchiveCommand(ctx, db, nil, &out))
+	assert.Contains(t, out.String(), batchID+" (Test Batch): 2 codes")
+
+	var live, archived int
+	assert.NoError(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM codes WHERE batch_id = $1", batchID).Scan(&live))
+	assert.NoError(t, db.QueryRow(ctx, "SELECT COUNT(*) FROM codes_archive WHERE batch_id = $1", batchID).Scan(&archived))
+	assert.Equal(t, 0, live)
+	assert.Equal(t, 2, archived)
+}
+
+func TestPostgresStore(t *testing.T) {
+	// Setup database connection for tests
+	var err error
+	db, err = connectToDB() // Ensuring db is set globally as it might be used elsewhere
+	if err != nil {
+		t.Fatalf("Unable to connect to database: %v\n", err)
+	}
+	defer db.Close()
+
+	testStore(t, func(t *testing.T) storeFixture {
+		return storeFixture{
+			Store: NewPostgresStore(db),
+			recordUsage: func(t *testing.T, batchID, clientID, customerID string, usedAt time.Time) {
+				_, err := db.Exec(context.Background(), "INSERT INTO code_usage (code, batch_id, client_id, customer_id, used_at) VALUES ('used', $1, $2, $3, $4)",
+					batchID, clientID, customerID, usedAt)
+				assert.NoError(t, err)
+			},
+		}
+	})
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteSchema is applied every time the database is opened. Postgres uses
+// the versioned migrations in db/migrations instead.
+//
+//go:embed db/sqlite/schema.sql
+var sqliteSchema string
+
+// isSQLiteURL reports whether DATABASE_URL selects the SQLite backend, e.g.
+// sqlite:///var/lib/ango/ango.db or sqlite://ango.db for a relative path.
+func isSQLiteURL(url string) bool {
+	return strings.HasPrefix(url, "sqlite://") || strings.HasPrefix(url, "sqlite3://")
+}
+
+// SQLiteStore is a Store for single-node deployments. SQLite has no SKIP
+// LOCKED, so every write transaction takes the database write lock when it
+// begins (_txlock=immediate) and redemptions are serialised.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func OpenSQLiteStore(ctx context.Context, url string) (*SQLiteStore, error) {
+	path := url[strings.Index(url, "://")+3:]
+	if path == "" {
+		return nil, fmt.Errorf("invalid database url: missing the SQLite file path")
+	}
+
+	dsn := "file:" + path + "?_txlock=immediate&_time_format=sqlite" +
+		"&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := upgradeSQLiteSchema(ctx, conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error upgrading SQLite schema: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, sqliteSchema); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error creating SQLite schema: %v", err)
+	}
+	return &SQLiteStore{db: conn}, nil
+}
+
+// sqliteColumns are columns added since the SQLite schema was first released.
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone, so they are added
+// to databases created before them.
+var sqliteColumns = []struct{ table, column, definition string }{
+	{"code_usage", "request_id", "TEXT"},
+	{"code_usage", "anonymised_at", "TIMESTAMP"},
+	{"code_usage", "idempotency_key", "TEXT"},
+}
+
+func upgradeSQLiteSchema(ctx context.Context, conn *sql.DB) error {
+	for _, c := range sqliteColumns {
+		var tableExists, columnExists bool
+		err := conn.QueryRowContext(ctx, `
+			SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?),
+			       EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)
+		`, c.table, c.table, c.column).Scan(&tableExists, &columnExists)
+		if err != nil {
+			return err
+		}
+		if tableExists && !columnExists {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func scanBatch(scan func(dest ...interface{}) error, batch *Batch) error {
+	var rules sql.NullString
+	if err := scan(&batch.ID, &batch.Name, &rules, &batch.Expired); err != nil {
+		return err
+	}
+	if rules.Valid && rules.String != "" {
+		return json.Unmarshal([]byte(rules.String), &batch.Rules)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetBatch(ctx context.Context, batchID string) (Batch, error) {
+	var batch Batch
+	row := s.db.QueryRowContext(ctx, "SELECT id, name, rules, expired FROM batches WHERE id = ?", strings.ToLower(batchID))
+	if err := scanBatch(row.Scan, &batch); err != nil {
+		if err == sql.ErrNoRows {
+			return Batch{}, ErrNoBatchFound
+		}
+		return Batch{}, err
+	}
+	return batch, nil
+}
+
+func (s *SQLiteStore) GetBatches(ctx context.Context) ([]Batch, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, rules, expired FROM batches WHERE expired = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []Batch
+	for rows.Next() {
+		var batch Batch
+		if err := scanBatch(rows.Scan, &batch); err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
+
+func (s *SQLiteStore) CreateBatch(ctx context.Context, name string, rules Rules) (string, error) {
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return "", err
+	}
+
+	batchID := uuid.New().String()
+	_, err = s.db.ExecContext(ctx, "INSERT INTO batches (id, name, rules) VALUES (?, ?, ?)", batchID, name, string(encoded))
+	if err != nil {
+		return "", err
+	}
+	return batchID, nil
+}
+
+func (s *SQLiteStore) ExpireBatch(ctx context.Context, batchID string) error {
+	res, err := s.db.ExecContext(ctx, "UPDATE batches SET expired = 1 WHERE id = ?", strings.ToLower(batchID))
+	if err != nil {
+		return err
+	}
+	expired, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if expired == 0 {
+		return ErrNoBatchFound
+	}
+	return nil
+}
+
+func (s *SQLiteStore) CreateBatchWithCodes(ctx context.Context, name string, rules Rules, codes []NewCode) (string, error) {
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	batchID := uuid.New().String()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO batches (id, name, rules) VALUES (?, ?, ?)", batchID, name, string(encoded)); err != nil {
+		return "", err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO codes (client_id, batch_id, code) VALUES (?, ?, ?)")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	for _, code := range codes {
+		if _, err := stmt.ExecContext(ctx, strings.ToLower(code.ClientID), batchID, code.Code); err != nil {
+			return "", fmt.Errorf("error executing bulk insert: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("error committing transaction: %v", err)
+	}
+	return batchID, nil
+}
+
+// ClaimCode holds the write lock for the whole claim, so the selected code
+// cannot be taken by another request before it is updated.
+func (s *SQLiteStore) ClaimCode(ctx context.Context, batchID, clientID, customerID string, check func(ctx context.Context) error) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var code string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, code
+		FROM codes
+		WHERE batch_id = ? AND client_id = ? AND customer_id IS NULL
+		LIMIT 1
+	`, strings.ToLower(batchID), strings.ToLower(clientID)).Scan(&id, &code)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrNoCodeFound
+		}
+		return "", err
+	}
+
+	if err := check(ctx); err != nil {
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE codes SET customer_id = ? WHERE id = ?", customerID, id); err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO code_usage (code, batch_id, client_id, customer_id, used_at, request_id, idempotency_key)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))
+	`, code, strings.ToLower(batchID), strings.ToLower(clientID), customerID, time.Now().UTC(), requestIDFromContext(ctx), idempotencyKeyFromContext(ctx))
+	if err != nil {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+			// The idempotency key is the only unique column written here
+			return "", ErrDuplicateIdempotencyKey
+		}
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (s *SQLiteStore) CountRedemptions(ctx context.Context, customerID string, since time.Time) (int, error) {
+	query := "SELECT COUNT(*) FROM code_usage WHERE customer_id = ?"
+	args := []interface{}{customerID}
+
+	if !since.IsZero() {
+		query += " AND used_at >= ?"
+		args = append(args, since.UTC())
+	}
+
+	var count int
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
+func (s *SQLiteStore) GetRedemptions(ctx context.Context, filter RedemptionFilter) ([]Redemption, error) {
+	query := `
+		SELECT u.id, u.code, u.batch_id, COALESCE(b.name, ''), u.client_id, u.customer_id, u.used_at, COALESCE(u.request_id, '')
+		FROM code_usage u
+		LEFT JOIN batches b ON b.id = u.batch_id
+		WHERE 1 = 1`
+	var args []interface{}
+
+	if filter.CustomerID != "" {
+		query += " AND u.customer_id = ?"
+		args = append(args, filter.CustomerID)
+	}
+	if filter.BatchID != "" {
+		query += " AND u.batch_id = ?"
+		args = append(args, strings.ToLower(filter.BatchID))
+	}
+	if filter.ClientID != "" {
+		query += " AND u.client_id = ?"
+		args = append(args, strings.ToLower(filter.ClientID))
+	}
+	if filter.IdempotencyKey != "" {
+		query += " AND u.idempotency_key = ?"
+		args = append(args, filter.IdempotencyKey)
+	}
+	if !filter.From.IsZero() {
+		query += " AND u.used_at >= ?"
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query += " AND u.used_at < ?"
+		args = append(args, filter.To.UTC())
+	}
+	if c := filter.Cursor; c != nil {
+		query += " AND (u.used_at < ? OR (u.used_at = ? AND u.id < ?))"
+		args = append(args, c.UsedAt.UTC(), c.UsedAt.UTC(), c.ID)
+	}
+	query += " ORDER BY u.used_at DESC, u.id DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := []Redemption{}
+	for rows.Next() {
+		var r Redemption
+		if err := rows.Scan(&r.ID, &r.Code, &r.BatchID, &r.BatchName, &r.ClientID, &r.CustomerID, &r.RedeemedAt, &r.RequestID); err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, rows.Err()
+}
+
+// sqliteRandomUUID is an expression for a random version 4 UUID, which
+// SQLite has no function for. It's evaluated separately for each row.
+const sqliteRandomUUID = `lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' ||
+	substr('89ab', 1 + (abs(random()) % 4), 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))`
+
+func (s *SQLiteStore) EraseCustomer(ctx context.Context, customerID string) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE codes SET customer_id = "+sqliteRandomUUID+" WHERE customer_id = ?", customerID); err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE code_usage SET customer_id = "+sqliteRandomUUID+", request_id = NULL, idempotency_key = NULL, anonymised_at = ? WHERE customer_id = ?",
+		time.Now().UTC(), customerID)
+	if err != nil {
+		return 0, err
+	}
+	erased, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(erased), tx.Commit()
+}
+
+func (s *SQLiteStore) AnonymiseRedemptions(ctx context.Context, before time.Time) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The codes are updated first, while their redemptions can still be found
+	_, err = tx.ExecContext(ctx, `
+		UPDATE codes SET customer_id = `+sqliteRandomUUID+`
+		WHERE customer_id IS NOT NULL AND EXISTS (
+			SELECT 1 FROM code_usage u
+			WHERE u.batch_id = codes.batch_id AND u.code = codes.code AND u.used_at < ? AND u.anonymised_at IS NULL
+		)
+	`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE code_usage SET customer_id = "+sqliteRandomUUID+", request_id = NULL, idempotency_key = NULL, anonymised_at = ? WHERE used_at < ? AND anonymised_at IS NULL",
+		time.Now().UTC(), before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	anonymised, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(anonymised), tx.Commit()
+}
+
+func scanClient(scan func(dest ...interface{}) error, client *Client) error {
+	var metadata string
+	if err := scan(&client.ID, &client.Name, &metadata, &client.CreatedAt, &client.UpdatedAt); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(metadata), &client.Metadata)
+}
+
+func (s *SQLiteStore) CreateClient(ctx context.Context, client Client) (Client, error) {
+	metadata, err := json.Marshal(client.Metadata)
+	if err != nil {
+		return Client{}, err
+	}
+
+	client.CreatedAt = time.Now().UTC()
+	client.UpdatedAt = client.CreatedAt
+	_, err = s.db.ExecContext(ctx, "INSERT INTO clients (id, name, metadata, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		strings.ToLower(client.ID), client.Name, string(metadata), client.CreatedAt, client.UpdatedAt)
+	if err != nil {
+		return Client{}, err
+	}
+	return client, nil
+}
+
+func (s *SQLiteStore) GetClients(ctx context.Context) ([]Client, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, metadata, created_at, updated_at FROM clients ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []Client{}
+	for rows.Next() {
+		var client Client
+		if err := scanClient(rows.Scan, &client); err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+func (s *SQLiteStore) GetClient(ctx context.Context, clientID string) (Client, error) {
+	var client Client
+	row := s.db.QueryRowContext(ctx, "SELECT id, name, metadata, created_at, updated_at FROM clients WHERE id = ?", strings.ToLower(clientID))
+	if err := scanClient(row.Scan, &client); err != nil {
+		if err == sql.ErrNoRows {
+			return Client{}, ErrNoClientFound
+		}
+		return Client{}, err
+	}
+	return client, nil
+}
+
+func (s *SQLiteStore) UpdateClient(ctx context.Context, client Client) (Client, error) {
+	metadata, err := json.Marshal(client.Metadata)
+	if err != nil {
+		return Client{}, err
+	}
+
+	result, err := s.db.ExecContext(ctx, "UPDATE clients SET name = ?, metadata = ?, updated_at = ? WHERE id = ?",
+		client.Name, string(metadata), time.Now().UTC(), strings.ToLower(client.ID))
+	if err != nil {
+		return Client{}, err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return Client{}, ErrNoClientFound
+	}
+	return s.GetClient(ctx, client.ID)
+}
+
+func (s *SQLiteStore) DeleteClient(ctx context.Context, clientID string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	clientID = strings.ToLower(clientID)
+	var inUse bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM codes WHERE client_id = ?)
+			OR EXISTS (SELECT 1 FROM code_usage WHERE client_id = ?)
+	`, clientID, clientID).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return ErrClientInUse
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM clients WHERE id = ?", clientID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrNoClientFound
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetClientBatches(ctx context.Context, clientID string) ([]BatchInventory, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT b.id, b.name, b.rules, b.expired,
+			COUNT(*), COUNT(c.customer_id)
+		FROM codes c
+		JOIN batches b ON b.id = c.batch_id
+		WHERE c.client_id = ?
+		GROUP BY b.id, b.name, b.rules, b.expired
+		ORDER BY b.name
+	`, strings.ToLower(clientID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []BatchInventory{}
+	for rows.Next() {
+		var batch BatchInventory
+		var rules sql.NullString
+		if err := rows.Scan(&batch.ID, &batch.Name, &rules, &batch.Expired, &batch.Total, &batch.Redeemed); err != nil {
+			return nil, err
+		}
+		if rules.Valid && rules.String != "" {
+			if err := json.Unmarshal([]byte(rules.String), &batch.Rules); err != nil {
+				return nil, err
+			}
+		}
+		batch.Available = batch.Total - batch.Redeemed
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
+
+func (s *SQLiteStore) GetClientInventory(ctx context.Context, clientID string) (ClientInventory, error) {
+	inventory := ClientInventory{ClientID: clientID}
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*), COUNT(customer_id) FROM codes WHERE client_id = ?", strings.ToLower(clientID)).
+		Scan(&inventory.Total, &inventory.Redeemed)
+	if err != nil {
+		return ClientInventory{}, err
+	}
+	inventory.Available = inventory.Total - inventory.Redeemed
+	return inventory, nil
+}
+
+func (s *SQLiteStore) GetBatchInventory(ctx context.Context, batchID string) (BatchInventory, error) {
+	var inventory BatchInventory
+	row := s.db.QueryRowContext(ctx, `
+		SELECT b.id, b.name, b.rules, b.expired,
+			COUNT(c.code), COUNT(c.customer_id)
+		FROM batches b
+		LEFT JOIN codes c ON c.batch_id = b.id
+		WHERE b.id = ?
+		GROUP BY b.id, b.name, b.rules, b.expired
+	`, strings.ToLower(batchID))
+	var total, redeemed int
+	err := scanBatch(func(dest ...interface{}) error {
+		return row.Scan(append(dest, &total, &redeemed)...)
+	}, &inventory.Batch)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return BatchInventory{}, ErrNoBatchFound
+		}
+		return BatchInventory{}, err
+	}
+	inventory.Total, inventory.Redeemed, inventory.Available = total, redeemed, total-redeemed
+	return inventory, nil
+}
+
+func (s *SQLiteStore) ClientExists(ctx context.Context, clientID string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM clients WHERE id = ?)", strings.ToLower(clientID)).Scan(&exists)
+	return exists, err
+}
+
+func (s *SQLiteStore) FindClients(ctx context.Context, clientIDs []string) (map[string]bool, error) {
+	found := make(map[string]bool)
+	if len(clientIDs) == 0 {
+		return found, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(clientIDs)), ",")
+	args := make([]interface{}, len(clientIDs))
+	for i, id := range clientIDs {
+		args[i] = strings.ToLower(id)
+	}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM clients WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	return found, rows.Err()
+}
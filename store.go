@@ -0,0 +1,674 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Store is the persistence layer behind the service functions. Postgres is
+// used in production and MemoryStore in unit tests, so both must behave the
+// same way, including the errors they return.
+type Store interface {
+	Ping(ctx context.Context) error
+
+	// GetBatch returns ErrNoBatchFound if the batch does not exist.
+	GetBatch(ctx context.Context, batchID string) (Batch, error)
+	// GetBatches returns every batch that has not expired.
+	GetBatches(ctx context.Context) ([]Batch, error)
+	CreateBatch(ctx context.Context, name string, rules Rules) (string, error)
+	// ExpireBatch marks a batch expired, returning ErrNoBatchFound if it
+	// does not exist. Expiring an expired batch is not an error.
+	ExpireBatch(ctx context.Context, batchID string) error
+	// CreateBatchWithCodes creates a batch holding the codes. Either the
+	// batch and every code are created or nothing is.
+	CreateBatchWithCodes(ctx context.Context, name string, rules Rules, codes []NewCode) (string, error)
+
+	// ClaimCode assigns an unclaimed code in the batch to the customer. The
+	// code is held while check runs, and is only claimed if check returns nil.
+	// Returns ErrNoCodeFound if no code is available, and
+	// ErrDuplicateIdempotencyKey if the context's idempotency key has already
+	// been used for the batch and customer.
+	ClaimCode(ctx context.Context, batchID, clientID, customerID string, check func(ctx context.Context) error) (string, error)
+	// CountRedemptions counts the customer's recorded redemptions since the
+	// given time, or all of them if since is zero.
+	CountRedemptions(ctx context.Context, customerID string, since time.Time) (int, error)
+	// GetRedemptions returns the recorded redemptions matching the filter,
+	// newest first.
+	GetRedemptions(ctx context.Context, filter RedemptionFilter) ([]Redemption, error)
+	// EraseCustomer replaces the customer's ID on their codes and redemptions
+	// with random IDs, so that they can't be linked back to the customer.
+	// Claimed codes stay claimed. Returns the number of redemptions erased.
+	EraseCustomer(ctx context.Context, customerID string) (int, error)
+	// AnonymiseRedemptions erases the customer IDs of redemptions made before
+	// the given time, and of the codes they claimed. Returns the number of
+	// redemptions anonymised.
+	AnonymiseRedemptions(ctx context.Context, before time.Time) (int, error)
+
+	CreateClient(ctx context.Context, client Client) (Client, error)
+	GetClients(ctx context.Context) ([]Client, error)
+	// GetClient, UpdateClient and DeleteClient return ErrNoClientFound if the
+	// client does not exist. DeleteClient returns ErrClientInUse if it has codes.
+	GetClient(ctx context.Context, clientID string) (Client, error)
+	UpdateClient(ctx context.Context, client Client) (Client, error)
+	DeleteClient(ctx context.Context, clientID string) error
+	GetClientBatches(ctx context.Context, clientID string) ([]BatchInventory, error)
+	GetClientInventory(ctx context.Context, clientID string) (ClientInventory, error)
+	// GetBatchInventory counts the batch's codes across every client. Returns
+	// ErrNoBatchFound if the batch does not exist.
+	GetBatchInventory(ctx context.Context, batchID string) (BatchInventory, error)
+	ClientExists(ctx context.Context, clientID string) (bool, error)
+	// FindClients returns the subset of clientIDs that exist, lower-cased.
+	FindClients(ctx context.Context, clientIDs []string) (map[string]bool, error)
+}
+
+// CodeLeaser is implemented by stores that can lease blocks of codes to the
+// Allocator. A leased code is skipped by ClaimCode until its lease expires.
+type CodeLeaser interface {
+	// LeaseCodes leases up to n unclaimed codes to owner for d, including
+	// codes whose previous lease has expired.
+	LeaseCodes(ctx context.Context, batchID, clientID, owner string, n int, d time.Duration) ([]string, error)
+	// AssignLeasedCodes claims codes leased to owner. If any lease has been
+	// lost nothing is assigned and ErrLeaseLost is returned, and if any
+	// idempotency key has already been used nothing is assigned and
+	// ErrDuplicateIdempotencyKey is returned.
+	AssignLeasedCodes(ctx context.Context, owner string, assignments []CodeAssignment) error
+	// RenewLeases extends every unclaimed code leased to owner by d.
+	RenewLeases(ctx context.Context, owner string, d time.Duration) error
+	// ReleaseLeases returns every unclaimed code leased to owner.
+	ReleaseLeases(ctx context.Context, owner string) error
+}
+
+type CodeAssignment struct {
+	BatchID        string
+	ClientID       string
+	Code           string
+	CustomerID     string
+	RequestID      string
+	IdempotencyKey string
+}
+
+// NewCode is a row of an uploaded CSV.
+type NewCode struct {
+	ClientID string
+	Code     string
+}
+
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStore(pool *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{pool: pool}
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+func (s *PostgresStore) GetBatch(ctx context.Context, batchID string) (Batch, error) {
+	var batch Batch
+	err := s.pool.QueryRow(ctx, "SELECT id, name, rules, expired FROM batches WHERE id=$1", batchID).
+		Scan(&batch.ID, &batch.Name, &batch.Rules, &batch.Expired)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Batch{}, ErrNoBatchFound
+		}
+		return Batch{}, err
+	}
+	return batch, nil
+}
+
+func (s *PostgresStore) GetBatches(ctx context.Context) ([]Batch, error) {
+	rows, err := s.pool.Query(ctx, "SELECT id, name, rules, expired FROM batches WHERE expired = false")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []Batch
+	for rows.Next() {
+		var batch Batch
+		err := rows.Scan(&batch.ID, &batch.Name, &batch.Rules, &batch.Expired)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+func (s *PostgresStore) CreateBatch(ctx context.Context, name string, rules Rules) (string, error) {
+	batchID := uuid.New().String()
+	_, err := s.pool.Exec(ctx, "INSERT INTO batches (id, name, rules) VALUES ($1, $2, $3)", batchID, name, rules)
+	if err != nil {
+		return "", err
+	}
+	return batchID, nil
+}
+
+func (s *PostgresStore) ExpireBatch(ctx context.Context, batchID string) error {
+	tag, err := s.pool.Exec(ctx, "UPDATE batches SET expired = true WHERE id = $1", batchID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoBatchFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateBatchWithCodes(ctx context.Context, name string, rules Rules, codes []NewCode) (string, error) {
+	// Start a transaction
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	batchID := uuid.New().String()
+	if _, err := tx.Exec(ctx, "INSERT INTO batches (id, name, rules) VALUES ($1, $2, $3)", batchID, name, rules); err != nil {
+		return "", err
+	}
+
+	if len(codes) > 0 {
+		// Prepare the bulk insert statement
+		stmt := "INSERT INTO codes (client_id, batch_id, code) VALUES "
+		var values []interface{}
+		for i, code := range codes {
+			stmt += fmt.Sprintf("($%d, $%d, $%d),", i*3+1, i*3+2, i*3+3)
+			values = append(values, code.ClientID, batchID, code.Code)
+		}
+		stmt = stmt[:len(stmt)-1] // Remove the trailing comma
+
+		// Execute the bulk insert
+		if _, err := tx.Exec(ctx, stmt, values...); err != nil {
+			return "", fmt.Errorf("error executing bulk insert: %v", err)
+		}
+	}
+
+	// Commit the transaction
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("error committing transaction: %v", err)
+	}
+	return batchID, nil
+}
+
+// ClaimCode locks a code with SKIP LOCKED so that concurrent redemptions
+// each get a different code without waiting on one another.
+func (s *PostgresStore) ClaimCode(ctx context.Context, batchID, clientID, customerID string, check func(ctx context.Context) error) (string, error) {
+	logger := loggerFromContext(ctx).With("batch_id", batchID, "client_id", clientID, "customer_id", CustomerID(customerID))
+
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if tx != nil {
+			tx.Rollback(ctx) // Ensure rollback if not committed
+		}
+	}()
+
+	selectCodeTime := time.Now()
+
+	// Attempt to acquire a code
+	selectCtx, span := startSpan(ctx, "getCode.selectCode")
+	var code string
+	err = tx.QueryRow(selectCtx, `
+		SELECT code
+		FROM codes
+		WHERE batch_id = $1 AND client_id = $2 AND customer_id IS NULL
+		  AND (leased_until IS NULL OR leased_until < NOW())
+		FOR NO KEY UPDATE SKIP LOCKED
+		LIMIT 1
+	`, batchID, clientID).Scan(&code)
+	endSpan(span, err)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return "", ErrNoCodeFound
+		}
+		return "", err
+	}
+
+	if elapsed := time.Since(selectCodeTime); elapsed > appConfig.Database.SlowQueryThreshold {
+		logger.Warn("Query for selecting code took too long", durationAttr(elapsed))
+	}
+
+	if err := check(ctx); err != nil {
+		return "", err
+	}
+
+	// Code usage updates
+	updateCodesTime := time.Now()
+	updateCtx, span := startSpan(ctx, "getCode.updateCode")
+	_, err = tx.Exec(updateCtx, "UPDATE codes SET customer_id=$1 WHERE batch_id=$2 AND code=$3", customerID, batchID, code)
+	endSpan(span, err)
+	if err != nil {
+		return "", err
+	}
+	if elapsed := time.Since(updateCodesTime); elapsed > appConfig.Database.SlowQueryThreshold {
+		logger.Warn("Query for updating codes took too long", durationAttr(elapsed))
+	}
+
+	// Record the redemption in the usage ledger. used_at has no time zone, so
+	// it is always written and compared in UTC
+	insertUsageTime := time.Now()
+	insertCtx, span := startSpan(ctx, "getCode.insertUsage")
+	_, err = tx.Exec(insertCtx, `
+		INSERT INTO code_usage (code, batch_id, client_id, customer_id, used_at, request_id, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''))
+	`, code, batchID, clientID, customerID, time.Now().UTC(), requestIDFromContext(ctx), idempotencyKeyFromContext(ctx))
+	endSpan(span, err)
+	if err != nil {
+		if isIdempotencyKeyViolation(err) {
+			return "", ErrDuplicateIdempotencyKey
+		}
+		return "", err
+	}
+	if elapsed := time.Since(insertUsageTime); elapsed > appConfig.Database.SlowQueryThreshold {
+		logger.Warn("Query for inserting code usage took too long", durationAttr(elapsed))
+	}
+
+	commitCtx, span := startSpan(ctx, "getCode.commit")
+	err = tx.Commit(commitCtx)
+	endSpan(span, err)
+	if err != nil {
+		return "", err
+	}
+	tx = nil // Avoid rollback
+
+	return code, nil
+}
+
+func (s *PostgresStore) CountRedemptions(ctx context.Context, customerID string, since time.Time) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM code_usage
+		WHERE customer_id = $1`
+	args := []interface{}{customerID}
+
+	if !since.IsZero() {
+		query += ` AND used_at >= $2`
+		args = append(args, since.UTC())
+	}
+
+	var count int
+	err := s.pool.QueryRow(ctx, query, args...).Scan(&count)
+	return count, err
+}
+
+func (s *PostgresStore) GetRedemptions(ctx context.Context, filter RedemptionFilter) ([]Redemption, error) {
+	query := `
+		SELECT u.id, u.code, u.batch_id, COALESCE(b.name, ''), u.client_id, u.customer_id, u.used_at, COALESCE(u.request_id, '')
+		FROM code_usage u
+		LEFT JOIN batches b ON b.id = u.batch_id
+		WHERE TRUE`
+	var args []interface{}
+	where := func(cond string, value interface{}) {
+		args = append(args, value)
+		query += fmt.Sprintf(" AND "+cond, len(args))
+	}
+
+	if filter.CustomerID != "" {
+		where("u.customer_id = $%d", filter.CustomerID)
+	}
+	if filter.BatchID != "" {
+		where("u.batch_id = $%d", filter.BatchID)
+	}
+	if filter.ClientID != "" {
+		where("u.client_id = $%d", filter.ClientID)
+	}
+	if filter.IdempotencyKey != "" {
+		where("u.idempotency_key = $%d", filter.IdempotencyKey)
+	}
+	if !filter.From.IsZero() {
+		where("u.used_at >= $%d", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		where("u.used_at < $%d", filter.To.UTC())
+	}
+	if filter.Cursor != nil {
+		args = append(args, filter.Cursor.UsedAt.UTC(), filter.Cursor.ID)
+		query += fmt.Sprintf(" AND (u.used_at, u.id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY u.used_at DESC, u.id DESC LIMIT $%d", len(args))
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	redemptions := []Redemption{}
+	for rows.Next() {
+		var r Redemption
+		if err := rows.Scan(&r.ID, &r.Code, &r.BatchID, &r.BatchName, &r.ClientID, &r.CustomerID, &r.RedeemedAt, &r.RequestID); err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, r)
+	}
+	return redemptions, rows.Err()
+}
+
+func (s *PostgresStore) EraseCustomer(ctx context.Context, customerID string) (int, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range []string{"codes", "codes_archive"} {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("UPDATE %s SET customer_id = gen_random_uuid()::text WHERE customer_id = $1", table), customerID); err != nil {
+			return 0, err
+		}
+	}
+	tag, err := tx.Exec(ctx, `
+		UPDATE code_usage SET customer_id = gen_random_uuid()::text, request_id = NULL, idempotency_key = NULL, anonymised_at = $2
+		WHERE customer_id = $1
+	`, customerID, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), tx.Commit(ctx)
+}
+
+// anonymiseBatchSize limits how many redemptions are anonymised per
+// statement, so that the retention job doesn't hold locks on a large ledger.
+const anonymiseBatchSize = 1000
+
+func (s *PostgresStore) AnonymiseRedemptions(ctx context.Context, before time.Time) (int, error) {
+	total := 0
+	for {
+		var n int
+		err := s.pool.QueryRow(ctx, `
+			WITH expired AS (
+				UPDATE code_usage SET customer_id = gen_random_uuid()::text, request_id = NULL, idempotency_key = NULL, anonymised_at = $3
+				WHERE id IN (
+					SELECT id FROM code_usage
+					WHERE used_at < $1 AND anonymised_at IS NULL
+					LIMIT $2
+				)
+				RETURNING batch_id, code
+			), codes_erased AS (
+				UPDATE codes SET customer_id = gen_random_uuid()::text
+				FROM expired e
+				WHERE codes.batch_id = e.batch_id AND codes.code = e.code AND codes.customer_id IS NOT NULL
+			), archive_erased AS (
+				UPDATE codes_archive SET customer_id = gen_random_uuid()::text
+				FROM expired e
+				WHERE codes_archive.batch_id = e.batch_id AND codes_archive.code = e.code AND codes_archive.customer_id IS NOT NULL
+			)
+			SELECT COUNT(*) FROM expired
+		`, before.UTC(), anonymiseBatchSize, time.Now().UTC()).Scan(&n)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n < anonymiseBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (s *PostgresStore) CreateClient(ctx context.Context, client Client) (Client, error) {
+	err := s.pool.QueryRow(ctx, `
+		INSERT INTO clients (id, name, metadata)
+		VALUES ($1, $2, $3)
+		RETURNING created_at, updated_at
+	`, client.ID, client.Name, client.Metadata).Scan(&client.CreatedAt, &client.UpdatedAt)
+	if err != nil {
+		return Client{}, err
+	}
+	return client, nil
+}
+
+func (s *PostgresStore) GetClients(ctx context.Context) ([]Client, error) {
+	rows, err := s.pool.Query(ctx, "SELECT id, name, metadata, created_at, updated_at FROM clients ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []Client{}
+	for rows.Next() {
+		var client Client
+		if err := rows.Scan(&client.ID, &client.Name, &client.Metadata, &client.CreatedAt, &client.UpdatedAt); err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+func (s *PostgresStore) GetClient(ctx context.Context, clientID string) (Client, error) {
+	var client Client
+	err := s.pool.QueryRow(ctx, "SELECT id, name, metadata, created_at, updated_at FROM clients WHERE id = $1", clientID).
+		Scan(&client.ID, &client.Name, &client.Metadata, &client.CreatedAt, &client.UpdatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Client{}, ErrNoClientFound
+		}
+		return Client{}, err
+	}
+	return client, nil
+}
+
+func (s *PostgresStore) UpdateClient(ctx context.Context, client Client) (Client, error) {
+	err := s.pool.QueryRow(ctx, `
+		UPDATE clients SET name = $2, metadata = $3, updated_at = NOW()
+		WHERE id = $1
+		RETURNING id, name, metadata, created_at, updated_at
+	`, client.ID, client.Name, client.Metadata).Scan(&client.ID, &client.Name, &client.Metadata, &client.CreatedAt, &client.UpdatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return Client{}, ErrNoClientFound
+		}
+		return Client{}, err
+	}
+	return client, nil
+}
+
+func (s *PostgresStore) DeleteClient(ctx context.Context, clientID string) error {
+	tag, err := s.pool.Exec(ctx, "DELETE FROM clients WHERE id = $1", clientID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" { // foreign_key_violation
+			return ErrClientInUse
+		}
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoClientFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetClientBatches(ctx context.Context, clientID string) ([]BatchInventory, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT b.id, b.name, b.rules, b.expired,
+			COUNT(*), COUNT(c.customer_id)
+		FROM codes c
+		JOIN batches b ON b.id = c.batch_id
+		WHERE c.client_id = $1
+		GROUP BY b.id, b.name, b.rules, b.expired
+		ORDER BY b.name
+	`, clientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	batches := []BatchInventory{}
+	for rows.Next() {
+		var batch BatchInventory
+		if err := rows.Scan(&batch.ID, &batch.Name, &batch.Rules, &batch.Expired, &batch.Total, &batch.Redeemed); err != nil {
+			return nil, err
+		}
+		batch.Available = batch.Total - batch.Redeemed
+		batches = append(batches, batch)
+	}
+	return batches, rows.Err()
+}
+
+func (s *PostgresStore) GetClientInventory(ctx context.Context, clientID string) (ClientInventory, error) {
+	inventory := ClientInventory{ClientID: clientID}
+	err := s.pool.QueryRow(ctx, "SELECT COUNT(*), COUNT(customer_id) FROM codes WHERE client_id = $1", clientID).
+		Scan(&inventory.Total, &inventory.Redeemed)
+	if err != nil {
+		return ClientInventory{}, err
+	}
+	inventory.Available = inventory.Total - inventory.Redeemed
+	return inventory, nil
+}
+
+func (s *PostgresStore) GetBatchInventory(ctx context.Context, batchID string) (BatchInventory, error) {
+	var inventory BatchInventory
+	err := s.pool.QueryRow(ctx, `
+		SELECT b.id, b.name, b.rules, b.expired,
+			COUNT(c.code), COUNT(c.customer_id)
+		FROM batches b
+		LEFT JOIN codes c ON c.batch_id = b.id
+		WHERE b.id = $1
+		GROUP BY b.id, b.name, b.rules, b.expired
+	`, batchID).Scan(&inventory.ID, &inventory.Name, &inventory.Rules, &inventory.Expired, &inventory.Total, &inventory.Redeemed)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return BatchInventory{}, ErrNoBatchFound
+		}
+		return BatchInventory{}, err
+	}
+	inventory.Available = inventory.Total - inventory.Redeemed
+	return inventory, nil
+}
+
+func (s *PostgresStore) ClientExists(ctx context.Context, clientID string) (bool, error) {
+	var exists bool
+	err := s.pool.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM clients WHERE id = $1)", clientID).Scan(&exists)
+	return exists, err
+}
+
+func (s *PostgresStore) FindClients(ctx context.Context, clientIDs []string) (map[string]bool, error) {
+	rows, err := s.pool.Query(ctx, "SELECT id::text FROM clients WHERE id = ANY($1::uuid[])", clientIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		found[id] = true
+	}
+	return found, rows.Err()
+}
+
+func (s *PostgresStore) LeaseCodes(ctx context.Context, batchID, clientID, owner string, n int, d time.Duration) ([]string, error) {
+	rows, err := s.pool.Query(ctx, `
+		UPDATE codes SET leased_by = $3, leased_until = NOW() + $5 * INTERVAL '1 millisecond'
+		WHERE batch_id = $1 AND id IN (
+			SELECT id
+			FROM codes
+			WHERE batch_id = $1 AND client_id = $2 AND customer_id IS NULL
+			  AND (leased_until IS NULL OR leased_until < NOW())
+			FOR NO KEY UPDATE SKIP LOCKED
+			LIMIT $4
+		)
+		RETURNING code
+	`, batchID, clientID, owner, n, d.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+func (s *PostgresStore) AssignLeasedCodes(ctx context.Context, owner string, assignments []CodeAssignment) error {
+	batchIDs := make([]string, len(assignments))
+	clientIDs := make([]string, len(assignments))
+	codes := make([]string, len(assignments))
+	customerIDs := make([]string, len(assignments))
+	requestIDs := make([]string, len(assignments))
+	idempotencyKeys := make([]string, len(assignments))
+	for i, a := range assignments {
+		batchIDs[i] = a.BatchID
+		clientIDs[i] = a.ClientID
+		codes[i] = a.Code
+		customerIDs[i] = a.CustomerID
+		requestIDs[i] = a.RequestID
+		idempotencyKeys[i] = a.IdempotencyKey
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE codes SET customer_id = a.customer_id, leased_by = NULL, leased_until = NULL
+		FROM unnest($2::uuid[], $3::text[], $4::text[]) AS a(batch_id, code, customer_id)
+		WHERE codes.batch_id = a.batch_id AND codes.code = a.code AND codes.leased_by = $1 AND codes.customer_id IS NULL
+	`, owner, batchIDs, codes, customerIDs)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() != int64(len(assignments)) {
+		return ErrLeaseLost
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO code_usage (code, batch_id, client_id, customer_id, used_at, request_id, idempotency_key)
+		SELECT a.code, a.batch_id, a.client_id, a.customer_id, $7, NULLIF(a.request_id, ''), NULLIF(a.idempotency_key, '')
+		FROM unnest($1::text[], $2::uuid[], $3::uuid[], $4::text[], $5::text[], $6::text[]) AS a(code, batch_id, client_id, customer_id, request_id, idempotency_key)
+	`, codes, batchIDs, clientIDs, customerIDs, requestIDs, idempotencyKeys, time.Now().UTC())
+	if err != nil {
+		if isIdempotencyKeyViolation(err) {
+			return ErrDuplicateIdempotencyKey
+		}
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// isIdempotencyKeyViolation reports whether err is a violation of the unique
+// index on the redemptions' idempotency keys.
+func isIdempotencyKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_code_usage_idempotency_key" // unique_violation
+}
+
+func (s *PostgresStore) RenewLeases(ctx context.Context, owner string, d time.Duration) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE codes SET leased_until = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE leased_by = $1 AND customer_id IS NULL
+	`, owner, d.Milliseconds())
+	return err
+}
+
+func (s *PostgresStore) ReleaseLeases(ctx context.Context, owner string) error {
+	_, err := s.pool.Exec(ctx, "UPDATE codes SET leased_by = NULL, leased_until = NULL WHERE leased_by = $1 AND customer_id IS NULL", owner)
+	return err
+}
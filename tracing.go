@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracer         = otel.Tracer("github.com/joshghent/ango")
+	tracingEnabled = false // Set when an exporter is configured, database queries are only traced then
+)
+
+// setupTracing configures the global tracer provider. The exporter may be
+// "otlp" (configured with the standard OTEL_EXPORTER_OTLP_* variables),
+// "stdout" or "none". The returned function flushes any buffered spans and
+// must be called on shutdown.
+func setupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	// W3C trace context is propagated even when spans are not exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name := cfg.Exporter; name {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	tracingEnabled = true
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a child span of whatever span is in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, unless it is one of the expected outcomes of a
+// redemption, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil && redemptionOutcome(err) == "error" {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// queryTracer turns pgx's query log into spans. pgx v4 only reports a query
+// once it has finished, so each span is back-dated by the query duration.
+type queryTracer struct{}
+
+func (queryTracer) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	duration, ok := data["time"].(time.Duration)
+	if !ok {
+		return
+	}
+
+	end := time.Now()
+	sql, _ := data["sql"].(string)
+	name := msg
+	if fields := strings.Fields(sql); len(fields) > 0 {
+		name = strings.ToUpper(fields[0])
+	}
+
+	_, span := tracer.Start(ctx, "db "+name,
+		trace.WithTimestamp(end.Add(-duration)),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatement(strings.Join(strings.Fields(sql), " ")),
+		),
+	)
+	if err, ok := data["err"].(error); ok {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestQueryTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	defer func() { tracer = previous }()
+	tracer = provider.Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "getCode")
+	queryTracer{}.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{
+		"sql":  "\n        SELECT code\n        FROM codes\n        FOR NO KEY UPDATE SKIP LOCKED",
+		"time": 50 * time.Millisecond,
+	})
+	queryTracer{}.Log(ctx, pgx.LogLevelError, "Exec", map[string]interface{}{
+		"sql":  "UPDATE codes SET customer_id=$1 WHERE code=$2",
+		"time": time.Millisecond,
+		"err":  errors.New("deadlock detected"),
+	})
+	// Messages without a duration are not queries
+	queryTracer{}.Log(ctx, pgx.LogLevelInfo, "Dialing PostgreSQL server", map[string]interface{}{"host": "localhost"})
+	parent.End()
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 3)
+
+	selectSpan := spans[0]
+	assert.Equal(t, "db SELECT", selectSpan.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), selectSpan.Parent().SpanID())
+	assert.Equal(t, 50*time.Millisecond, selectSpan.EndTime().Sub(selectSpan.StartTime()))
+
+	updateSpan := spans[1]
+	assert.Equal(t, "db UPDATE", updateSpan.Name())
+	assert.Len(t, updateSpan.Events(), 1, "Expected the error to be recorded")
+}